@@ -0,0 +1,265 @@
+package catTrackslib
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Access logs are structured, a line per request, as logfmt or JSON, with the request's ID, how long it took,
+// and who made it: the token and its cat, or the share link. Secrets are redacted on the way:
+// query params like api_token, headers like AuthorizationOfCats, and share link tokens in paths.
+// Each request's ID is the X-Request-ID it came with, if it's sensible, or a new one, and is sent back in the response.
+
+const (
+	AccessLogLogfmt = "logfmt"
+	AccessLogJSON   = "json"
+
+	redacted = "REDACTED"
+)
+
+type AccessLogOptions struct {
+	// Format is logfmt or json.
+	Format string
+	// Output is where access logs are written.
+	Output io.Writer
+	// RedactParams are query params whose values are redacted, case-insensitively.
+	RedactParams []string
+	// Headers are request headers logged, if they're sent.
+	Headers []string
+	// RedactHeaders are headers whose values are redacted, wherever they're logged.
+	RedactHeaders []string
+	// RedactPathAfter are path segments the segment after which is redacted, like the token in /share/{token}.
+	RedactPathAfter []string
+}
+
+var DefaultAccessLogOptions = AccessLogOptions{
+	Format:          AccessLogLogfmt,
+	Output:          os.Stdout,
+	RedactParams:    []string{"api_token", "token", "access_token", "secret", "password"},
+	Headers:         []string{"User-Agent", "Referer", "AuthorizationOfCats", "Authorization"},
+	RedactHeaders:   []string{"AuthorizationOfCats", "Authorization", "Cookie", "Proxy-Authorization"},
+	RedactPathAfter: []string{"share"},
+}
+
+func newAccessLogger(opts AccessLogOptions) *slog.Logger {
+	out := opts.Output
+	if out == nil {
+		out = os.Stdout
+	}
+	if opts.Format == AccessLogJSON {
+		return slog.New(slog.NewJSONHandler(out, nil))
+	}
+	return slog.New(slog.NewTextHandler(out, nil))
+}
+
+var accessLog = newAccessLogger(DefaultAccessLogOptions)
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactURL returns a copy of the URL, with its secrets redacted.
+func (o AccessLogOptions) redactURL(in *url.URL) *url.URL {
+	u := *in
+	u.User = nil
+	segs := strings.Split(u.Path, "/")
+	for i := 1; i < len(segs); i++ {
+		if segs[i] != "" && containsFold(o.RedactPathAfter, segs[i-1]) {
+			segs[i] = redacted
+		}
+	}
+	u.Path, u.RawPath = strings.Join(segs, "/"), ""
+	if u.RawQuery != "" {
+		q := u.Query()
+		for k := range q {
+			if containsFold(o.RedactParams, k) {
+				q[k] = []string{redacted}
+			}
+		}
+		u.RawQuery = q.Encode()
+	}
+	return &u
+}
+
+// redactURI returns the request's URI, with its secrets redacted.
+func (o AccessLogOptions) redactURI(r *http.Request) string {
+	return o.redactURL(r.URL).RequestURI()
+}
+
+// redactHeaders returns a copy of the headers, with the secret ones redacted.
+func (o AccessLogOptions) redactHeaders(h http.Header) http.Header {
+	out := h.Clone()
+	for k := range out {
+		if containsFold(o.RedactHeaders, k) {
+			out[k] = []string{redacted}
+		}
+	}
+	return out
+}
+
+// redactRequest returns a copy of the request, for logging, with its URL and headers redacted.
+func (o AccessLogOptions) redactRequest(r *http.Request) *http.Request {
+	out := r.Clone(r.Context())
+	out.URL = o.redactURL(r.URL)
+	out.Header = o.redactHeaders(r.Header)
+	out.RequestURI = ""
+	return out
+}
+
+// accessLogEntry is what's learned about a request on its way through, to be logged once it's done.
+type accessLogEntry struct {
+	id    string
+	token *APIToken
+	share *ShareLink
+}
+
+type accessLogContextKey struct{}
+
+func accessLogEntryFromContext(ctx context.Context) *accessLogEntry {
+	e, _ := ctx.Value(accessLogContextKey{}).(*accessLogEntry)
+	return e
+}
+
+// requestIDFromContext returns the request's ID, or "-" if it hasn't one.
+func requestIDFromContext(ctx context.Context) string {
+	if e := accessLogEntryFromContext(ctx); e != nil {
+		return e.id
+	}
+	return "-"
+}
+
+// noteAccessToken records the token the request was authenticated with, for the access log.
+func noteAccessToken(ctx context.Context, t *APIToken) {
+	if e := accessLogEntryFromContext(ctx); e != nil {
+		e.token = t
+	}
+}
+
+// noteAccessShare records the share link the request was made with, for the access log.
+func noteAccessShare(ctx context.Context, s *ShareLink) {
+	if e := accessLogEntryFromContext(ctx); e != nil {
+		e.share = s
+	}
+}
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// requestID returns the ID the request came with, if it's sensible, or a new one.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-ID"); validRequestID.MatchString(id) {
+		return id
+	}
+	return randomHex(8)
+}
+
+// accessLogWriter records the response's status and size.
+// It passes on flushes, for server-sent events, and hijacks, for websockets.
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (w *accessLogWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessLogWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += n
+	return n, err
+}
+
+func (w *accessLogWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *accessLogWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return h.Hijack()
+}
+
+func (w *accessLogWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// loggingMiddleware gives the request an ID and writes its access log line once it's served.
+func loggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		entry := &accessLogEntry{id: requestID(r)}
+		w.Header().Set("X-Request-ID", entry.id)
+		lw := &accessLogWriter{ResponseWriter: w}
+		next.ServeHTTP(lw, r.WithContext(context.WithValue(r.Context(), accessLogContextKey{}, entry)))
+
+		if lw.status == 0 {
+			lw.status = http.StatusOK
+		}
+		opts := accessLogOptions
+		attrs := []slog.Attr{
+			slog.String("id", entry.id),
+			slog.String("method", r.Method),
+			slog.String("uri", opts.redactURI(r)),
+			slog.String("proto", r.Proto),
+			slog.Int("status", lw.status),
+			slog.Int("size", lw.size),
+			slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("remote", requestIP(r)),
+		}
+		headers := []any{}
+		for _, k := range opts.Headers {
+			if v := r.Header.Get(k); v != "" {
+				if containsFold(opts.RedactHeaders, k) {
+					v = redacted
+				}
+				headers = append(headers, slog.String(k, v))
+			}
+		}
+		if len(headers) > 0 {
+			attrs = append(attrs, slog.Group("header", headers...))
+		}
+		if t := entry.token; t != nil {
+			attrs = append(attrs, slog.String("token", t.ID))
+			if t.Cat != "" {
+				attrs = append(attrs, slog.String("cat", t.Cat))
+			}
+		}
+		if s := entry.share; s != nil {
+			attrs = append(attrs, slog.String("share", s.ID), slog.String("cat", s.Cat))
+		}
+		level := slog.LevelInfo
+		if lw.status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		accessLog.LogAttrs(r.Context(), level, "request", attrs...)
+	})
+}
@@ -0,0 +1,91 @@
+package catTrackslib
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLogRedaction(t *testing.T) {
+	SetDBPath("master", filepath.Join(t.TempDir(), "m.db"))
+	if err := InitBoltDB(); err != nil {
+		t.Fatal(err)
+	}
+	defer GetDB("master").Close()
+	t.Setenv("COTOKEN", "legacy-secret")
+
+	logs, accessLogs := &bytes.Buffer{}, &bytes.Buffer{}
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+	opts := DefaultAccessLogOptions
+	opts.Format, opts.Output = AccessLogJSON, accessLogs
+	SetAccessLogOptions(opts)
+	defer SetAccessLogOptions(DefaultAccessLogOptions)
+
+	rye, _, _ := CreateAPIToken("rye's phone", "rye", "", []string{ScopeRead}, time.Time{})
+	share, _, _ := CreateShareLink("", "rye", nil, nil, time.Now().Add(time.Hour))
+	srv := httptest.NewServer(NewRouter(&RouterOpts{DisableWebsocket: true}))
+	defer srv.Close()
+	get := func(path, header, requestID string) *http.Response {
+		req, _ := http.NewRequest("GET", srv.URL+path, nil)
+		if header != "" {
+			req.Header.Set("AuthorizationOfCats", header)
+		}
+		if requestID != "" {
+			req.Header.Set("X-Request-ID", requestID)
+		}
+		res, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	get("/geofences?api_token="+rye+"&cat=rye", "", "trace-1")
+	get("/geofences", "legacy-secret", "")
+	get("/geofences?api_token=ct_abc_wrongsecret", "", "")
+	res := get("/share/"+share+"/track", "", "not a good id!")
+
+	for _, secret := range []string{rye, "legacy-secret", "wrongsecret", share} {
+		if strings.Contains(accessLogs.String(), secret) || strings.Contains(logs.String(), secret) {
+			t.Errorf("want %.12q redacted, got access logs:\n%s\nlogs:\n%s", secret, accessLogs, logs)
+		}
+	}
+
+	lines := []map[string]any{}
+	for _, l := range strings.Split(strings.TrimSpace(accessLogs.String()), "\n") {
+		m := map[string]any{}
+		if err := json.Unmarshal([]byte(l), &m); err != nil {
+			t.Fatalf("got %q: %v", l, err)
+		}
+		lines = append(lines, m)
+	}
+	if len(lines) != 4 {
+		t.Fatalf("got %d lines, want 4", len(lines))
+	}
+	first := lines[0]
+	if first["id"] != "trace-1" || first["cat"] != "rye" || first["token"] == nil || first["status"] != float64(200) {
+		t.Errorf("got %v, want the request's ID, and rye's token", first)
+	}
+	if _, ok := first["latency_ms"].(float64); !ok || first["uri"] != "/geofences?api_token=REDACTED&cat=rye" {
+		t.Errorf("got %v", first)
+	}
+	if h, _ := lines[1]["header"].(map[string]any); h["AuthorizationOfCats"] != redacted {
+		t.Errorf("got %v, want the header redacted", lines[1])
+	}
+	if lines[2]["status"] != float64(http.StatusForbidden) || !strings.Contains(logs.String(), "Invalid token id: abc") {
+		t.Errorf("got %v, and logs:\n%s", lines[2], logs)
+	}
+	last := lines[3]
+	if id := res.Header.Get("X-Request-ID"); id == "" || id != last["id"] || last["share"] == nil || last["uri"] != "/share/REDACTED/track" {
+		t.Errorf("got %v, with X-Request-ID %q", last, id)
+	}
+}
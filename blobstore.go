@@ -0,0 +1,186 @@
+package catTrackslib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// BlobStore keeps blobs, like catsnap images, by key.
+type BlobStore interface {
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	Get(ctx context.Context, key string) ([]byte, error)
+	Delete(ctx context.Context, key string) error
+}
+
+var ErrBlobNotFound = errors.New("blob not found")
+
+// FSBlobStore keeps blobs as files in a directory, named by their keys.
+type FSBlobStore struct {
+	Dir string
+}
+
+// Path returns the path of the key's file.
+func (s *FSBlobStore) Path(key string) string {
+	return filepath.Join(s.Dir, filepath.Base(key))
+}
+
+func (s *FSBlobStore) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return err
+	}
+	// Write then rename, so nobody reads half a file.
+	tmp := s.Path(key) + "." + randomHex(4) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.Path(key))
+}
+
+func (s *FSBlobStore) Get(ctx context.Context, key string) ([]byte, error) {
+	b, err := os.ReadFile(s.Path(key))
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	return b, err
+}
+
+func (s *FSBlobStore) Delete(ctx context.Context, key string) error {
+	err := os.Remove(s.Path(key))
+	if os.IsNotExist(err) {
+		return ErrBlobNotFound
+	}
+	return err
+}
+
+// S3BlobStore keeps blobs in an S3 bucket, or a bucket of anything speaking S3, like MinIO or Spaces.
+// Credentials come from the environment, as the AWS SDK finds them.
+type S3BlobStore struct {
+	Bucket string
+	// Endpoint, Region and PathStyle are for S3-compatible services; leave them empty for AWS.
+	Endpoint  string
+	Region    string
+	PathStyle bool
+
+	once sync.Once
+	svc  *s3.S3
+	err  error
+}
+
+// client returns the store's S3 client, sharing one session across all requests.
+func (s *S3BlobStore) client() (*s3.S3, error) {
+	s.once.Do(func() {
+		cfg := aws.NewConfig()
+		if s.Endpoint != "" {
+			cfg = cfg.WithEndpoint(s.Endpoint)
+		}
+		if s.Region != "" {
+			cfg = cfg.WithRegion(s.Region)
+		}
+		if s.PathStyle {
+			cfg = cfg.WithS3ForcePathStyle(true)
+		}
+		sess, err := session.NewSession(cfg)
+		if err != nil {
+			s.err = err
+			return
+		}
+		s.svc = s3.New(sess)
+	})
+	return s.svc, s.err
+}
+
+func (s *S3BlobStore) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	svc, err := s.client()
+	if err != nil {
+		return err
+	}
+	_, err = svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(s.Bucket),
+		Key:           aws.String(key),
+		Body:          bytes.NewReader(data),
+		ContentType:   aws.String(contentType),
+		ContentLength: aws.Int64(int64(len(data))),
+	})
+	return err
+}
+
+func (s *S3BlobStore) Get(ctx context.Context, key string) ([]byte, error) {
+	svc, err := s.client()
+	if err != nil {
+		return nil, err
+	}
+	out, err := svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return nil, ErrBlobNotFound
+		}
+		return nil, err
+	}
+	defer out.Body.Close()
+	return io.ReadAll(out.Body)
+}
+
+func (s *S3BlobStore) Delete(ctx context.Context, key string) error {
+	svc, err := s.client()
+	if err != nil {
+		return err
+	}
+	_, err = svc.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+// MemoryBlobStore keeps blobs in memory, for tests and development.
+type MemoryBlobStore struct {
+	mu    sync.Mutex
+	blobs map[string][]byte
+	types map[string]string
+}
+
+func NewMemoryBlobStore() *MemoryBlobStore {
+	return &MemoryBlobStore{blobs: map[string][]byte{}, types: map[string]string{}}
+}
+
+func (s *MemoryBlobStore) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blobs[key] = append([]byte(nil), data...)
+	s.types[key] = contentType
+	return nil
+}
+
+func (s *MemoryBlobStore) Get(ctx context.Context, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.blobs[key]
+	if !ok {
+		return nil, ErrBlobNotFound
+	}
+	return append([]byte(nil), b...), nil
+}
+
+func (s *MemoryBlobStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.blobs[key]; !ok {
+		return ErrBlobNotFound
+	}
+	delete(s.blobs, key)
+	delete(s.types, key)
+	return nil
+}
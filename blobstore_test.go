@@ -0,0 +1,125 @@
+package catTrackslib
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// flakyBlobStore fails its first n puts.
+type flakyBlobStore struct {
+	*MemoryBlobStore
+	n int
+}
+
+func (s *flakyBlobStore) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	if s.n > 0 {
+		s.n--
+		return errors.New("unavailable")
+	}
+	return s.MemoryBlobStore.Put(ctx, key, data, contentType)
+}
+
+func TestBlobStores(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range map[string]BlobStore{
+		"fs":     &FSBlobStore{Dir: t.TempDir()},
+		"memory": NewMemoryBlobStore(),
+	} {
+		if err := store.Put(ctx, "rye.jpg", []byte("meow"), "image/jpeg"); err != nil {
+			t.Fatalf("%s: put: %v", name, err)
+		}
+		if b, err := store.Get(ctx, "rye.jpg"); err != nil || string(b) != "meow" {
+			t.Errorf("%s: got %q, %v", name, b, err)
+		}
+		if err := store.Delete(ctx, "rye.jpg"); err != nil {
+			t.Errorf("%s: delete: %v", name, err)
+		}
+		if _, err := store.Get(ctx, "rye.jpg"); !errors.Is(err, ErrBlobNotFound) {
+			t.Errorf("%s: got %v, want not found", name, err)
+		}
+	}
+}
+
+func TestCatsnapUploadRetries(t *testing.T) {
+	SetDBPath("master", filepath.Join(t.TempDir(), "m.db"))
+	if err := InitBoltDB(); err != nil {
+		t.Fatal(err)
+	}
+	defer GetDB("master").Close()
+	defer SetCatsnapUploadOptions(catsnapUploadOptions)
+	defer SetCatsnapBlobStore(getCatsnapBlobStore())
+
+	store := &flakyBlobStore{MemoryBlobStore: NewMemoryBlobStore(), n: 3}
+	SetCatsnapBlobStore(store)
+	SetCatsnapUploadOptions(CatsnapUploadOptions{Mode: CatsnapUploadSync, Retries: 1, Backoff: 50 * time.Millisecond, MaxBackoff: time.Minute})
+
+	// Sync: two failed attempts, and it's left pending.
+	if err := catsnapLocalStore().Put(context.Background(), "rye_1.jpg", []byte("meow"), "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+	if err := uploadCatsnap("rye_1", []byte("meow"), "image/jpeg"); err == nil {
+		t.Fatal("want the upload to fail")
+	}
+	uploads, _ := getCatsnapUploads()
+	if len(uploads) != 1 || uploads[0].Attempts != 2 || uploads[0].LastError != "unavailable" {
+		t.Fatalf("got %+v, want 1 pending after 2 attempts", uploads)
+	}
+
+	// Not due yet, then due and failing once more, then uploaded from the local copy.
+	retryCatsnapUploads(time.Now())
+	if uploads, _ = getCatsnapUploads(); uploads[0].Attempts != 2 {
+		t.Errorf("want it left until it's due, got %+v", uploads[0])
+	}
+	retryCatsnapUploads(time.Now().Add(time.Hour))
+	if uploads, _ = getCatsnapUploads(); uploads[0].Attempts != 3 {
+		t.Errorf("want a third attempt, got %+v", uploads[0])
+	}
+	retryCatsnapUploads(time.Now().Add(time.Hour))
+	if uploads, _ = getCatsnapUploads(); len(uploads) != 0 {
+		t.Errorf("want it uploaded, got %+v", uploads)
+	}
+	if b, err := store.Get(context.Background(), "rye_1"); err != nil || string(b) != "meow" {
+		t.Errorf("got %q, %v", b, err)
+	}
+
+	// Queued: left for the uploader straight away.
+	SetCatsnapUploadOptions(CatsnapUploadOptions{Mode: CatsnapUploadQueued})
+	if err := uploadCatsnap("rye_2", []byte("purr"), "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+	if uploads, _ = getCatsnapUploads(); len(uploads) != 1 || uploads[0].Attempts != 0 {
+		t.Errorf("got %+v, want 1 queued", uploads)
+	}
+}
+
+func TestCatsnapUploadsHaveNoGPS(t *testing.T) {
+	SetDBPath("master", filepath.Join(t.TempDir(), "m.db"))
+	if err := InitBoltDB(); err != nil {
+		t.Fatal(err)
+	}
+	defer GetDB("master").Close()
+	defer SetCatsnapUploadOptions(catsnapUploadOptions)
+	defer SetCatsnapBlobStore(getCatsnapBlobStore())
+
+	store := NewMemoryBlobStore()
+	SetCatsnapBlobStore(store)
+	SetCatsnapUploadOptions(CatsnapUploadOptions{Mode: CatsnapUploadSync})
+
+	tiff := exifTIFF(-93.25, 44.98, time.Date(2024, 6, 1, 12, 30, 15, 0, time.UTC))
+	lat := append([]byte(nil), exifTag(tiff, int(binary.BigEndian.Uint32(exifTag(tiff, 8, 0x8825))), 0x0002)...)
+	png := append(append([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x00eXIf"), tiff...), "IEND"...)
+	if err := uploadCatsnap("rye_1", png, "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := store.Get(context.Background(), "rye_1"); len(b) != len(png) || bytes.Contains(b, lat) {
+		t.Error("want the uploaded copy's latitude blanked")
+	}
+	if !bytes.Contains(png, lat) {
+		t.Error("want the original left alone")
+	}
+}
@@ -0,0 +1,348 @@
+package catTrackslib
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"net/http"
+	"time"
+)
+
+// Catsnaps are kept as they were sent, in whatever format that was, and their MIME type kept in the imgMIME property.
+// Formats the standard library can decode are checked that they do; others, like HEIC, are passed through as they are.
+// They're served as they were sent only to their cat's owners; anyone else gets them with any GPS EXIF blanked.
+// Optionally, JPEGs without EXIF of their own are served with GPS and time EXIF tags written from their point,
+// where the one asking sees it.
+
+type CatsnapImageOptions struct {
+	// WriteEXIF writes the point's coordinates, as the one asking sees them, and time as EXIF tags
+	// to JPEGs that have no EXIF, as they're served.
+	WriteEXIF bool
+}
+
+var DefaultCatsnapImageOptions = CatsnapImageOptions{}
+
+var errUnsupportedImageType = errors.New("unsupported image type")
+
+// catsnapTypes are the image types accepted for catsnaps, and the extensions they're kept with.
+var catsnapTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+	"image/heic": ".heic",
+	"image/heif": ".heif",
+}
+
+// catsnapExt returns the extension catsnaps of the content type are kept with. Catsnaps from before
+// their types were kept are JPEGs.
+func catsnapExt(contentType string) string {
+	if ext, ok := catsnapTypes[contentType]; ok {
+		return ext
+	}
+	return ".jpg"
+}
+
+// catsnapContentType returns the content type of a catsnap extension, or "" if it isn't one.
+func catsnapContentType(ext string) string {
+	for ct, e := range catsnapTypes {
+		if e == ext {
+			return ct
+		}
+	}
+	return ""
+}
+
+// detectImageType returns the MIME type of the image, or errUnsupportedImageType.
+func detectImageType(b []byte) (string, error) {
+	// HEIF files are ISO media files, with the image's brand in the ftyp box.
+	if len(b) >= 12 && string(b[4:8]) == "ftyp" {
+		switch string(b[8:12]) {
+		case "heic", "heix", "hevc", "hevx", "heim", "heis", "hevm", "hevs":
+			return "image/heic", nil
+		case "mif1", "msf1":
+			return "image/heif", nil
+		}
+	}
+	ct := http.DetectContentType(b)
+	if _, ok := catsnapTypes[ct]; !ok {
+		return "", fmt.Errorf("%w: %s", errUnsupportedImageType, ct)
+	}
+	return ct, nil
+}
+
+// b64ToImageBytes decodes the base64 image, returning its bytes as they are and its MIME type.
+func b64ToImageBytes(b64 string) ([]byte, string, error) {
+	b, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return nil, "", err
+	}
+	ct, err := detectImageType(b)
+	if err != nil {
+		return nil, "", err
+	}
+	switch ct {
+	case "image/jpeg", "image/png", "image/gif":
+		if _, _, err := image.DecodeConfig(bytes.NewReader(b)); err != nil {
+			return nil, "", err
+		}
+	}
+	return b, ct, nil
+}
+
+// jpegHasEXIF reports whether the JPEG has an EXIF segment.
+func jpegHasEXIF(b []byte) bool {
+	for i := 2; i+4 <= len(b) && b[i] == 0xFF; {
+		marker := b[i+1]
+		if marker == 0xDA { // start of scan; the metadata's all before it
+			return false
+		}
+		n := int(binary.BigEndian.Uint16(b[i+2:]))
+		if marker == 0xE1 && i+10 <= len(b) && string(b[i+4:i+10]) == "Exif\x00\x00" {
+			return true
+		}
+		i += 2 + n
+	}
+	return false
+}
+
+// addJPEGEXIF returns the JPEG with an EXIF segment tagging it with where and when it was taken.
+// JPEGs with EXIF of their own are left alone, as are JPEGs it can't make sense of.
+func addJPEGEXIF(b []byte, lng, lat float64, t time.Time) []byte {
+	if len(b) < 4 || b[0] != 0xFF || b[1] != 0xD8 || jpegHasEXIF(b) {
+		return b
+	}
+	tiff := exifTIFF(lng, lat, t)
+	seg := make([]byte, 0, 10+len(tiff))
+	seg = append(seg, 0xFF, 0xE1)
+	seg = binary.BigEndian.AppendUint16(seg, uint16(2+6+len(tiff)))
+	seg = append(seg, "Exif\x00\x00"...)
+	seg = append(seg, tiff...)
+
+	// EXIF goes straight after the start of image, or after the JFIF segment, if there is one.
+	at := 2
+	if b[2] == 0xFF && b[3] == 0xE0 && len(b) >= 6 {
+		at = 4 + int(binary.BigEndian.Uint16(b[4:]))
+		if at > len(b) {
+			return b
+		}
+	}
+	out := make([]byte, 0, len(b)+len(seg))
+	out = append(out, b[:at]...)
+	out = append(out, seg...)
+	return append(out, b[at:]...)
+}
+
+// exifMarkers are what comes before EXIF TIFF data in the formats we keep, and how many bytes after it the TIFF starts:
+// the Exif header of JPEGs' APP1 segments and HEIFs' Exif items, PNGs' eXIf chunk type,
+// and WebPs' EXIF chunk type and size. WebPs with an Exif header are found by it too.
+var exifMarkers = []struct {
+	marker string
+	skip   int
+}{
+	{"Exif\x00\x00", 0},
+	{"eXIf", 0},
+	{"EXIF", 4},
+}
+
+// stripEXIFGPS returns a copy of the image with its EXIF GPS tags blanked where they are,
+// so nothing else in the file moves. An image without them is returned as it is.
+func stripEXIFGPS(b []byte) []byte {
+	var out []byte
+	for _, m := range exifMarkers {
+		for i := 0; ; {
+			at := bytes.Index(b[i:], []byte(m.marker))
+			if at < 0 {
+				break
+			}
+			start := i + at + len(m.marker) + m.skip
+			i += at + 1
+			if start+8 > len(b) || exifByteOrder(b[start:]) == nil {
+				continue
+			}
+			if out == nil {
+				out = append([]byte(nil), b...)
+			}
+			blankTIFFGPS(out[start:])
+		}
+	}
+	if out == nil {
+		return b
+	}
+	return out
+}
+
+// exifByteOrder returns the byte order of the TIFF header, or nil if it isn't one.
+func exifByteOrder(tiff []byte) binary.ByteOrder {
+	switch {
+	case len(tiff) < 8:
+		return nil
+	case string(tiff[:4]) == "MM\x00\x2a":
+		return binary.BigEndian
+	case string(tiff[:4]) == "II\x2a\x00":
+		return binary.LittleEndian
+	}
+	return nil
+}
+
+// exifTypeSizes are the sizes of the TIFF field types.
+var exifTypeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+// blankTIFFGPS zeroes the GPS IFD of the TIFF data, its entries and their values, leaving it an empty IFD.
+// The tiff slice may run on past the TIFF data; offsets out of it are left alone.
+func blankTIFFGPS(tiff []byte) {
+	order := exifByteOrder(tiff)
+	ifd0 := int(order.Uint32(tiff[4:]))
+	if ifd0 < 8 || ifd0+2 > len(tiff) {
+		return
+	}
+	gps := -1
+	for i, n := 0, int(order.Uint16(tiff[ifd0:])); i < n && ifd0+2+12*(i+1) <= len(tiff); i++ {
+		e := tiff[ifd0+2+12*i:]
+		if order.Uint16(e) == 0x8825 {
+			gps = int(order.Uint32(e[8:]))
+		}
+	}
+	if gps < 8 || gps+2 > len(tiff) {
+		return
+	}
+	n := int(order.Uint16(tiff[gps:]))
+	for i := 0; i < n && gps+2+12*(i+1) <= len(tiff); i++ {
+		e := tiff[gps+2+12*i : gps+2+12*(i+1)]
+		size := exifTypeSizes[order.Uint16(e[2:])] * int(order.Uint32(e[4:]))
+		if at := int(order.Uint32(e[8:])); size > 4 && at >= 8 && at+size <= len(tiff) {
+			clear(tiff[at : at+size])
+		}
+		clear(e)
+	}
+	// An IFD of no entries, and no next IFD.
+	clear(tiff[gps:min(gps+6, len(tiff))])
+}
+
+const (
+	exifByte     = 1
+	exifASCII    = 2
+	exifLong     = 4
+	exifRational = 5
+)
+
+type exifEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+func exifASCIIEntry(tag uint16, s string) exifEntry {
+	return exifEntry{tag, exifASCII, uint32(len(s) + 1), append([]byte(s), 0)}
+}
+
+func exifLongEntry(tag uint16, v uint32) exifEntry {
+	return exifEntry{tag, exifLong, 1, binary.BigEndian.AppendUint32(nil, v)}
+}
+
+// exifRationalsEntry encodes the values as rationals over denom.
+func exifRationalsEntry(tag uint16, denom uint32, vs ...float64) exifEntry {
+	b := []byte{}
+	for _, v := range vs {
+		b = binary.BigEndian.AppendUint32(b, uint32(math.Round(v*float64(denom))))
+		b = binary.BigEndian.AppendUint32(b, denom)
+	}
+	return exifEntry{tag, exifRational, uint32(len(vs)), b}
+}
+
+// exifDMS splits decimal degrees into degrees, minutes and seconds.
+func exifDMS(deg float64) (float64, float64, float64) {
+	deg = math.Abs(deg)
+	d := math.Floor(deg)
+	m := math.Floor((deg - d) * 60)
+	s := (deg - d - m/60) * 3600
+	return d, m, s
+}
+
+// exifIFDSize returns how many bytes the IFD takes, with the values that don't fit in its entries.
+func exifIFDSize(entries []exifEntry) int {
+	n := 2 + 12*len(entries) + 4
+	for _, e := range entries {
+		if len(e.value) > 4 {
+			n += len(e.value) + len(e.value)%2
+		}
+	}
+	return n
+}
+
+// appendExifIFD appends the IFD, which starts at offset off in the TIFF data.
+// Entries must be in tag order.
+func appendExifIFD(b []byte, off int, entries []exifEntry) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(entries)))
+	data := []byte{}
+	dataOff := off + 2 + 12*len(entries) + 4
+	for _, e := range entries {
+		b = binary.BigEndian.AppendUint16(b, e.tag)
+		b = binary.BigEndian.AppendUint16(b, e.typ)
+		b = binary.BigEndian.AppendUint32(b, e.count)
+		if len(e.value) <= 4 {
+			v := make([]byte, 4)
+			copy(v, e.value)
+			b = append(b, v...)
+			continue
+		}
+		b = binary.BigEndian.AppendUint32(b, uint32(dataOff+len(data)))
+		data = append(data, e.value...)
+		if len(e.value)%2 == 1 {
+			data = append(data, 0)
+		}
+	}
+	b = binary.BigEndian.AppendUint32(b, 0) // no next IFD
+	return append(b, data...)
+}
+
+// exifTIFF returns big-endian TIFF data with the time, in IFD0 and the EXIF IFD, and the coordinates, in the GPS IFD.
+func exifTIFF(lng, lat float64, t time.Time) []byte {
+	t = t.UTC()
+	stamp := t.Format("2006:01:02 15:04:05")
+
+	latRef, lngRef := "N", "E"
+	if lat < 0 {
+		latRef = "S"
+	}
+	if lng < 0 {
+		lngRef = "W"
+	}
+	latD, latM, latS := exifDMS(lat)
+	lngD, lngM, lngS := exifDMS(lng)
+	gps := []exifEntry{
+		{0x0000, exifByte, 4, []byte{2, 3, 0, 0}}, // GPSVersionID
+		exifASCIIEntry(0x0001, latRef),
+		exifRationalsEntry(0x0002, 10000, latD, latM, latS),
+		exifASCIIEntry(0x0003, lngRef),
+		exifRationalsEntry(0x0004, 10000, lngD, lngM, lngS),
+		exifRationalsEntry(0x0007, 1, float64(t.Hour()), float64(t.Minute()), float64(t.Second())), // GPSTimeStamp
+		exifASCIIEntry(0x001D, t.Format("2006:01:02")),                                             // GPSDateStamp
+	}
+	exif := []exifEntry{
+		exifASCIIEntry(0x9003, stamp),    // DateTimeOriginal
+		exifASCIIEntry(0x9011, "+00:00"), // OffsetTimeOriginal
+	}
+	ifd0 := []exifEntry{
+		exifASCIIEntry(0x0132, stamp), // DateTime
+		exifLongEntry(0x8769, 0),      // EXIF IFD pointer
+		exifLongEntry(0x8825, 0),      // GPS IFD pointer
+	}
+	exifOff := 8 + exifIFDSize(ifd0)
+	gpsOff := exifOff + exifIFDSize(exif)
+	ifd0[1] = exifLongEntry(0x8769, uint32(exifOff))
+	ifd0[2] = exifLongEntry(0x8825, uint32(gpsOff))
+
+	b := []byte{'M', 'M', 0, 42, 0, 0, 0, 8}
+	b = appendExifIFD(b, 8, ifd0)
+	b = appendExifIFD(b, exifOff, exif)
+	return appendExifIFD(b, gpsOff, gps)
+}
@@ -0,0 +1,114 @@
+package catTrackslib
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestCatsnapImageTypes(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	jpg, pngb := &bytes.Buffer{}, &bytes.Buffer{}
+	jpeg.Encode(jpg, img, nil)
+	png.Encode(pngb, img)
+	heic := append([]byte{0, 0, 0, 24}, "ftypheic\x00\x00\x00\x00mif1heic"...)
+
+	for want, b := range map[string][]byte{"image/jpeg": jpg.Bytes(), "image/png": pngb.Bytes(), "image/heic": heic} {
+		got, ct, err := b64ToImageBytes(base64.StdEncoding.EncodeToString(b))
+		if err != nil || ct != want {
+			t.Errorf("got %q, %v, want %s", ct, err, want)
+		}
+		if !bytes.Equal(got, b) {
+			t.Errorf("%s: want the bytes kept as they were", want)
+		}
+	}
+	if _, _, err := b64ToImageBytes(base64.StdEncoding.EncodeToString([]byte("meow"))); !errors.Is(err, errUnsupportedImageType) {
+		t.Errorf("got %v, want unsupported", err)
+	}
+	// A JPEG that doesn't decode is refused.
+	if _, _, err := b64ToImageBytes(base64.StdEncoding.EncodeToString(jpg.Bytes()[:20])); err == nil {
+		t.Error("want a truncated JPEG refused")
+	}
+}
+
+// exifTag returns the value bytes of the tag in the IFD at off, of the big-endian TIFF data.
+func exifTag(tiff []byte, off int, tag uint16) []byte {
+	n := int(binary.BigEndian.Uint16(tiff[off:]))
+	for i := 0; i < n; i++ {
+		e := tiff[off+2+12*i:]
+		if binary.BigEndian.Uint16(e) != tag {
+			continue
+		}
+		size := map[uint16]int{exifByte: 1, exifASCII: 1, exifLong: 4, exifRational: 8}[binary.BigEndian.Uint16(e[2:])]
+		size *= int(binary.BigEndian.Uint32(e[4:]))
+		if size <= 4 {
+			return e[8 : 8+size]
+		}
+		at := int(binary.BigEndian.Uint32(e[8:]))
+		return tiff[at : at+size]
+	}
+	return nil
+}
+
+func TestAddJPEGEXIF(t *testing.T) {
+	jpg := &bytes.Buffer{}
+	jpeg.Encode(jpg, image.NewRGBA(image.Rect(0, 0, 8, 8)), nil)
+	when := time.Date(2024, 6, 1, 12, 30, 15, 0, time.UTC)
+
+	b := addJPEGEXIF(jpg.Bytes(), -93.25, 44.98, when)
+	if !jpegHasEXIF(b) {
+		t.Fatal("want EXIF")
+	}
+	if _, err := jpeg.DecodeConfig(bytes.NewReader(b)); err != nil {
+		t.Fatalf("want it still a JPEG: %v", err)
+	}
+	if again := addJPEGEXIF(b, 0, 0, time.Now()); !bytes.Equal(again, b) {
+		t.Error("want EXIF already there left alone")
+	}
+
+	tiff := b[bytes.Index(b, []byte("Exif\x00\x00"))+6:]
+	if got := string(exifTag(tiff, 8, 0x0132)); got != "2024:06:01 12:30:15\x00" {
+		t.Errorf("got DateTime %q", got)
+	}
+	gps := int(binary.BigEndian.Uint32(exifTag(tiff, 8, 0x8825)))
+	if ref := string(exifTag(tiff, gps, 0x0003)); ref != "W\x00" {
+		t.Errorf("got longitude ref %q", ref)
+	}
+	lat := exifTag(tiff, gps, 0x0002)
+	deg := 0.0
+	for i, div := range []float64{1, 60, 3600} {
+		deg += float64(binary.BigEndian.Uint32(lat[8*i:])) / float64(binary.BigEndian.Uint32(lat[8*i+4:])) / div
+	}
+	if math.Abs(deg-44.98) > 1e-6 {
+		t.Errorf("got latitude %v", deg)
+	}
+}
+
+func TestStripEXIFGPS(t *testing.T) {
+	tiff := exifTIFF(-93.25, 44.98, time.Date(2024, 6, 1, 12, 30, 15, 0, time.UTC))
+	gps := int(binary.BigEndian.Uint32(exifTag(tiff, 8, 0x8825)))
+	lat := append([]byte(nil), exifTag(tiff, gps, 0x0002)...)
+
+	// As a HEIC's Exif item has it, and as a PNG's eXIf chunk does.
+	heic := append(append([]byte("\x00\x00\x00\x18ftypheic....\x00\x00\x00\x06Exif\x00\x00"), tiff...), "mdat"...)
+	png := append(append([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x00eXIf"), tiff...), "IEND"...)
+	for name, b := range map[string][]byte{"heic": heic, "png": png} {
+		got := stripEXIFGPS(b)
+		if len(got) != len(b) || bytes.Contains(got, lat) || !bytes.Contains(b, lat) {
+			t.Errorf("%s: want the latitude blanked in place, and the original left alone", name)
+		}
+		if !bytes.Contains(got, []byte("2024:06:01 12:30:15")) {
+			t.Errorf("%s: want the rest of the EXIF kept", name)
+		}
+	}
+	if b := []byte("no exif here"); &stripEXIFGPS(b)[0] != &b[0] {
+		t.Error("want an image without EXIF returned as it is")
+	}
+}
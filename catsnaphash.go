@@ -0,0 +1,278 @@
+package catTrackslib
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"log"
+	"math/bits"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/paulmach/orb/geojson"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Catsnaps get a difference hash (dHash) of their image as they're stored, kept in the imgHash property
+// and indexed per cat in the catsnap hashes bucket, keyed by Name+catsnap key.
+// A snap whose hash is within MaxDistance bits of one of the cat's snaps already stored is a near-duplicate:
+// the same photo resent, or re-encoded. It's either flagged, with imgDuplicateOf naming the snap it duplicates,
+// or its image is skipped, leaving just the point.
+// Images we can't decode, like HEIC, aren't hashed.
+
+const (
+	CatsnapDedupeOff  = "off"
+	CatsnapDedupeFlag = "flag"
+	CatsnapDedupeSkip = "skip"
+)
+
+type CatsnapDedupeOptions struct {
+	// Action is what's done with near-duplicates: off, flag or skip.
+	Action string
+	// MaxDistance is the most bits two hashes can differ by for the snaps to be near-duplicates.
+	MaxDistance int
+}
+
+var DefaultCatsnapDedupeOptions = CatsnapDedupeOptions{
+	Action:      CatsnapDedupeFlag,
+	MaxDistance: 6,
+}
+
+// dHash returns the difference hash of the image: it's shrunk to 9x8 grey pixels,
+// and each bit is whether a pixel is brighter than the one to its right.
+func dHash(img image.Image) uint64 {
+	const w, h = 9, 8
+	b := img.Bounds()
+	var grey [h][w]float64
+	for y := 0; y < h; y++ {
+		y0 := b.Min.Y + y*b.Dy()/h
+		y1 := max(y0+1, b.Min.Y+(y+1)*b.Dy()/h)
+		for x := 0; x < w; x++ {
+			x0 := b.Min.X + x*b.Dx()/w
+			x1 := max(x0+1, b.Min.X+(x+1)*b.Dx()/w)
+			var sum, n float64
+			// Sample at most 16x16 pixels under each cell; it's plenty for a hash.
+			stepY, stepX := max(1, (y1-y0)/16), max(1, (x1-x0)/16)
+			for sy := y0; sy < y1; sy += stepY {
+				for sx := x0; sx < x1; sx += stepX {
+					r, g, bl, _ := img.At(sx, sy).RGBA()
+					sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(bl)
+					n++
+				}
+			}
+			grey[y][x] = sum / n
+		}
+	}
+	var hash uint64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w-1; x++ {
+			hash <<= 1
+			if grey[y][x] > grey[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// imageDHash decodes the image and returns its dHash, if it's a format we can decode.
+func imageDHash(data []byte) (uint64, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	return dHash(img), nil
+}
+
+func hashDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+func formatImgHash(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
+
+func parseImgHash(s string) (uint64, bool) {
+	h, err := strconv.ParseUint(s, 16, 64)
+	return h, err == nil
+}
+
+func catsnapHashKey(name, key string) []byte {
+	return []byte(name + "+" + key)
+}
+
+// findCatsnapNearDuplicate returns the key of the cat's stored snap nearest the hash, if one's within maxDistance.
+func findCatsnapNearDuplicate(name string, hash uint64, maxDistance int) (key string, distance int, err error) {
+	distance = -1
+	err = GetDB("master").View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(catsnapHashesKey))
+		if b == nil {
+			return nil
+		}
+		prefix := catsnapHashKey(name, "")
+		c := b.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			if len(v) != 8 {
+				continue
+			}
+			d := hashDistance(hash, binary.BigEndian.Uint64(v))
+			if d <= maxDistance && (distance < 0 || d < distance) {
+				key, distance = string(k[len(prefix):]), d
+			}
+		}
+		return nil
+	})
+	return key, distance, err
+}
+
+func putCatsnapHash(name, key string, hash uint64) error {
+	return GetDB("master").Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(catsnapHashesKey))
+		if err != nil {
+			return err
+		}
+		return b.Put(catsnapHashKey(name, key), binary.BigEndian.AppendUint64(nil, hash))
+	})
+}
+
+func deleteCatsnapHash(tx *bolt.Tx, name, key string) error {
+	b := tx.Bucket([]byte(catsnapHashesKey))
+	if b == nil {
+		return nil
+	}
+	return b.Delete(catsnapHashKey(name, key))
+}
+
+// dedupeCatsnap hashes the cat's new snap, keeping the hash in its properties, and checks it against the cat's others.
+// It returns whether the snap was hashed, and whether its image should be skipped as a near-duplicate.
+func dedupeCatsnap(feat *geojson.Feature, data []byte) (hash uint64, hashed, skip bool) {
+	if catsnapDedupeOptions.Action == CatsnapDedupeOff || catsnapDedupeOptions.Action == "" {
+		return 0, false, false
+	}
+	hash, err := imageDHash(data)
+	if err != nil {
+		return 0, false, false
+	}
+	feat.Properties["imgHash"] = formatImgHash(hash)
+
+	name, _ := feat.Properties["Name"].(string)
+	dup, distance, err := findCatsnapNearDuplicate(name, hash, catsnapDedupeOptions.MaxDistance)
+	if err != nil {
+		log.Println("[catsnaps] error checking for duplicates:", err)
+		return hash, true, false
+	}
+	if distance < 0 {
+		return hash, true, false
+	}
+	log.Printf("[catsnaps] %s's snap is a near-duplicate of %s (distance %d)\n", name, dup, distance)
+	feat.Properties["imgDuplicateOf"] = dup
+	feat.Properties["imgHashDistance"] = distance
+	return hash, true, catsnapDedupeOptions.Action == CatsnapDedupeSkip
+}
+
+type CatsnapDuplicate struct {
+	Key      string    `json:"key"`
+	Time     time.Time `json:"time"`
+	Hash     string    `json:"hash"`
+	Distance int       `json:"distance"` // from the cluster's first snap
+}
+
+type CatsnapDuplicateCluster struct {
+	Name  string             `json:"name"`
+	Snaps []CatsnapDuplicate `json:"snaps"`
+}
+
+// getCatsnapDuplicateClusters groups each cat's snaps into clusters of near-duplicates, each snap within
+// maxDistance of another in its cluster, and returns the clusters of more than one, biggest first.
+// Snaps stored before they were hashed are hashed from their local images.
+func getCatsnapDuplicateClusters(maxDistance int) ([]CatsnapDuplicateCluster, error) {
+	byCat := map[string][]CatsnapDuplicate{}
+	hashes := map[string][]uint64{}
+	err := GetDB("master").View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(catsnapsGeoJSONKey))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			f, err := geojson.UnmarshalFeature(v)
+			if err != nil {
+				return nil
+			}
+			imgS3, _ := f.Properties["imgS3"].(string)
+			if imgS3 == "" {
+				return nil
+			}
+			key := catsnapKeyFromImgS3(imgS3)
+			raw, _ := f.Properties["imgHash"].(string)
+			hash, ok := parseImgHash(raw)
+			if !ok {
+				contentType, _ := f.Properties["imgMIME"].(string)
+				data, err := catsnapLocalStore().Get(context.Background(), key+catsnapExt(contentType))
+				if err != nil {
+					return nil
+				}
+				if hash, err = imageDHash(data); err != nil {
+					return nil
+				}
+			}
+			name, _ := f.Properties["Name"].(string)
+			byCat[name] = append(byCat[name], CatsnapDuplicate{Key: key, Time: mustGetTime(f), Hash: formatImgHash(hash)})
+			hashes[name] = append(hashes[name], hash)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	clusters := []CatsnapDuplicateCluster{}
+	for name, snaps := range byCat {
+		hs := hashes[name]
+		// Union-find the snaps within maxDistance of each other.
+		parent := make([]int, len(snaps))
+		for i := range parent {
+			parent[i] = i
+		}
+		var find func(int) int
+		find = func(i int) int {
+			if parent[i] != i {
+				parent[i] = find(parent[i])
+			}
+			return parent[i]
+		}
+		for i := range snaps {
+			for j := i + 1; j < len(snaps); j++ {
+				if hashDistance(hs[i], hs[j]) <= maxDistance {
+					parent[find(j)] = find(i)
+				}
+			}
+		}
+		groups := map[int][]int{}
+		for i := range snaps {
+			groups[find(i)] = append(groups[find(i)], i)
+		}
+		for _, idx := range groups {
+			if len(idx) < 2 {
+				continue
+			}
+			sort.Slice(idx, func(a, b int) bool { return snaps[idx[a]].Time.Before(snaps[idx[b]].Time) })
+			cluster := CatsnapDuplicateCluster{Name: name}
+			for _, i := range idx {
+				s := snaps[i]
+				s.Distance = hashDistance(hs[idx[0]], hs[i])
+				cluster.Snaps = append(cluster.Snaps, s)
+			}
+			clusters = append(clusters, cluster)
+		}
+	}
+	sort.Slice(clusters, func(i, j int) bool {
+		if len(clusters[i].Snaps) != len(clusters[j].Snaps) {
+			return len(clusters[i].Snaps) > len(clusters[j].Snaps)
+		}
+		return clusters[i].Snaps[0].Time.After(clusters[j].Snaps[0].Time)
+	})
+	return clusters, nil
+}
@@ -0,0 +1,93 @@
+package catTrackslib
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+)
+
+// gradient returns an image getting brighter left to right, or right to left.
+func gradient(rtl bool) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 320, 240))
+	for y := 0; y < 240; y++ {
+		for x := 0; x < 320; x++ {
+			v := uint8(x * 255 / 320)
+			if rtl {
+				v = 255 - v
+			}
+			img.SetRGBA(x, y, color.RGBA{v, uint8(y), v / 2, 255})
+		}
+	}
+	return img
+}
+
+func TestCatsnapNearDuplicates(t *testing.T) {
+	SetDBPath("master", filepath.Join(t.TempDir(), "m.db"))
+	if err := InitBoltDB(); err != nil {
+		t.Fatal(err)
+	}
+	defer GetDB("master").Close()
+	defer SetCatsnapDedupeOptions(catsnapDedupeOptions)
+
+	original, reencoded, other := &bytes.Buffer{}, &bytes.Buffer{}, &bytes.Buffer{}
+	png.Encode(original, gradient(false))
+	jpeg.Encode(reencoded, gradient(false), &jpeg.Options{Quality: 40})
+	png.Encode(other, gradient(true))
+
+	h1, _ := imageDHash(original.Bytes())
+	h2, _ := imageDHash(reencoded.Bytes())
+	h3, _ := imageDHash(other.Bytes())
+	if d := hashDistance(h1, h2); d > 4 {
+		t.Errorf("got distance %d re-encoded, want near", d)
+	}
+	if d := hashDistance(h1, h3); d < 20 {
+		t.Errorf("got distance %d for another image, want far", d)
+	}
+
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	snap := func(img []byte, after time.Duration) *geojson.Feature {
+		f := geojson.NewFeature(orb.Point{-93, 45})
+		f.Properties["Name"] = "rye"
+		f.Properties["UUID"] = "rye-uuid"
+		f.Properties["Time"] = start.Add(after).Format(time.RFC3339)
+		f.Properties["imgB64"] = base64.StdEncoding.EncodeToString(img)
+		if err := storePoint(f); err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+
+	SetCatsnapDedupeOptions(CatsnapDedupeOptions{Action: CatsnapDedupeFlag, MaxDistance: 6})
+	first := snap(original.Bytes(), 0)
+	if _, ok := first.Properties["imgDuplicateOf"]; ok {
+		t.Fatal("want the first snap not flagged")
+	}
+	flagged := snap(reencoded.Bytes(), time.Second)
+	if flagged.Properties["imgDuplicateOf"] != catsnapKeyFromImgS3(first.Properties["imgS3"].(string)) {
+		t.Errorf("want the re-encoded snap flagged, got %v", flagged.Properties)
+	}
+	snap(other.Bytes(), 2*time.Second)
+
+	SetCatsnapDedupeOptions(CatsnapDedupeOptions{Action: CatsnapDedupeSkip, MaxDistance: 6})
+	skipped := snap(original.Bytes(), 3*time.Second)
+	if _, ok := skipped.Properties["imgS3"]; ok {
+		t.Errorf("want the resent snap's image skipped, got %v", skipped.Properties)
+	}
+	if _, total, _ := queryCatSnaps(catsnapsQuery{}); total != 3 {
+		t.Errorf("got %d snaps, want 3", total)
+	}
+
+	clusters, err := getCatsnapDuplicateClusters(6)
+	if err != nil || len(clusters) != 1 || len(clusters[0].Snaps) != 2 || clusters[0].Name != "rye" {
+		t.Fatalf("got %+v (%v), want the original and re-encoded clustered", clusters, err)
+	}
+}
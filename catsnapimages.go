@@ -0,0 +1,280 @@
+package catTrackslib
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/paulmach/orb/geojson"
+)
+
+// Catsnaps are kept on the local filesystem as <dbdir>/catsnaps/<key><ext>, where the key is the last part
+// of the feature's imgS3 property and the extension is for its imgMIME type, and served from /catsnaps/{key}<ext>.
+// Thumbnails are served from /catsnaps/{key}/thumb?w=, made as JPEGs on the first request for a width
+// and cached in <dbdir>/catsnaps/thumbs. Widths are rounded up to one of catsnapThumbWidths, so the cache
+// holds at most a handful of thumbnails per snap. Formats we can't decode, like HEIC, have no thumbnails.
+// Images are served through the privacy zones: their EXIF GPS is blanked for anyone but their cat's owners,
+// and EXIF written, if it is, where the one asking sees the snap. Thumbnails have no EXIF.
+
+const (
+	catsnapThumbDefaultWidth = 256
+	catsnapCacheMaxAge       = 365 * 24 * time.Hour // a key's image never changes
+)
+
+var errInvalidCatsnapKey = errors.New("invalid catsnap key")
+
+// catsnapThumbWidths are the widths thumbnails are made at, narrowest first.
+var catsnapThumbWidths = []int{64, 128, 256, 512, 1024}
+
+// catsnapThumbWidth returns the narrowest thumbnail width at least w wide, or the widest.
+func catsnapThumbWidth(w int) int {
+	for _, tw := range catsnapThumbWidths {
+		if w <= tw {
+			return tw
+		}
+	}
+	return catsnapThumbWidths[len(catsnapThumbWidths)-1]
+}
+
+func catsnapsDir() string {
+	return filepath.Join(filepath.Dir(GetDB("master").Path()), "catsnaps")
+}
+
+// catsnapKeyFromImgS3 returns the catsnap key from an imgS3 property, which is the key, or bucket/key.
+func catsnapKeyFromImgS3(imgS3 string) string {
+	return imgS3[strings.LastIndex(imgS3, "/")+1:]
+}
+
+// catsnapPath returns the path of the catsnap image with the extension, making sure the key doesn't step outside the directory.
+func catsnapPath(key, ext string) (string, error) {
+	if key == "" || key != filepath.Base(key) || strings.Contains(key, "..") {
+		return "", errInvalidCatsnapKey
+	}
+	if catsnapContentType(ext) == "" {
+		return "", fmt.Errorf("%w: %s", errUnsupportedImageType, ext)
+	}
+	return filepath.Join(catsnapsDir(), key+ext), nil
+}
+
+// findCatsnapPath returns the path of the catsnap image, whatever its format.
+func findCatsnapPath(key string) (string, error) {
+	for _, ext := range catsnapTypes {
+		path, err := catsnapPath(key, ext)
+		if err != nil {
+			return "", err
+		}
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", os.ErrNotExist
+}
+
+// requestBaseURL returns the scheme and host the request was made to, for building URLs back to us.
+func requestBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if p := r.Header.Get("X-Forwarded-Proto"); p != "" {
+		scheme = p
+	}
+	return scheme + "://" + r.Host
+}
+
+// addCatsnapURLs adds the URLs of the catsnap's image and thumbnail to the feature, as imgURL and thumbURL.
+func addCatsnapURLs(f *geojson.Feature, base string) {
+	imgS3, _ := f.Properties["imgS3"].(string)
+	key := catsnapKeyFromImgS3(imgS3)
+	if key == "" {
+		return
+	}
+	contentType, _ := f.Properties["imgMIME"].(string)
+	f.Properties["imgURL"] = base + "/catsnaps/" + url.PathEscape(key) + catsnapExt(contentType)
+	f.Properties["thumbURL"] = base + "/catsnaps/" + url.PathEscape(key) + "/thumb"
+}
+
+// serveCatsnapFile serves the image file with headers for caching it for good.
+func serveCatsnapFile(w http.ResponseWriter, r *http.Request, path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "catsnap not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", catsnapContentType(filepath.Ext(path)))
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d, immutable", int(catsnapCacheMaxAge.Seconds())))
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size()))
+	http.ServeContent(w, r, filepath.Base(path), fi.ModTime(), f)
+}
+
+// viewCatsnapImage returns the snap's image as the viewer sees it. Without its snap, we don't know whose it is,
+// so it's seen as anyone's would be.
+func viewCatsnapImage(b []byte, contentType string, view *privacyView, snap *geojson.Feature) []byte {
+	name := ""
+	if snap != nil {
+		name, _ = snap.Properties["Name"].(string)
+	}
+	if snap == nil || !view.owns(name) {
+		b = stripEXIFGPS(b)
+	}
+	if catsnapImageOptions.WriteEXIF && contentType == "image/jpeg" && snap != nil {
+		if f, ok := view.feature(snap); ok {
+			pt := f.Point()
+			b = addJPEGEXIF(b, pt.Lon(), pt.Lat(), mustGetTime(f))
+		}
+	}
+	return b
+}
+
+func handleGetCatSnapImage(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	path, err := catsnapPath(vars["key"], "."+vars["ext"])
+	if err != nil {
+		if errors.Is(err, errUnsupportedImageType) {
+			http.Error(w, "catsnap not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "catsnap not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	snap, err := getCatSnap(vars["key"])
+	if err != nil && !errors.Is(err, ErrCatSnapNotFound) {
+		log.Println("error getting catsnap:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	contentType := catsnapContentType(filepath.Ext(path))
+	b = viewCatsnapImage(b, contentType, requestPrivacyView(r), snap)
+
+	// What's served depends on who's asking, and on the zones as they are now, so it's checked each time.
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Set("ETag", fmt.Sprintf(`"%x"`, sha256.Sum256(b)))
+	http.ServeContent(w, r, filepath.Base(path), fi.ModTime(), bytes.NewReader(b))
+}
+
+func handleGetCatSnapThumb(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	path, err := findCatsnapPath(key)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "catsnap not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	width := catsnapThumbDefaultWidth
+	if raw := r.URL.Query().Get("w"); raw != "" {
+		if width, err = strconv.Atoi(raw); err != nil {
+			http.Error(w, "invalid w: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	width = catsnapThumbWidth(width)
+
+	thumbPath := filepath.Join(catsnapsDir(), "thumbs", fmt.Sprintf("%s_w%d.jpg", key, width))
+	if _, err := os.Stat(thumbPath); os.IsNotExist(err) {
+		if err := makeCatsnapThumb(path, thumbPath, width); err != nil {
+			if errors.Is(err, image.ErrFormat) {
+				http.Error(w, "no thumbnails for "+catsnapContentType(filepath.Ext(path)), http.StatusUnsupportedMediaType)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	serveCatsnapFile(w, r, thumbPath)
+}
+
+// makeCatsnapThumb writes a thumbnail of the image, width pixels wide, to thumbPath.
+func makeCatsnapThumb(path, thumbPath string, width int) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	img, _, err := image.Decode(src)
+	if err != nil {
+		return err
+	}
+	buf := &bytes.Buffer{}
+	if err := jpeg.Encode(buf, thumbnail(img, width), &jpeg.Options{Quality: 85}); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(thumbPath), 0755); err != nil {
+		return err
+	}
+	// Write then rename, so a concurrent request never serves half a thumbnail.
+	tmp := thumbPath + "." + randomHex(4) + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, thumbPath)
+}
+
+// thumbnail scales the image down to width pixels wide, keeping its aspect,
+// averaging the source pixels under each thumbnail pixel. Images already narrower aren't scaled up.
+func thumbnail(img image.Image, width int) image.Image {
+	b := img.Bounds()
+	if b.Dx() <= width {
+		return img
+	}
+	height := max(1, b.Dy()*width/b.Dx())
+	out := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := b.Min.Y + y*b.Dy()/height
+		y1 := max(y0+1, b.Min.Y+(y+1)*b.Dy()/height)
+		for x := 0; x < width; x++ {
+			x0 := b.Min.X + x*b.Dx()/width
+			x1 := max(x0+1, b.Min.X+(x+1)*b.Dx()/width)
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			out.SetRGBA(x, y, color.RGBA{uint8(r / n >> 8), uint8(g / n >> 8), uint8(bl / n >> 8), uint8(a / n >> 8)})
+		}
+	}
+	return out
+}
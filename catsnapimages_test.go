@@ -0,0 +1,57 @@
+package catTrackslib
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+)
+
+func TestCatsnapThumbnail(t *testing.T) {
+	// Left half black, right half white.
+	img := image.NewRGBA(image.Rect(0, 0, 400, 300))
+	for y := 0; y < 300; y++ {
+		for x := 200; x < 400; x++ {
+			img.SetRGBA(x, y, color.RGBA{255, 255, 255, 255})
+		}
+	}
+	th := thumbnail(img, 100)
+	if b := th.Bounds(); b.Dx() != 100 || b.Dy() != 75 {
+		t.Fatalf("got %v, want 100x75", b)
+	}
+	if r, _, _, _ := th.At(10, 10).RGBA(); r != 0 {
+		t.Errorf("want the left black, got %d", r)
+	}
+	if r, _, _, _ := th.At(90, 10).RGBA(); r>>8 != 255 {
+		t.Errorf("want the right white, got %d", r>>8)
+	}
+	if th := thumbnail(img, 1000); th != image.Image(img) {
+		t.Error("want narrow images left alone")
+	}
+
+	for w, want := range map[int]int{-5: 64, 16: 64, 64: 64, 65: 128, 300: 512, 1024: 1024, 4000: 1024} {
+		if got := catsnapThumbWidth(w); got != want {
+			t.Errorf("w=%d: got width %d, want %d", w, got, want)
+		}
+	}
+}
+
+func TestCatsnapKeys(t *testing.T) {
+	for _, key := range []string{"", "../master", "a/b", ".."} {
+		if _, err := catsnapPath(key, ".jpg"); err == nil {
+			t.Errorf("%q: want invalid", key)
+		}
+	}
+
+	f := geojson.NewFeature(orb.Point{})
+	f.Properties["imgS3"] = "rotblauer.cattracks/rye_abc-123_1700000000"
+	addCatsnapURLs(f, "https://api.catonmap.info")
+	if got := f.Properties["imgURL"]; got != "https://api.catonmap.info/catsnaps/rye_abc-123_1700000000.jpg" {
+		t.Errorf("got imgURL %v", got)
+	}
+	if got := f.Properties["thumbURL"]; got != "https://api.catonmap.info/catsnaps/rye_abc-123_1700000000/thumb" {
+		t.Errorf("got thumbURL %v", got)
+	}
+}
@@ -0,0 +1,277 @@
+package catTrackslib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	catnames "github.com/rotblauer/cattracks-names"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Catsnaps are named in the API by their catsnap key, as in their image URLs.
+// In the catsnaps-geojson bucket they're keyed by Name+UUID+unix time, as points are,
+// so queries can skip snaps by cat and time without unmarshalling them.
+
+var ErrCatSnapNotFound = errors.New("catsnap not found")
+
+type catsnapsQuery struct {
+	Cat    string
+	Start  time.Time
+	End    time.Time
+	BBox   *orb.Bound
+	Limit  int // 0 is no limit
+	Offset int
+	// View is who the snaps are for; they're matched where they're shown. Nil is raw.
+	View *privacyView
+}
+
+// parseCatsnapBoltKey returns the name and time from a catsnap's bucket key, if it's in the Name+UUID+unix form.
+func parseCatsnapBoltKey(k []byte) (name string, t time.Time, ok bool) {
+	parts := strings.Split(string(k), "+")
+	if len(parts) != 3 {
+		return "", time.Time{}, false
+	}
+	unix, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return parts[0], time.Unix(unix, 0), true
+}
+
+func (q catsnapsQuery) matchCat(name string) bool {
+	return q.Cat == "" || q.Cat == name || q.Cat == catnames.AliasOrSanitizedName(name)
+}
+
+func (q catsnapsQuery) matchTime(t time.Time) bool {
+	if !q.Start.IsZero() && t.Before(q.Start) {
+		return false
+	}
+	return q.End.IsZero() || !t.After(q.End)
+}
+
+func (q catsnapsQuery) match(f *geojson.Feature) bool {
+	name, _ := f.Properties["Name"].(string)
+	if !q.matchCat(name) || !q.matchTime(mustGetTime(f)) {
+		return false
+	}
+	if q.BBox != nil {
+		pt, ok := f.Geometry.(orb.Point)
+		if !ok || !q.BBox.Contains(pt) {
+			return false
+		}
+	}
+	return true
+}
+
+// queryCatSnaps returns the page of catsnaps matching the query, newest first, and how many match in all.
+func queryCatSnaps(q catsnapsQuery) ([]*geojson.Feature, int, error) {
+	features := []*geojson.Feature{}
+	migrated := true
+	err := GetDB("master").View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(catsnapsGeoJSONKey))
+		if b == nil {
+			migrated = false
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			if name, t, ok := parseCatsnapBoltKey(k); ok && (!q.matchTime(t) || !q.matchCat(name)) {
+				return nil
+			}
+			f, err := geojson.UnmarshalFeature(v)
+			if err != nil {
+				log.Println("error unmarshalling catsnap:", err)
+				return nil
+			}
+			if imgS3, _ := f.Properties["imgS3"].(string); imgS3 == "" {
+				return nil
+			}
+			if f, ok := q.View.feature(f); ok && q.match(f) {
+				features = append(features, f)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if !migrated {
+		// Snaps from before the geojson bucket; getCatSnaps migrates them.
+		all, err := getCatSnaps(q.Start, q.End)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, f := range all {
+			if f, ok := q.View.feature(f); ok && q.match(f) {
+				features = append(features, f)
+			}
+		}
+	}
+
+	sort.SliceStable(features, func(i, j int) bool {
+		return mustGetTime(features[i]).After(mustGetTime(features[j]))
+	})
+	total := len(features)
+	if q.Offset > 0 {
+		features = features[min(q.Offset, total):]
+	}
+	if q.Limit > 0 && len(features) > q.Limit {
+		features = features[:q.Limit]
+	}
+	return features, total, nil
+}
+
+// indexCatSnap indexes the catsnap stored under the bucket key k by its catsnap key, for findCatSnap.
+func indexCatSnap(tx *bolt.Tx, k []byte, f *geojson.Feature) error {
+	imgS3, _ := f.Properties["imgS3"].(string)
+	if imgS3 == "" {
+		return nil
+	}
+	b, err := tx.CreateBucketIfNotExists([]byte(catsnapIndexKey))
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(catsnapKeyFromImgS3(imgS3)), k)
+}
+
+// indexCatSnaps indexes the catsnaps stored before there was an index.
+// It's skipped once the index has as many keys as there are snaps.
+func indexCatSnaps() error {
+	return GetDB("master").Update(func(tx *bolt.Tx) error {
+		snaps := tx.Bucket([]byte(catsnapsGeoJSONKey))
+		if snaps == nil {
+			return nil
+		}
+		index, err := tx.CreateBucketIfNotExists([]byte(catsnapIndexKey))
+		if err != nil {
+			return err
+		}
+		if index.Stats().KeyN >= snaps.Stats().KeyN {
+			return nil
+		}
+		return snaps.ForEach(func(k, v []byte) error {
+			f, err := geojson.UnmarshalFeature(v)
+			if err != nil {
+				return nil
+			}
+			return indexCatSnap(tx, append([]byte(nil), k...), f)
+		})
+	})
+}
+
+// findCatSnap returns the catsnap with the catsnap key, and its bucket key.
+func findCatSnap(tx *bolt.Tx, key string) ([]byte, *geojson.Feature, error) {
+	index, snaps := tx.Bucket([]byte(catsnapIndexKey)), tx.Bucket([]byte(catsnapsGeoJSONKey))
+	if index == nil || snaps == nil {
+		return nil, nil, ErrCatSnapNotFound
+	}
+	k := index.Get([]byte(key))
+	if k == nil {
+		return nil, nil, ErrCatSnapNotFound
+	}
+	v := snaps.Get(k)
+	if v == nil {
+		return nil, nil, ErrCatSnapNotFound
+	}
+	f, err := geojson.UnmarshalFeature(v)
+	if err != nil {
+		return nil, nil, err
+	}
+	return append([]byte(nil), k...), f, nil
+}
+
+func getCatSnap(key string) (*geojson.Feature, error) {
+	var f *geojson.Feature
+	err := GetDB("master").View(func(tx *bolt.Tx) error {
+		var err error
+		_, f, err = findCatSnap(tx, key)
+		return err
+	})
+	return f, err
+}
+
+// DeleteCatSnap deletes the catsnap: its image from the blob store, then its local image and thumbnails, then the snap.
+// If the blob store fails, nothing is deleted, so it can be tried again.
+func DeleteCatSnap(key string) error {
+	if _, err := catsnapPath(key, ".jpg"); err != nil {
+		return err
+	}
+	f, err := getCatSnap(key)
+	if err != nil {
+		return err
+	}
+	if store := getCatsnapBlobStore(); store != nil {
+		ctx, cancel := catsnapBlobContext()
+		err := store.Delete(ctx, key)
+		cancel()
+		if err != nil && !errors.Is(err, ErrBlobNotFound) {
+			return err
+		}
+	}
+
+	contentType, _ := f.Properties["imgMIME"].(string)
+	if err := catsnapLocalStore().Delete(context.Background(), key+catsnapExt(contentType)); err != nil && !errors.Is(err, ErrBlobNotFound) {
+		return err
+	}
+	thumbs, _ := filepath.Glob(filepath.Join(catsnapsDir(), "thumbs", key+"_w*.jpg"))
+	for _, th := range thumbs {
+		if err := os.Remove(th); err != nil {
+			log.Println("[catsnaps] error removing thumbnail:", err)
+		}
+	}
+
+	return GetDB("master").Update(func(tx *bolt.Tx) error {
+		k, _, err := findCatSnap(tx, key)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket([]byte(catsnapsGeoJSONKey)).Delete(k); err != nil {
+			return err
+		}
+		if err := tx.Bucket([]byte(catsnapIndexKey)).Delete([]byte(key)); err != nil {
+			return err
+		}
+		name, _ := f.Properties["Name"].(string)
+		if err := deleteCatsnapHash(tx, name, key); err != nil {
+			return err
+		}
+		if b := tx.Bucket([]byte(catsnapUploadsKey)); b != nil {
+			return b.Delete([]byte(key))
+		}
+		return nil
+	})
+}
+
+// UpdateCatSnapNotes sets the catsnap's caption, its Notes and CustomNote, or removes it if it's empty.
+func UpdateCatSnapNotes(key, notes string) (*geojson.Feature, error) {
+	var f *geojson.Feature
+	err := GetDB("master").Update(func(tx *bolt.Tx) error {
+		k, snap, err := findCatSnap(tx, key)
+		if err != nil {
+			return err
+		}
+		if notes == "" {
+			delete(snap.Properties, "Notes")
+			delete(snap.Properties, "CustomNote")
+		} else {
+			snap.Properties["Notes"] = notes
+			snap.Properties["CustomNote"] = notes
+		}
+		v, err := json.Marshal(snap)
+		if err != nil {
+			return err
+		}
+		f = snap
+		return tx.Bucket([]byte(catsnapsGeoJSONKey)).Put(k, v)
+	})
+	return f, err
+}
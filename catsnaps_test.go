@@ -0,0 +1,108 @@
+package catTrackslib
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestCatSnapsManagement(t *testing.T) {
+	SetDBPath("master", filepath.Join(t.TempDir(), "m.db"))
+	if err := InitBoltDB(); err != nil {
+		t.Fatal(err)
+	}
+	defer GetDB("master").Close()
+	defer SetCatsnapBlobStore(getCatsnapBlobStore())
+	store := NewMemoryBlobStore()
+	SetCatsnapBlobStore(store)
+
+	jpg := &bytes.Buffer{}
+	jpeg.Encode(jpg, image.NewRGBA(image.Rect(0, 0, 8, 8)), nil)
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	snap := func(name string, lng float64, after time.Duration) string {
+		f := geojson.NewFeature(orb.Point{lng, 45})
+		f.Properties["Name"] = name
+		f.Properties["UUID"] = name + "-uuid"
+		f.Properties["Time"] = start.Add(after).Format(time.RFC3339)
+		f.Properties["imgB64"] = base64.StdEncoding.EncodeToString(jpg.Bytes())
+		if err := storePoint(f); err != nil {
+			t.Fatal(err)
+		}
+		return catsnapKeyFromImgS3(f.Properties["imgS3"].(string))
+	}
+	rye1 := snap("rye", -93, 0)
+	snap("ia", -90, time.Minute)
+	rye2 := snap("rye", -93, 2*time.Minute)
+	rye3 := snap("rye", 10, 3*time.Minute)
+
+	keys := func(fs []*geojson.Feature) []string {
+		out := []string{}
+		for _, f := range fs {
+			out = append(out, catsnapKeyFromImgS3(f.Properties["imgS3"].(string)))
+		}
+		return out
+	}
+	got, total, err := queryCatSnaps(catsnapsQuery{Cat: "rye", Limit: 2})
+	if err != nil || total != 3 || len(got) != 2 || keys(got)[0] != rye3 || keys(got)[1] != rye2 {
+		t.Fatalf("got %v of %d (%v), want rye's newest 2 of 3", keys(got), total, err)
+	}
+	if got, _, _ = queryCatSnaps(catsnapsQuery{Cat: "rye", Limit: 2, Offset: 2}); len(got) != 1 || keys(got)[0] != rye1 {
+		t.Errorf("got %v, want the last page", keys(got))
+	}
+	bbox := &orb.Bound{Min: orb.Point{-100, 40}, Max: orb.Point{-92, 50}}
+	if _, total, _ = queryCatSnaps(catsnapsQuery{BBox: bbox}); total != 2 {
+		t.Errorf("got %d in the bbox, want rye's 2 there", total)
+	}
+
+	f, err := UpdateCatSnapNotes(rye2, "in the garden")
+	if err != nil || f.Properties["Notes"] != "in the garden" || f.Properties["CustomNote"] != "in the garden" {
+		t.Fatalf("got %v (%v)", f, err)
+	}
+	if f, _ = getCatSnap(rye2); f.Properties["Notes"] != "in the garden" {
+		t.Errorf("want the caption kept, got %v", f.Properties["Notes"])
+	}
+
+	if err := DeleteCatSnap(rye2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := getCatSnap(rye2); !errors.Is(err, ErrCatSnapNotFound) {
+		t.Errorf("got %v, want it gone", err)
+	}
+	if _, err := os.Stat(filepath.Join(catsnapsDir(), rye2+".jpg")); !os.IsNotExist(err) {
+		t.Errorf("want the local image gone, got %v", err)
+	}
+	if _, err := store.Get(context.Background(), rye2); !errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("want the blob gone, got %v", err)
+	}
+	if err := DeleteCatSnap(rye2); !errors.Is(err, ErrCatSnapNotFound) {
+		t.Errorf("got %v, want not found", err)
+	}
+	if err := DeleteCatSnap("../m"); !errors.Is(err, errInvalidCatsnapKey) {
+		t.Errorf("got %v, want invalid", err)
+	}
+
+	// Snaps stored before the index are indexed when the db is opened.
+	GetDB("master").Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket([]byte(catsnapIndexKey))
+	})
+	if _, err := getCatSnap(rye1); !errors.Is(err, ErrCatSnapNotFound) {
+		t.Fatalf("got %v, want it missing from the index", err)
+	}
+	if err := indexCatSnaps(); err != nil {
+		t.Fatal(err)
+	}
+	if f, err := getCatSnap(rye1); err != nil || catsnapKeyFromImgS3(f.Properties["imgS3"].(string)) != rye1 {
+		t.Errorf("got %v (%v), want it found by the index", f, err)
+	}
+}
@@ -0,0 +1,286 @@
+package catTrackslib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Catsnaps are always kept in the local catsnaps directory, and copied to the catsnap blob store if there is one.
+// The copy is made either while the point is stored (sync), retrying a few times, or later by the uploader (queued).
+// Either way, an upload that hasn't succeeded yet is kept in the catsnap uploads bucket,
+// so the uploader retries it, even after a restart, and GET /catsnaps/uploads shows what's pending and why.
+// Only the local image is the original; the copy has its EXIF GPS blanked, since the blob store
+// isn't behind the privacy zones.
+
+const (
+	CatsnapUploadSync   = "sync"
+	CatsnapUploadQueued = "queued"
+)
+
+type CatsnapUploadOptions struct {
+	// Mode is sync, to upload while the point is stored, or queued, to leave it to the uploader.
+	Mode string
+	// Retries is how many times a sync upload is retried before it's left to the uploader.
+	Retries int
+	// Backoff is the wait before the first retry, doubling for each after it, up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Timeout limits each upload attempt.
+	Timeout time.Duration
+	// CheckInterval is how often the uploader looks for pending uploads due a retry.
+	CheckInterval time.Duration
+}
+
+var DefaultCatsnapUploadOptions = CatsnapUploadOptions{
+	Mode:          CatsnapUploadSync,
+	Retries:       2,
+	Backoff:       2 * time.Second,
+	MaxBackoff:    time.Hour,
+	Timeout:       30 * time.Second,
+	CheckInterval: time.Minute,
+}
+
+// CatsnapUpload is an upload to the catsnap blob store that hasn't succeeded yet.
+type CatsnapUpload struct {
+	Key         string    `json:"key"`
+	ContentType string    `json:"contentType"`
+	Created     time.Time `json:"created"`
+	Attempts    int       `json:"attempts"`
+	LastAttempt time.Time `json:"lastAttempt,omitempty"`
+	LastError   string    `json:"lastError,omitempty"`
+	NextAttempt time.Time `json:"nextAttempt"`
+}
+
+var (
+	catsnapBlobStore         BlobStore
+	catsnapBlobStoreResolved bool
+	catsnapBlobStoreLock     sync.Mutex
+)
+
+// getCatsnapBlobStore returns the store catsnaps are uploaded to, or nil if there isn't one.
+// It's the store last given to SetCatsnapBlobStore, whenever that was; failing that,
+// the S3 bucket named by AWS_BUCKETNAME, if that's set, read on the first call.
+func getCatsnapBlobStore() BlobStore {
+	catsnapBlobStoreLock.Lock()
+	defer catsnapBlobStoreLock.Unlock()
+	if !catsnapBlobStoreResolved {
+		if bucket := os.Getenv("AWS_BUCKETNAME"); bucket != "" {
+			catsnapBlobStore = &S3BlobStore{Bucket: bucket}
+		}
+		catsnapBlobStoreResolved = true
+	}
+	return catsnapBlobStore
+}
+
+// setCatsnapBlobStore sets the store catsnaps are uploaded to, in place of any other.
+func setCatsnapBlobStore(store BlobStore) {
+	catsnapBlobStoreLock.Lock()
+	defer catsnapBlobStoreLock.Unlock()
+	catsnapBlobStore = store
+	catsnapBlobStoreResolved = true
+}
+
+// catsnapLocalStore is the local catsnaps directory, where images are kept as <key><ext>.
+func catsnapLocalStore() *FSBlobStore {
+	return &FSBlobStore{Dir: catsnapsDir()}
+}
+
+// catsnapImgS3 returns the imgS3 property for a catsnap key: bucket/key when it's uploaded to S3, otherwise the key.
+func catsnapImgS3(key string) string {
+	if s, ok := getCatsnapBlobStore().(*S3BlobStore); ok {
+		return s.Bucket + "/" + key
+	}
+	return key
+}
+
+// catsnapBackoff returns how long to wait after the attempt'th failed attempt.
+func catsnapBackoff(attempt int) time.Duration {
+	d := catsnapUploadOptions.Backoff
+	for i := 1; i < attempt && d < catsnapUploadOptions.MaxBackoff; i++ {
+		d *= 2
+	}
+	if catsnapUploadOptions.MaxBackoff > 0 && d > catsnapUploadOptions.MaxBackoff {
+		d = catsnapUploadOptions.MaxBackoff
+	}
+	return d
+}
+
+// catsnapBlobContext returns a context for a request to the blob store, limited by the upload timeout.
+func catsnapBlobContext() (context.Context, context.CancelFunc) {
+	if catsnapUploadOptions.Timeout > 0 {
+		return context.WithTimeout(context.Background(), catsnapUploadOptions.Timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+func putCatsnapBlob(store BlobStore, key string, data []byte, contentType string) error {
+	ctx, cancel := catsnapBlobContext()
+	defer cancel()
+	return store.Put(ctx, key, stripEXIFGPS(data), contentType)
+}
+
+// uploadCatsnap copies the catsnap to the blob store, if there is one.
+// Sync uploads are retried, and if they still fail they're left pending for the uploader, and the error returned.
+// Queued uploads are left pending straight away.
+func uploadCatsnap(key string, data []byte, contentType string) error {
+	store := getCatsnapBlobStore()
+	if store == nil {
+		return nil
+	}
+	up := CatsnapUpload{Key: key, ContentType: contentType, Created: time.Now()}
+	if catsnapUploadOptions.Mode == CatsnapUploadQueued {
+		if err := putCatsnapUpload(up); err != nil {
+			return err
+		}
+		wakeCatsnapUploader()
+		return nil
+	}
+
+	var err error
+	for attempt := 1; attempt <= catsnapUploadOptions.Retries+1; attempt++ {
+		if attempt > 1 {
+			time.Sleep(catsnapBackoff(attempt - 1))
+		}
+		up.Attempts, up.LastAttempt = attempt, time.Now()
+		if err = putCatsnapBlob(store, key, data, contentType); err == nil {
+			return nil
+		}
+		log.Printf("[catsnaps] upload %s failed (attempt %d): %v\n", key, attempt, err)
+	}
+	up.LastError = err.Error()
+	up.NextAttempt = time.Now().Add(catsnapBackoff(up.Attempts))
+	if e := putCatsnapUpload(up); e != nil {
+		log.Println("[catsnaps] error keeping pending upload:", e)
+	}
+	return err
+}
+
+func putCatsnapUpload(up CatsnapUpload) error {
+	return GetDB("master").Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(catsnapUploadsKey))
+		if err != nil {
+			return err
+		}
+		v, err := json.Marshal(up)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(up.Key), v)
+	})
+}
+
+func deleteCatsnapUpload(key string) error {
+	return GetDB("master").Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(catsnapUploadsKey))
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+// getCatsnapUploads returns the pending uploads, oldest first.
+func getCatsnapUploads() ([]CatsnapUpload, error) {
+	uploads := []CatsnapUpload{}
+	err := GetDB("master").View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(catsnapUploadsKey))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			up := CatsnapUpload{}
+			if err := json.Unmarshal(v, &up); err != nil {
+				log.Println("error unmarshalling catsnap upload:", err)
+				return nil
+			}
+			uploads = append(uploads, up)
+			return nil
+		})
+	})
+	sort.Slice(uploads, func(i, j int) bool {
+		return uploads[i].Created.Before(uploads[j].Created)
+	})
+	return uploads, err
+}
+
+// retryCatsnapUploads attempts the pending uploads that are due, reading the images from the local catsnaps directory.
+func retryCatsnapUploads(now time.Time) {
+	store := getCatsnapBlobStore()
+	if store == nil {
+		return
+	}
+	uploads, err := getCatsnapUploads()
+	if err != nil {
+		log.Println("[catsnaps] error getting pending uploads:", err)
+		return
+	}
+	local := catsnapLocalStore()
+	for _, up := range uploads {
+		if up.NextAttempt.After(now) {
+			continue
+		}
+		data, err := local.Get(context.Background(), up.Key+catsnapExt(up.ContentType))
+		if errors.Is(err, ErrBlobNotFound) {
+			log.Printf("[catsnaps] dropping upload %s: no local image\n", up.Key)
+			if err := deleteCatsnapUpload(up.Key); err != nil {
+				log.Println(err)
+			}
+			continue
+		}
+		if err == nil {
+			err = putCatsnapBlob(store, up.Key, data, up.ContentType)
+		}
+		if err == nil {
+			log.Printf("[catsnaps] uploaded %s (attempt %d)\n", up.Key, up.Attempts+1)
+			if err := deleteCatsnapUpload(up.Key); err != nil {
+				log.Println(err)
+			}
+			continue
+		}
+		up.Attempts++
+		up.LastAttempt = time.Now()
+		up.LastError = err.Error()
+		up.NextAttempt = up.LastAttempt.Add(catsnapBackoff(up.Attempts))
+		log.Printf("[catsnaps] upload %s failed (attempt %d), next at %v: %v\n", up.Key, up.Attempts, up.NextAttempt, err)
+		if err := putCatsnapUpload(up); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+var startCatsnapUploaderOnce sync.Once
+var catsnapUploaderWake = make(chan struct{}, 1)
+
+func wakeCatsnapUploader() {
+	select {
+	case catsnapUploaderWake <- struct{}{}:
+	default:
+	}
+}
+
+// startCatsnapUploader starts retrying pending uploads, once, beginning with any left from before a restart.
+func startCatsnapUploader() {
+	startCatsnapUploaderOnce.Do(func() {
+		if catsnapUploadOptions.CheckInterval <= 0 {
+			return
+		}
+		go func() {
+			ticker := time.NewTicker(catsnapUploadOptions.CheckInterval)
+			for {
+				retryCatsnapUploads(time.Now())
+				select {
+				case <-ticker.C:
+				case <-catsnapUploaderWake:
+				}
+			}
+		}()
+	})
+}
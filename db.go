@@ -21,7 +21,23 @@ var (
 	placesByCoord          = "placesByCoord"
 	catsnapsKey            = "catsnaps"
 	catsnapsGeoJSONKey     = "catsnaps-geojson"
-	allBuckets             = []string{trackKey, statsKey, "names", "geohash", placesKey, googlefindnearby, googlefindnearbyphotos, placesByCoord, catsnapsKey}
+	catsnapIndexKey        = "catsnapIndex" // catsnap key: catsnaps-geojson key
+	geofencesKey           = "geofences"
+	geofenceStateKey       = "geofenceState"
+	geofenceEventsKey      = "geofenceEvents"
+	tripsKey               = "trips"
+	quarantineKey          = "quarantine"
+	broadcastsKey          = "broadcasts"
+	presenceKey            = "presence"
+	presenceEventsKey      = "presenceEvents"
+	catsnapUploadsKey      = "catsnapUploads"
+	catsnapHashesKey       = "catsnapHashes"
+	apiTokensKey           = "apiTokens"
+	privacyZonesKey        = "privacyZones"
+	shareLinksKey          = "shareLinks"
+	secretsKey             = "secrets"
+	liveStateKey           = "liveState"
+	allBuckets             = []string{trackKey, statsKey, "names", "geohash", placesKey, googlefindnearby, googlefindnearbyphotos, placesByCoord, catsnapsKey, catsnapIndexKey, geofencesKey, geofenceStateKey, geofenceEventsKey, tripsKey, quarantineKey, broadcastsKey, presenceKey, presenceEventsKey, catsnapUploadsKey, catsnapHashesKey, apiTokensKey, privacyZonesKey, shareLinksKey, secretsKey, liveStateKey}
 )
 
 // GetDB is db getter.
@@ -69,6 +85,9 @@ func InitBoltDB() error {
 	if err := initBuckets(GetDB("master"), allBuckets); err != nil {
 		fmt.Println("Err initing buckets @master.", err)
 	}
+	if err := indexCatSnaps(); err != nil {
+		fmt.Println("Err indexing catsnaps @master.", err)
+	}
 
 	// devop and edge databases aren't actually necessary or required or used at all. just for symmetry, and maybe for something unknown
 	// devop
@@ -36,6 +36,23 @@ var edgedbpath string
 
 var placesLayer bool
 
+var stayPointOptions = DefaultStayPointOptions
+var significantPlaceOptions = DefaultSignificantPlaceOptions
+var geofenceOptions = DefaultGeofenceOptions
+var tripOptions = DefaultTripOptions
+var modeClassifierOptions = DefaultModeClassifierOptions
+var smoothingOptions = DefaultSmoothingOptions
+var plausibilityOptions = DefaultPlausibilityOptions
+var motionOptions = DefaultMotionOptions
+var replayOptions = DefaultReplayOptions
+var presenceOptions = DefaultPresenceOptions
+var websocketOptions = DefaultWebsocketOptions
+var catsnapUploadOptions = DefaultCatsnapUploadOptions
+var catsnapImageOptions = DefaultCatsnapImageOptions
+var catsnapDedupeOptions = DefaultCatsnapDedupeOptions
+var shareLinkOptions = DefaultShareLinkOptions
+var accessLogOptions = DefaultAccessLogOptions
+
 var (
 	masterlock, devoplock, edgelock string
 )
@@ -127,6 +144,93 @@ func SetPlacesLayer(b bool) {
 	placesLayer = b
 }
 
+// SetStayPointOptions configures the thresholds used to detect visits from raw tracks.
+func SetStayPointOptions(opts StayPointOptions) {
+	stayPointOptions = opts
+}
+
+// SetSignificantPlaceOptions configures the clustering of visits into significant places.
+func SetSignificantPlaceOptions(opts SignificantPlaceOptions) {
+	significantPlaceOptions = opts
+}
+
+// SetGeofenceOptions configures the accuracy limits used to evaluate points against geofences.
+func SetGeofenceOptions(opts GeofenceOptions) {
+	geofenceOptions = opts
+}
+
+// SetTripOptions configures how point streams are cut into trips.
+func SetTripOptions(opts TripOptions) {
+	tripOptions = opts
+}
+
+// SetModeClassifierOptions configures the window over which transport modes are inferred.
+func SetModeClassifierOptions(opts ModeClassifierOptions) {
+	modeClassifierOptions = opts
+}
+
+// SetSmoothingOptions configures the Kalman filter smoothing tracks.
+func SetSmoothingOptions(opts SmoothingOptions) {
+	smoothingOptions = opts
+}
+
+// SetPlausibilityOptions configures the plausibility rules incoming points are checked against.
+func SetPlausibilityOptions(opts PlausibilityOptions) {
+	plausibilityOptions = opts
+}
+
+// SetMotionOptions configures deriving Speed and Heading for points missing them.
+func SetMotionOptions(opts MotionOptions) {
+	motionOptions = opts
+}
+
+// SetReplayOptions configures how long, and how much of, the live broadcasts are kept for clients to catch up on.
+func SetReplayOptions(opts ReplayOptions) {
+	replayOptions = opts
+}
+
+// SetPresenceOptions configures when cats are online, quiet, stale, and back online.
+func SetPresenceOptions(opts PresenceOptions) {
+	presenceOptions = opts
+}
+
+// SetWebsocketOptions configures websocket sessions' queues and compression. Set it before NewRouter.
+func SetWebsocketOptions(opts WebsocketOptions) {
+	websocketOptions = opts
+}
+
+// SetCatsnapBlobStore sets the store catsnaps are uploaded to, in place of the AWS_BUCKETNAME bucket.
+// A nil store uploads nowhere.
+func SetCatsnapBlobStore(store BlobStore) {
+	setCatsnapBlobStore(store)
+}
+
+// SetCatsnapUploadOptions configures whether catsnaps are uploaded as they're stored or queued, and their retries.
+func SetCatsnapUploadOptions(opts CatsnapUploadOptions) {
+	catsnapUploadOptions = opts
+}
+
+// SetCatsnapImageOptions configures what's done to catsnap images as they're stored.
+func SetCatsnapImageOptions(opts CatsnapImageOptions) {
+	catsnapImageOptions = opts
+}
+
+// SetCatsnapDedupeOptions configures whether near-duplicate catsnaps are flagged or skipped, and how near they are.
+func SetCatsnapDedupeOptions(opts CatsnapDedupeOptions) {
+	catsnapDedupeOptions = opts
+}
+
+// SetShareLinkOptions configures how share links are signed, and how much track they show.
+func SetShareLinkOptions(opts ShareLinkOptions) {
+	shareLinkOptions = opts
+}
+
+// SetAccessLogOptions configures the access logs' format, where they go, and what's redacted from them.
+func SetAccessLogOptions(opts AccessLogOptions) {
+	accessLogOptions = opts
+	accessLog = newAccessLogger(opts)
+}
+
 func getTestesPrefix() string {
 	if testes {
 		return testesPrefix
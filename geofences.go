@@ -0,0 +1,409 @@
+package catTrackslib
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geo"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/planar"
+	catnames "github.com/rotblauer/cattracks-names"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Geofences are named areas, a circle or a polygon, watched for cats entering and leaving.
+// Definitions are stored in the geofences bucket keyed by ID.
+// The geofenceState bucket holds whether each cat is inside each fence, keyed by fence ID and cat name,
+// and the geofenceEvents bucket holds the history of enter and exit events, keyed by time.
+
+const (
+	geofenceEventEnter = "enter"
+	geofenceEventExit  = "exit"
+)
+
+var (
+	ErrGeofenceNoName   = errors.New("geofence has no name")
+	ErrGeofenceNoShape  = errors.New("geofence needs either a center and radius, or a polygon")
+	ErrGeofenceTwoShape = errors.New("geofence cannot be both a circle and a polygon")
+	ErrGeofenceNotFound = errors.New("geofence not found")
+)
+
+// GeofenceOptions configures how points are evaluated against geofences.
+type GeofenceOptions struct {
+	// MaxAccuracy ignores points less accurate than this (meters).
+	MaxAccuracy float64
+	// MaxHysteresis caps the margin (meters), taken from a point's Accuracy,
+	// by which a point must be clearly in or out of a fence to change state.
+	MaxHysteresis float64
+}
+
+var DefaultGeofenceOptions = GeofenceOptions{
+	MaxAccuracy:   500,
+	MaxHysteresis: 100,
+}
+
+type Geofence struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Cat limits the fence to one cat, by name or alias. Empty means everyone.
+	Cat string `json:"cat,omitempty"`
+
+	// Circles have a Center ([lng, lat]) and Radius (meters).
+	Center *orb.Point `json:"center,omitempty"`
+	Radius float64    `json:"radius,omitempty"`
+	// Polygons have rings of [lng, lat] points, the first being the outer boundary.
+	Polygon orb.Polygon `json:"polygon,omitempty"`
+
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+type GeofenceEvent struct {
+	FenceID   string    `json:"fenceId"`
+	FenceName string    `json:"fenceName"`
+	Type      string    `json:"type"` // enter or exit
+	Name      string    `json:"name"`
+	UUID      string    `json:"uuid"`
+	Time      time.Time `json:"time"`
+	Lat       float64   `json:"lat"`
+	Lng       float64   `json:"lng"`
+	Accuracy  float64   `json:"accuracy"`
+}
+
+type geofenceEventsQuery struct {
+	Cat     string
+	FenceID string
+	Start   time.Time
+	End     time.Time
+}
+
+func (g *Geofence) validate() error {
+	if g.Name == "" {
+		return ErrGeofenceNoName
+	}
+	isCircle := g.Center != nil
+	isPolygon := len(g.Polygon) > 0
+	if isCircle && isPolygon {
+		return ErrGeofenceTwoShape
+	}
+	if isCircle {
+		if g.Radius <= 0 {
+			return fmt.Errorf("geofence radius must be positive, got %v", g.Radius)
+		}
+		if g.Center.Lat() < -90 || g.Center.Lat() > 90 || g.Center.Lon() < -180 || g.Center.Lon() > 180 {
+			return fmt.Errorf("geofence center out of range: %v", *g.Center)
+		}
+		return nil
+	}
+	if isPolygon {
+		if len(g.Polygon[0]) < 3 {
+			return fmt.Errorf("geofence polygon needs at least 3 points, got %d", len(g.Polygon[0]))
+		}
+		// Close any open rings, as GeoJSON requires.
+		for i, ring := range g.Polygon {
+			if !ring.Closed() {
+				g.Polygon[i] = append(ring, ring[0])
+			}
+		}
+		return nil
+	}
+	return ErrGeofenceNoShape
+}
+
+func (g Geofence) appliesTo(name string) bool {
+	return g.Cat == "" || g.Cat == name || g.Cat == catnames.AliasOrSanitizedName(name)
+}
+
+// size returns a rough radius of the fence, in meters.
+func (g Geofence) size() float64 {
+	if g.Center != nil {
+		return g.Radius
+	}
+	b := g.Polygon.Bound()
+	return geo.Distance(b.Min, b.Max) / 2
+}
+
+// signedDistance returns the distance in meters from the point to the fence boundary,
+// negative when the point is inside.
+func (g Geofence) signedDistance(pt orb.Point) float64 {
+	if g.Center != nil {
+		return geo.Distance(*g.Center, pt) - g.Radius
+	}
+	d := math.Inf(1)
+	for _, ring := range g.Polygon {
+		for i := 0; i < len(ring)-1; i++ {
+			d = math.Min(d, distanceToSegment(pt, ring[i], ring[i+1]))
+		}
+	}
+	if planar.PolygonContains(g.Polygon, pt) {
+		return -d
+	}
+	return d
+}
+
+// distanceToSegment returns the distance in meters from p to the segment a-b,
+// on a local flat projection around p. Fences are small enough for this to be fine.
+func distanceToSegment(p, a, b orb.Point) float64 {
+	kx := 111320 * math.Cos(p.Lat()*math.Pi/180)
+	const ky = 110540
+	ax, ay := (a.Lon()-p.Lon())*kx, (a.Lat()-p.Lat())*ky
+	bx, by := (b.Lon()-p.Lon())*kx, (b.Lat()-p.Lat())*ky
+	dx, dy := bx-ax, by-ay
+	t := 0.0
+	if l2 := dx*dx + dy*dy; l2 > 0 {
+		t = math.Max(0, math.Min(1, -(ax*dx+ay*dy)/l2))
+	}
+	return math.Hypot(ax+t*dx, ay+t*dy)
+}
+
+// geofenceTransition decides whether a point at signed distance d from a fence boundary,
+// with the given accuracy, moves a cat in or out of it.
+// The point must be clear of the boundary by its accuracy (capped, so small fences still work)
+// before the state changes; fixes in between keep the previous state, so a cat sitting
+// near the edge doesn't flap in and out.
+func geofenceTransition(inside bool, d, acc, fenceSize float64, opts GeofenceOptions) (nowInside bool) {
+	margin := math.Min(acc, math.Min(opts.MaxHysteresis, fenceSize/2))
+	if !inside && d <= -margin {
+		return true
+	}
+	if inside && d >= margin {
+		return false
+	}
+	return inside
+}
+
+func buildGeofenceStateKey(fenceID, name string) []byte {
+	return []byte(fenceID + "+" + name)
+}
+
+func buildGeofenceEventKey(ev GeofenceEvent) []byte {
+	k := i64tob(ev.Time.UnixNano())
+	return append(k, []byte(ev.FenceID+"+"+ev.Name)...)
+}
+
+// PutGeofence validates and stores the geofence, creating an ID for new fences.
+func PutGeofence(g *Geofence) error {
+	if err := g.validate(); err != nil {
+		return err
+	}
+	g.Updated = time.Now()
+	g.Created = g.Updated
+	if g.ID == "" {
+		g.ID = randomHex(8)
+	}
+	return GetDB("master").Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(geofencesKey))
+		if existing := b.Get([]byte(g.ID)); existing != nil {
+			old := Geofence{}
+			if err := json.Unmarshal(existing, &old); err == nil {
+				g.Created = old.Created
+			}
+		}
+		v, err := json.Marshal(g)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(g.ID), v)
+	})
+}
+
+// DeleteGeofence removes the geofence and the cats' states for it. Its event history is kept.
+func DeleteGeofence(id string) error {
+	return GetDB("master").Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(geofencesKey))
+		if b.Get([]byte(id)) == nil {
+			return ErrGeofenceNotFound
+		}
+		if err := b.Delete([]byte(id)); err != nil {
+			return err
+		}
+		sb := tx.Bucket([]byte(geofenceStateKey))
+		prefix := []byte(id + "+")
+		c := sb.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Seek(prefix) {
+			if err := sb.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// getGeofences returns the stored geofences, optionally only those applying to a cat (by name or alias).
+func getGeofences(cat string) ([]Geofence, error) {
+	fences := []Geofence{}
+	err := GetDB("master").View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(geofencesKey)).ForEach(func(k, v []byte) error {
+			g := Geofence{}
+			if err := json.Unmarshal(v, &g); err != nil {
+				log.Println("error unmarshalling geofence:", err)
+				return nil
+			}
+			if cat != "" && !g.appliesTo(cat) {
+				return nil
+			}
+			fences = append(fences, g)
+			return nil
+		})
+	})
+	return fences, err
+}
+
+// evaluateGeofences runs stored features through the geofences, storing and broadcasting
+// any enter and exit events.
+func evaluateGeofences(features []*geojson.Feature) {
+	fences, err := getGeofences("")
+	if err != nil {
+		log.Println("get geofences error:", err)
+		return
+	}
+	if len(fences) == 0 {
+		return
+	}
+
+	events := []GeofenceEvent{}
+	err = GetDB("master").Update(func(tx *bolt.Tx) error {
+		sb := tx.Bucket([]byte(geofenceStateKey))
+		eb := tx.Bucket([]byte(geofenceEventsKey))
+
+		for _, f := range features {
+			acc, _ := f.Properties["Accuracy"].(float64)
+			if acc > geofenceOptions.MaxAccuracy {
+				continue
+			}
+			name, _ := f.Properties["Name"].(string)
+			pt := f.Geometry.(orb.Point)
+
+			for _, g := range fences {
+				if !g.appliesTo(name) {
+					continue
+				}
+				sk := buildGeofenceStateKey(g.ID, name)
+				inside := string(sb.Get(sk)) == geofenceEventEnter
+				nowInside := geofenceTransition(inside, g.signedDistance(pt), acc, g.size(), geofenceOptions)
+				if nowInside == inside {
+					continue
+				}
+
+				ev := GeofenceEvent{
+					FenceID:   g.ID,
+					FenceName: g.Name,
+					Type:      geofenceEventExit,
+					Name:      name,
+					Time:      mustGetTime(f),
+					Lat:       pt.Lat(),
+					Lng:       pt.Lon(),
+					Accuracy:  acc,
+				}
+				ev.UUID, _ = f.Properties["UUID"].(string)
+				if nowInside {
+					ev.Type = geofenceEventEnter
+				}
+				if err := sb.Put(sk, []byte(ev.Type)); err != nil {
+					return err
+				}
+				v, err := json.Marshal(ev)
+				if err != nil {
+					return err
+				}
+				if err := eb.Put(buildGeofenceEventKey(ev), v); err != nil {
+					return err
+				}
+				events = append(events, ev)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("evaluate geofences error:", err)
+		return
+	}
+	if len(events) == 0 {
+		return
+	}
+
+	evFeatures := make([]*geojson.Feature, 0, len(events))
+	for _, ev := range events {
+		log.Println("Geofence", ev.Type, ev.FenceName, ev.Name, ev.Time)
+		evFeatures = append(evFeatures, GeofenceEventToFeature(ev))
+	}
+	broadcastFeatures(websocketActionGeofence, evFeatures)
+}
+
+// GeofenceEventToFeature converts a geofence event to a GeoJSON point feature at the point which triggered it.
+func GeofenceEventToFeature(ev GeofenceEvent) *geojson.Feature {
+	p := geojson.NewFeature(orb.Point{ev.Lng, ev.Lat})
+
+	props := make(map[string]interface{})
+	if alias := catnames.AliasOrName(ev.Name); alias != ev.Name {
+		props["Alias"] = alias
+	}
+	props["Name"] = ev.Name
+	props["UUID"] = ev.UUID
+	props["Time"] = ev.Time
+	props["Accuracy"] = ev.Accuracy
+	props["Event"] = ev.Type
+	props["FenceID"] = ev.FenceID
+	props["FenceName"] = ev.FenceName
+
+	p.Properties = props
+	return p
+}
+
+func (q geofenceEventsQuery) match(ev GeofenceEvent) bool {
+	if q.Cat != "" && q.Cat != ev.Name && q.Cat != catnames.AliasOrSanitizedName(ev.Name) {
+		return false
+	}
+	if q.FenceID != "" && q.FenceID != ev.FenceID {
+		return false
+	}
+	return true
+}
+
+// getGeofenceEvents returns the stored geofence events matching the query, newest first.
+func getGeofenceEvents(q geofenceEventsQuery) ([]*geojson.Feature, error) {
+	events := []GeofenceEvent{}
+	err := GetDB("master").View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(geofenceEventsKey)).Cursor()
+		var k, v []byte
+		if q.Start.IsZero() {
+			k, v = c.First()
+		} else {
+			k, v = c.Seek(i64tob(q.Start.UnixNano()))
+		}
+		for ; k != nil; k, v = c.Next() {
+			if !q.End.IsZero() && i64fromb(k[:8]) > q.End.UnixNano() {
+				break
+			}
+			ev := GeofenceEvent{}
+			if err := json.Unmarshal(v, &ev); err != nil {
+				log.Println("error unmarshalling geofence event:", err)
+				continue
+			}
+			if q.match(ev) {
+				events = append(events, ev)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.After(events[j].Time)
+	})
+
+	features := make([]*geojson.Feature, 0, len(events))
+	for _, ev := range events {
+		features = append(features, GeofenceEventToFeature(ev))
+	}
+	return features, nil
+}
@@ -0,0 +1,85 @@
+package catTrackslib
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/paulmach/orb"
+)
+
+func TestGeofenceHysteresis(t *testing.T) {
+	center := orb.Point{-93.25544, 44.98931}
+	circle := Geofence{Name: "home", Center: &center, Radius: 200}
+	// A square of about 200m a side around the same center.
+	square := Geofence{Name: "block", Polygon: orb.Polygon{{
+		{-93.25671, 44.98841}, {-93.25417, 44.98841}, {-93.25417, 44.99021}, {-93.25671, 44.99021},
+	}}}
+	for _, g := range []*Geofence{&circle, &square} {
+		if err := g.validate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Walk north from the center, in meters.
+	north := func(m float64) orb.Point {
+		return orb.Point{center.Lon(), center.Lat() + m/110540}
+	}
+
+	cases := []struct {
+		name   string
+		fence  Geofence
+		inside bool
+		at     float64
+		acc    float64
+		want   bool
+	}{
+		{"circle center enters", circle, false, 0, 10, true},
+		{"circle just inside, poor accuracy, stays out", circle, false, 180, 50, false},
+		{"circle just inside, good accuracy, enters", circle, false, 180, 10, true},
+		{"circle just outside, poor accuracy, stays in", circle, true, 220, 50, true},
+		{"circle well outside exits", circle, true, 300, 50, false},
+		{"circle huge accuracy is capped", circle, false, 0, 5000, true},
+		{"square center enters", square, false, 0, 10, true},
+		{"square near edge stays out", square, false, 90, 30, false},
+		{"square near edge stays in", square, true, 110, 30, true},
+		{"square outside exits", square, true, 140, 30, false},
+	}
+	for _, c := range cases {
+		d := c.fence.signedDistance(north(c.at))
+		got := geofenceTransition(c.inside, d, c.acc, c.fence.size(), DefaultGeofenceOptions)
+		if got != c.want {
+			t.Errorf("%s: distance %.1f: got inside=%v, want %v", c.name, d, got, c.want)
+		}
+	}
+}
+
+func TestGetGeofencesForCat(t *testing.T) {
+	SetDBPath("master", filepath.Join(t.TempDir(), "m.db"))
+	if err := InitBoltDB(); err != nil {
+		t.Fatal(err)
+	}
+	defer GetDB("master").Close()
+
+	center := orb.Point{-93.25544, 44.98931}
+	for _, g := range []*Geofence{
+		{Name: "home", Center: &center, Radius: 200},
+		{Name: "rye's vet", Cat: "rye", Center: &center, Radius: 50},
+		{Name: "ia's office", Cat: "ia", Center: &center, Radius: 50},
+	} {
+		if err := PutGeofence(g); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A fence is listed for a cat just when it fires for them: by name, or by the alias it goes by.
+	for _, cat := range []string{"rye", "Kitty's iPhone"} {
+		fences, err := getGeofences(cat)
+		if err != nil || len(fences) != 2 {
+			t.Errorf("%s: got %v (%v), want home and rye's vet", cat, fences, err)
+		}
+		for _, g := range fences {
+			if !g.appliesTo(cat) {
+				t.Errorf("%s: got %s, which doesn't apply", cat, g.Name)
+			}
+		}
+	}
+}
@@ -13,9 +13,12 @@ import (
 	"net/http/httputil"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/jellydator/ttlcache/v3"
+	"github.com/paulmach/orb"
 	"github.com/paulmach/orb/geojson"
 	catnames "github.com/rotblauer/cattracks-names"
 	// "os"
@@ -175,7 +178,7 @@ targetLoop:
 			if resp.StatusCode >= http.StatusBadRequest {
 				log.Println("forward populate failed, status:", resp.Status, "target:", target)
 				// log the request for debugging
-				if b, _ := httputil.DumpRequest(newReq, false); b != nil {
+				if b, _ := httputil.DumpRequest(accessLogOptions.redactRequest(newReq), false); b != nil {
 					log.Println(string(b))
 				}
 			}
@@ -357,8 +360,20 @@ func populatePoints(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// A cat's token can only populate as its cat.
+	if t := apiTokenFromContext(r.Context()); t != nil {
+		if err := t.canPopulate(features); err != nil {
+			log.Println("Token", t.ID, "rejected:", err)
+			http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	// Forwarded points are public, so they go through the privacy zones.
 	if forwardTargetRequests != nil {
-		go handleForwardPopulate(r, body)
+		if public, ok := publicPopulateBody(body, features); ok {
+			go handleForwardPopulate(r, public)
+		}
 	}
 
 	if err := validatePoint(features[0]); err == nil {
@@ -387,11 +402,8 @@ func populatePoints(w http.ResponseWriter, r *http.Request) {
 		catname := catnames.AliasOrSanitizedName(features[0].Properties["Name"].(string))
 		lastPushTTLCache.Set(catname, stored, ttlcache.DefaultTTL)
 
-		if m := GetMelody(); m != nil {
-			broadcast := broadcats{Action: websocketActionPopulate, Features: stored}
-			b, _ := json.Marshal(broadcast)
-			m.Broadcast(b)
-		}
+		broadcastFeatures(websocketActionPopulate, stored)
+		arrivePresence(stored)
 	}
 
 	// return empty json of empty trackpoints to not have to download tons of shit
@@ -409,41 +421,817 @@ func getLastKnown(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, e.Error(), http.StatusInternalServerError)
 		return
 	}
+	lk := LastKnownGeoJSON{}
+	if e := json.Unmarshal(b, &lk); e != nil {
+		log.Println(e)
+		http.Error(w, e.Error(), http.StatusInternalServerError)
+		return
+	}
+	presences, e := getPresences()
+	if e != nil {
+		log.Println(e)
+	}
+	smoothed := wantSmoothed(r.URL.Query().Get("smoothed"))
+	view := requestPrivacyView(r)
+	for name, f := range lk {
+		if smoothed {
+			f = smoothedFeature(f)
+		}
+		f, ok := view.feature(f)
+		if !ok {
+			delete(lk, name)
+			continue
+		}
+		if p, ok := presences[name]; ok {
+			f.Properties["Presence"] = p.State
+			f.Properties["PresenceSince"] = p.Since
+		}
+		lk[name] = f
+	}
+	if b, e = json.Marshal(lk); e != nil {
+		log.Println(e)
+		http.Error(w, e.Error(), http.StatusInternalServerError)
+		return
+	}
 	w.Write(b)
 }
 
 func handleGetCatSnaps(w http.ResponseWriter, r *http.Request) {
-	var startQ, endQ time.Time
-	startRaw, ok := r.URL.Query()["tstart"]
+	var err error
+	query := r.URL.Query()
+	q := catsnapsQuery{Cat: query.Get("cat"), View: requestPrivacyView(r)}
+	startRaw, ok := query["tstart"]
 	if ok && len(startRaw) > 0 {
 		i64, err := strconv.ParseInt(startRaw[0], 10, 64)
 		if err == nil {
-			startQ = time.Unix(i64, 0)
+			q.Start = time.Unix(i64, 0)
 		} else {
 			log.Printf("catsnaps: Invalid t-start value: %s (%v)\n", startRaw[0], err)
 		}
 	}
-	endRaw, ok := r.URL.Query()["tend"]
+	endRaw, ok := query["tend"]
 	if ok && len(endRaw) > 0 {
 		i64, err := strconv.ParseInt(endRaw[0], 10, 64)
 		if err == nil {
-			endQ = time.Unix(i64, 0)
+			q.End = time.Unix(i64, 0)
 		} else {
 			log.Printf("catsnaps: Invalid t-end value: %s (%v)\n", endRaw[0], err)
 		}
 	}
-	snapPoints, e := getCatSnaps(startQ, endQ)
+	if q.BBox, err = parseBBoxParam(query.Get("bbox")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for param, dst := range map[string]*int{"limit": &q.Limit, "offset": &q.Offset} {
+		if raw := query.Get(param); raw != "" {
+			if *dst, err = strconv.Atoi(raw); err != nil || *dst < 0 {
+				http.Error(w, "invalid "+param+": "+raw, http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	snapPoints, total, e := queryCatSnaps(q)
 	if e != nil {
 		log.Println(e)
 		http.Error(w, e.Error(), http.StatusInternalServerError)
+		return
+	}
+	if wantSmoothed(query.Get("smoothed")) {
+		for i, f := range snapPoints {
+			snapPoints[i] = smoothedFeature(f)
+		}
+	}
+	base := requestBaseURL(r)
+	for _, f := range snapPoints {
+		addCatsnapURLs(f, base)
 	}
 
 	bs, err := json.Marshal(snapPoints)
 	if err != nil {
 		log.Println(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
+	// The body stays a plain array of snaps; paging is in the headers.
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	w.Header().Set("Access-Control-Expose-Headers", "X-Total-Count, Link")
+	if q.Limit > 0 && q.Offset+len(snapPoints) < total {
+		next := *r.URL
+		nq := next.Query()
+		nq.Set("offset", strconv.Itoa(q.Offset+len(snapPoints)))
+		next.RawQuery = nq.Encode()
+		w.Header().Set("Link", fmt.Sprintf(`<%s%s>; rel="next"`, base, next.RequestURI()))
+	}
 	fmt.Println("Got catsnaps", len(snapPoints), "snaps", len(bs), "bytes")
 	w.Write(bs)
 }
+
+// catsnapErrorStatus returns the HTTP status for an error finding or changing a catsnap.
+func catsnapErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrCatSnapNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errInvalidCatsnapKey):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// handleDeleteCatSnap deletes a catsnap, with its images here and in the blob store.
+func handleDeleteCatSnap(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	if err := DeleteCatSnap(key); err != nil {
+		log.Println("[catsnaps] error deleting", key, err)
+		http.Error(w, err.Error(), catsnapErrorStatus(err))
+		return
+	}
+	log.Println("[catsnaps] deleted", key)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlePatchCatSnap edits a catsnap's caption, given as {"notes": "..."}.
+func handlePatchCatSnap(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		Notes *string `json:"notes"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Notes == nil {
+		http.Error(w, "want {\"notes\": \"...\"}", http.StatusBadRequest)
+		return
+	}
+	f, err := UpdateCatSnapNotes(mux.Vars(r)["key"], *body.Notes)
+	if err != nil {
+		http.Error(w, err.Error(), catsnapErrorStatus(err))
+		return
+	}
+	addCatsnapURLs(f, requestBaseURL(r))
+	if err := json.NewEncoder(w).Encode(f); err != nil {
+		log.Println(err)
+	}
+}
+
+// parseTimeParam parses a time query parameter given either as unix seconds or RFC3339.
+func parseTimeParam(raw string) (time.Time, error) {
+	if raw == "" {
+		return time.Time{}, nil
+	}
+	if i64, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		return time.Unix(i64, 0), nil
+	}
+	return time.Parse(time.RFC3339, raw)
+}
+
+// parseBBoxParam parses a bounding box query parameter given as minLng,minLat,maxLng,maxLat.
+func parseBBoxParam(raw string) (*orb.Bound, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	parts := strings.Split(raw, ",")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("invalid bbox %q (want minLng,minLat,maxLng,maxLat)", raw)
+	}
+	vals := [4]float64{}
+	for i, p := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bbox %q: %v", raw, err)
+		}
+		vals[i] = f
+	}
+	return &orb.Bound{Min: orb.Point{vals[0], vals[1]}, Max: orb.Point{vals[2], vals[3]}}, nil
+}
+
+func handleGetVisits(w http.ResponseWriter, r *http.Request) {
+	var err error
+	q := visitsQuery{Cat: r.URL.Query().Get("cat")}
+	if q.Start, err = parseTimeParam(r.URL.Query().Get("start")); err != nil {
+		http.Error(w, "invalid start: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if q.End, err = parseTimeParam(r.URL.Query().Get("end")); err != nil {
+		http.Error(w, "invalid end: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if q.BBox, err = parseBBoxParam(r.URL.Query().Get("bbox")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The box is matched against where the visits are shown.
+	view, bbox := requestPrivacyView(r), q.BBox
+	if len(view.zones) > 0 {
+		q.BBox = nil
+	}
+	features, err := getVisits(q)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	features = withinBBox(view.features(features), bbox)
+
+	fc := geojson.NewFeatureCollection()
+	fc.Features = features
+	bs, err := json.Marshal(fc)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(bs)
+}
+
+func handleGetTrips(w http.ResponseWriter, r *http.Request) {
+	var err error
+	q := tripsQuery{Cat: r.URL.Query().Get("cat"), Smoothed: wantSmoothed(r.URL.Query().Get("smoothed"))}
+	if q.Start, err = parseTimeParam(r.URL.Query().Get("start")); err != nil {
+		http.Error(w, "invalid start: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if q.End, err = parseTimeParam(r.URL.Query().Get("end")); err != nil {
+		http.Error(w, "invalid end: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	features, err := getTrips(q)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	features = requestPrivacyView(r).features(features)
+
+	fc := geojson.NewFeatureCollection()
+	fc.Features = features
+	bs, err := json.Marshal(fc)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(bs)
+}
+
+func handleGetPlaces(w http.ResponseWriter, r *http.Request) {
+	features, err := getSignificantPlaces(r.URL.Query().Get("cat"))
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	features = requestPrivacyView(r).features(features)
+
+	fc := geojson.NewFeatureCollection()
+	fc.Features = features
+	bs, err := json.Marshal(fc)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(bs)
+}
+
+func handleGetGeofences(w http.ResponseWriter, r *http.Request) {
+	fences, err := getGeofences(r.URL.Query().Get("cat"))
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(fences); err != nil {
+		log.Println(err)
+	}
+}
+
+// handlePutGeofence creates a geofence (POST /geofences) or replaces one (PUT /geofences/{id}).
+func handlePutGeofence(w http.ResponseWriter, r *http.Request) {
+	g := &Geofence{}
+	if err := json.NewDecoder(r.Body).Decode(g); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if id, ok := mux.Vars(r)["id"]; ok {
+		g.ID = id
+	}
+	if err := PutGeofence(g); err != nil {
+		log.Println("put geofence error:", err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(g); err != nil {
+		log.Println(err)
+	}
+}
+
+func handleDeleteGeofence(w http.ResponseWriter, r *http.Request) {
+	if err := DeleteGeofence(mux.Vars(r)["id"]); err != nil {
+		if errors.Is(err, ErrGeofenceNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		log.Println("delete geofence error:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleGetPrivacyZones(w http.ResponseWriter, r *http.Request) {
+	zones, err := getPrivacyZones(r.URL.Query().Get("cat"))
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(zones); err != nil {
+		log.Println(err)
+	}
+}
+
+// handlePutPrivacyZone creates a privacy zone (POST /privacy-zones) or replaces one (PUT /privacy-zones/{id}).
+func handlePutPrivacyZone(w http.ResponseWriter, r *http.Request) {
+	z := &PrivacyZone{}
+	if err := json.NewDecoder(r.Body).Decode(z); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if id, ok := mux.Vars(r)["id"]; ok {
+		z.ID = id
+	}
+	if err := PutPrivacyZone(z); err != nil {
+		log.Println("put privacy zone error:", err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(z); err != nil {
+		log.Println(err)
+	}
+}
+
+func handleDeletePrivacyZone(w http.ResponseWriter, r *http.Request) {
+	if err := DeletePrivacyZone(mux.Vars(r)["id"]); err != nil {
+		if errors.Is(err, ErrPrivacyZoneNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		log.Println("delete privacy zone error:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleGetGeofenceEvents(w http.ResponseWriter, r *http.Request) {
+	var err error
+	q := geofenceEventsQuery{Cat: r.URL.Query().Get("cat"), FenceID: r.URL.Query().Get("fence")}
+	if q.Start, err = parseTimeParam(r.URL.Query().Get("start")); err != nil {
+		http.Error(w, "invalid start: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if q.End, err = parseTimeParam(r.URL.Query().Get("end")); err != nil {
+		http.Error(w, "invalid end: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	features, err := getGeofenceEvents(q)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	fc := geojson.NewFeatureCollection()
+	fc.Features = requestPrivacyView(r).features(features)
+	bs, err := json.Marshal(fc)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(bs)
+}
+
+// handleGetQuarantine lists the points quarantined by the plausibility rules, optionally filtered by ?cat= and ?reason=,
+// as the privacy zones show them.
+func handleGetQuarantine(w http.ResponseWriter, r *http.Request) {
+	points, err := getQuarantinedPoints(r.URL.Query().Get("cat"), r.URL.Query().Get("reason"))
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	view := requestPrivacyView(r)
+	shown := make([]QuarantinedPoint, 0, len(points))
+	for _, p := range points {
+		if f, ok := view.feature(p.Feature); ok {
+			p.Feature = f
+			shown = append(shown, p)
+		}
+	}
+	if err := json.NewEncoder(w).Encode(shown); err != nil {
+		log.Println(err)
+	}
+}
+
+func handleRestoreQuarantined(w http.ResponseWriter, r *http.Request) {
+	f, err := RestoreQuarantinedPoint(mux.Vars(r)["key"])
+	if err != nil {
+		if errors.Is(err, ErrQuarantineNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		log.Println("restore quarantined point error:", err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(f); err != nil {
+		log.Println(err)
+	}
+}
+
+func handleDeleteQuarantined(w http.ResponseWriter, r *http.Request) {
+	if err := DiscardQuarantinedPoint(mux.Vars(r)["key"]); err != nil {
+		if errors.Is(err, ErrQuarantineNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		log.Println("discard quarantined point error:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleGetPresence returns each cat's current presence, by name.
+func handleGetPresence(w http.ResponseWriter, r *http.Request) {
+	presences, err := getPresences()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	view := requestPrivacyView(r)
+	for name, p := range presences {
+		pt, ok := view.point(p.Name, fmt.Sprintf("%s+%d", p.Name, p.LastSeen.UnixNano()), orb.Point{p.Lng, p.Lat})
+		if !ok {
+			// Where a hidden cat was is left out.
+			pt = orb.Point{}
+		}
+		p.Lng, p.Lat = pt.Lon(), pt.Lat()
+		presences[name] = p
+	}
+	if err := json.NewEncoder(w).Encode(presences); err != nil {
+		log.Println(err)
+	}
+}
+
+func handleGetPresenceEvents(w http.ResponseWriter, r *http.Request) {
+	var err error
+	q := presenceEventsQuery{Cat: r.URL.Query().Get("cat")}
+	if q.Start, err = parseTimeParam(r.URL.Query().Get("start")); err != nil {
+		http.Error(w, "invalid start: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if q.End, err = parseTimeParam(r.URL.Query().Get("end")); err != nil {
+		http.Error(w, "invalid end: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	features, err := getPresenceEvents(q)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	features = requestPrivacyView(r).features(features)
+
+	fc := geojson.NewFeatureCollection()
+	fc.Features = features
+	bs, err := json.Marshal(fc)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(bs)
+}
+
+// handleGetLiveSessions returns metrics for each websocket and server-sent events session.
+func handleGetLiveSessions(w http.ResponseWriter, r *http.Request) {
+	if err := json.NewEncoder(w).Encode(getLiveSessionMetrics()); err != nil {
+		log.Println(err)
+	}
+}
+
+// handleGetCatsnapUploads lists the catsnap uploads still pending, with why they last failed.
+func handleGetCatsnapUploads(w http.ResponseWriter, r *http.Request) {
+	uploads, err := getCatsnapUploads()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(uploads); err != nil {
+		log.Println(err)
+	}
+}
+
+// handleGetCatsnapDuplicates reports the clusters of near-duplicate catsnaps, within ?distance= bits of each other.
+func handleGetCatsnapDuplicates(w http.ResponseWriter, r *http.Request) {
+	distance := catsnapDedupeOptions.MaxDistance
+	if raw := r.URL.Query().Get("distance"); raw != "" {
+		var err error
+		if distance, err = strconv.Atoi(raw); err != nil || distance < 0 || distance > 64 {
+			http.Error(w, "invalid distance: "+raw, http.StatusBadRequest)
+			return
+		}
+	}
+	clusters, err := getCatsnapDuplicateClusters(distance)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(clusters); err != nil {
+		log.Println(err)
+	}
+}
+
+// tokenErrorStatus returns the HTTP status for an error finding or changing a token.
+func tokenErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrTokenNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrInvalidScope), errors.Is(err, ErrTokenRevoked):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// createdToken is a token as it's handed over, with its secret, which is only ever shown once.
+type createdToken struct {
+	Token string    `json:"token"`
+	Info  *APIToken `json:"info"`
+}
+
+func handleGetTokens(w http.ResponseWriter, r *http.Request) {
+	tokens, err := ListAPITokens()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(tokens); err != nil {
+		log.Println(err)
+	}
+}
+
+// handleCreateToken makes a token from {"label", "cat", "uuid", "scopes", "expires"},
+// where expires is a duration from now, like "720h", or a time.
+func handleCreateToken(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		Label   string   `json:"label"`
+		Cat     string   `json:"cat"`
+		UUID    string   `json:"uuid"`
+		Scopes  []string `json:"scopes"`
+		Expires string   `json:"expires"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	expires, err := parseTokenExpiry(body.Expires, time.Now())
+	if err != nil {
+		http.Error(w, "invalid expires: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	token, t, err := CreateAPIToken(body.Label, body.Cat, body.UUID, body.Scopes, expires)
+	if err != nil {
+		http.Error(w, err.Error(), tokenErrorStatus(err))
+		return
+	}
+	log.Println("Created token", t.ID, "for", t.Label)
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(createdToken{Token: token, Info: t}); err != nil {
+		log.Println(err)
+	}
+}
+
+func handleRotateToken(w http.ResponseWriter, r *http.Request) {
+	token, t, err := RotateAPIToken(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), tokenErrorStatus(err))
+		return
+	}
+	log.Println("Rotated token", t.ID)
+	if err := json.NewEncoder(w).Encode(createdToken{Token: token, Info: t}); err != nil {
+		log.Println(err)
+	}
+}
+
+// handleExpireToken sets when the token expires, from {"expires": ...}, as for creating it. Without it, it expires now.
+func handleExpireToken(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		Expires *string `json:"expires"`
+	}{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	at := time.Now()
+	if body.Expires != nil {
+		var err error
+		if at, err = parseTokenExpiry(*body.Expires, at); err != nil {
+			http.Error(w, "invalid expires: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	id := mux.Vars(r)["id"]
+	if err := ExpireAPIToken(id, at); err != nil {
+		http.Error(w, err.Error(), tokenErrorStatus(err))
+		return
+	}
+	writeToken(w, id)
+}
+
+// handleRevokeToken revokes the token for good.
+func handleRevokeToken(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if err := RevokeAPIToken(id); err != nil {
+		http.Error(w, err.Error(), tokenErrorStatus(err))
+		return
+	}
+	log.Println("Revoked token", id)
+	writeToken(w, id)
+}
+
+func writeToken(w http.ResponseWriter, id string) {
+	t, err := GetAPIToken(id)
+	if err != nil {
+		http.Error(w, err.Error(), tokenErrorStatus(err))
+		return
+	}
+	if err := json.NewEncoder(w).Encode(t); err != nil {
+		log.Println(err)
+	}
+}
+
+func shareLinkErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrShareLinkRevoked), errors.Is(err, ErrShareLinkExpired):
+		return http.StatusGone
+	case errors.Is(err, ErrShareLinkNotFound), errors.Is(err, ErrInvalidShareLink):
+		return http.StatusNotFound
+	case errors.Is(err, errShareLinkInvalid):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// createdShareLink is a share link as it's handed over, with its token and URL.
+type createdShareLink struct {
+	Token string     `json:"token"`
+	URL   string     `json:"url"`
+	Info  *ShareLink `json:"info"`
+}
+
+func handleGetShareLinks(w http.ResponseWriter, r *http.Request) {
+	links, err := ListShareLinks()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(links); err != nil {
+		log.Println(err)
+	}
+}
+
+// handleCreateShareLink makes a share link from {"label", "cat", "start", "end", "expires"},
+// where start and end are times, and expires is a duration from now, like "4h", or a time.
+func handleCreateShareLink(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		Label   string `json:"label"`
+		Cat     string `json:"cat"`
+		Start   string `json:"start"`
+		End     string `json:"end"`
+		Expires string `json:"expires"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	window := [2]*time.Time{}
+	for i, raw := range []string{body.Start, body.End} {
+		t, err := parseTimeParam(raw)
+		if err != nil {
+			http.Error(w, "invalid window: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !t.IsZero() {
+			window[i] = &t
+		}
+	}
+	expires, err := parseTokenExpiry(body.Expires, time.Now())
+	if err != nil {
+		http.Error(w, "invalid expires: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	token, s, err := CreateShareLink(body.Label, body.Cat, window[0], window[1], expires)
+	if err != nil {
+		http.Error(w, err.Error(), shareLinkErrorStatus(err))
+		return
+	}
+	log.Println("Created share link", s.ID, "to", s.Cat, "for", s.Label)
+	w.WriteHeader(http.StatusCreated)
+	created := createdShareLink{Token: token, URL: requestBaseURL(r) + "/share/" + token, Info: s}
+	if err := json.NewEncoder(w).Encode(created); err != nil {
+		log.Println(err)
+	}
+}
+
+// handleRevokeShareLink revokes the share link for good.
+func handleRevokeShareLink(w http.ResponseWriter, r *http.Request) {
+	s, err := RevokeShareLink(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), shareLinkErrorStatus(err))
+		return
+	}
+	log.Println("Revoked share link", s.ID)
+	if err := json.NewEncoder(w).Encode(s); err != nil {
+		log.Println(err)
+	}
+}
+
+// handleGetShare returns what the share link shows: the cat, the window and when it expires.
+func handleGetShare(w http.ResponseWriter, r *http.Request) {
+	s := shareLinkFromContext(r.Context())
+	info := struct {
+		Cat     string     `json:"cat"`
+		Start   *time.Time `json:"start,omitempty"`
+		End     *time.Time `json:"end,omitempty"`
+		Expires time.Time  `json:"expires"`
+	}{s.Cat, s.Start, s.End, s.Expires}
+	if err := json.NewEncoder(w).Encode(info); err != nil {
+		log.Println(err)
+	}
+}
+
+// handleGetShareLastKnown returns the shared cat's last known position, if it's in the link's window.
+func handleGetShareLastKnown(w http.ResponseWriter, r *http.Request) {
+	s := shareLinkFromContext(r.Context())
+	b, err := getLastKnownData()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	lk := LastKnownGeoJSON{}
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &lk); err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	view := newPrivacyView(nil)
+	for _, f := range lk {
+		if !s.allows(f) {
+			continue
+		}
+		if f, ok := view.feature(f); ok {
+			if err := json.NewEncoder(w).Encode(f); err != nil {
+				log.Println(err)
+			}
+			return
+		}
+	}
+	http.Error(w, "Nothing to show", http.StatusNotFound)
+}
+
+// handleGetShareTrack returns the shared cat's recent track, in the link's window.
+func handleGetShareTrack(w http.ResponseWriter, r *http.Request) {
+	features, err := getShareTrack(shareLinkFromContext(r.Context()), time.Now())
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fc := geojson.NewFeatureCollection()
+	fc.Features = newPrivacyView(nil).features(features)
+	bs, err := json.Marshal(fc)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(bs)
+}
+
+// handleGetShareEvents streams the shared cat's live feed.
+func handleGetShareEvents(w http.ResponseWriter, r *http.Request) {
+	streamEvents(w, r, shareLinkFromContext(r.Context()))
+}
@@ -7,7 +7,6 @@ import (
 	"time"
 
 	"github.com/paulmach/orb/geojson"
-	"github.com/rotblauer/tileTester2/note"
 )
 
 func TestValidVisitGrabbing(t *testing.T) {
@@ -38,7 +37,7 @@ func TestValidVisitGrabbing(t *testing.T) {
 		Notes:     exampleNotesValidVisit,
 	}
 
-	sn, err := note.NotesField(tp.Notes).AsNoteStructured()
+	sn, err := NotesField(tp.Notes).AsNoteStructured()
 	if err != nil {
 		t.Error("err", err)
 	}
@@ -0,0 +1,59 @@
+package catTrackslib
+
+import (
+	"encoding/json"
+	"log"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The live detectors, of stays and trips, keep each cat's stay or trip in progress in the live state bucket,
+// keyed by kind and cat name, so a restart picks up where it left off rather than losing or splitting it.
+// A cat's state is read when its detector is first needed, and written after each batch of its points.
+
+const (
+	liveStateStayPoints = "staypoints"
+	liveStateTrips      = "trips"
+)
+
+func buildLiveStateKey(kind, name string) []byte {
+	return []byte(kind + "+" + name)
+}
+
+// getLiveState reads the cat's state of the kind into v, reporting whether there was one.
+func getLiveState(kind, name string, v any) bool {
+	found := false
+	err := GetDB("master").View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(liveStateKey)).Get(buildLiveStateKey(kind, name))
+		if b == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(b, v)
+	})
+	if err != nil {
+		log.Println("error reading live state:", kind, name, err)
+		return false
+	}
+	return found
+}
+
+// putLiveStates writes the cats' states of the kind, by name.
+func putLiveStates(kind string, states map[string]any) error {
+	if len(states) == 0 {
+		return nil
+	}
+	return GetDB("master").Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(liveStateKey))
+		for name, v := range states {
+			bs, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(buildLiveStateKey(kind, name), bs); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,66 @@
+package catTrackslib
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+)
+
+func TestLiveStateAcrossRestarts(t *testing.T) {
+	SetDBPath("master", filepath.Join(t.TempDir(), "m.db"))
+	if err := InitBoltDB(); err != nil {
+		t.Fatal(err)
+	}
+	defer GetDB("master").Close()
+	restart := func() {
+		stayPointDetectors = map[string]*stayPointDetector{}
+		tripSegmenters = map[string]*tripSegmenter{}
+	}
+	restart()
+	defer restart()
+
+	t0 := time.Date(2024, 3, 2, 15, 0, 0, 0, time.UTC)
+	lat, seconds := 44.98931, 0
+	// move goes north for n points, meters and seconds per point at a time, through the live detectors.
+	move := func(activity string, n int, meters float64, every int) {
+		features := []*geojson.Feature{}
+		for i := 0; i < n; i++ {
+			seconds += every
+			lat += meters / 110540
+			f := geojson.NewFeature(orb.Point{-93.25544, lat})
+			f.Properties = map[string]interface{}{
+				"Name":     "rye",
+				"UUID":     "rye-uuid",
+				"Time":     t0.Add(time.Duration(seconds) * time.Second),
+				"Accuracy": 5.0,
+				"Activity": activity,
+			}
+			features = append(features, f)
+		}
+		detectStayPoints(features)
+		segmentTrips(features)
+	}
+
+	move("Stationary", 10, 0, 30) // 5 minutes at home...
+	restart()
+	move("Stationary", 10, 0, 30)   // ...and 5 more after a restart
+	move("Automotive", 18, 100, 10) // half a drive...
+	restart()
+	move("Automotive", 18, 100, 10) // ...and the rest
+	move("Stationary", 20, 0, 30)
+
+	visits, _ := getVisits(visitsQuery{Cat: "rye"})
+	if len(visits) != 1 || !visits[0].Properties["ArrivalTime"].(time.Time).Equal(t0.Add(30*time.Second)) {
+		t.Fatalf("got %d visits, want the stay at home, from its first point", len(visits))
+	}
+	trips, _ := getTrips(tripsQuery{Cat: "rye"})
+	if len(trips) != 1 {
+		t.Fatalf("got %d trips, want the drive in one", len(trips))
+	}
+	if d := trips[0].Properties["Distance"].(float64); d < 3500 {
+		t.Errorf("got a %vm trip, want the whole 3.6km", d)
+	}
+}
@@ -1,10 +1,8 @@
 package catTrackslib
 
 import (
-	"bytes"
 	"compress/gzip"
 	"context"
-	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
@@ -14,7 +12,7 @@ import (
 	// image.Decode to understand JPEG formatted images. Uncomment these
 	// two lines to also understand GIF and PNG images:
 	_ "image/gif"
-	"image/jpeg"
+	"io"
 	"log"
 	"math"
 	"math/rand"
@@ -24,11 +22,6 @@ import (
 	"sync"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/request"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/davecgh/go-spew/spew"
 	"github.com/golang/groupcache/lru"
 	"github.com/mitchellh/hashstructure/v2"
@@ -122,13 +115,54 @@ func CloseGZ(f F) {
 	f.f.Close()
 }
 
+// readGZFeatures calls fn for each newline-delimited GeoJSON feature in the gzipped file at path,
+// eg. master.json.gz.
+func readGZFeatures(path string, fn func(f *geojson.Feature) error) error {
+	fi, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fi.Close()
+	gr, err := gzip.NewReader(fi)
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+
+	dec := json.NewDecoder(gr)
+	for {
+		f := &geojson.Feature{}
+		if err := dec.Decode(f); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+}
+
 var NotifyNewEdge = make(chan bool, 1000)
 var NotifyNewPlace = make(chan bool, 1000)
 var FeaturePlaceChan = make(chan *geojson.Feature, 100000)
 
 var masterGZLock sync.Mutex
 
+// storePointsOptions are how points are stored, set by us, never by what's populated.
+type storePointsOptions struct {
+	// Restored points are from the quarantine: reviewed, and likely old and out of order.
+	// They skip the plausibility rules and everything keeping live state (motion, modes, smoothing,
+	// the stay, trip and geofence detectors, and the last known), and are only stored, with their visits and catsnaps.
+	Restored bool
+}
+
 func storePoints(features []*geojson.Feature) ([]*geojson.Feature, error) {
+	return storePointsWith(features, storePointsOptions{})
+}
+
+func storePointsWith(features []*geojson.Feature, opts storePointsOptions) ([]*geojson.Feature, error) {
 	var err error
 
 	if len(features) == 0 {
@@ -207,6 +241,13 @@ func storePoints(features []*geojson.Feature) ([]*geojson.Feature, error) {
 		return ti.Before(tj)
 	})
 
+	if !opts.Restored {
+		features = checkPlausibility(features)
+		deriveMotion(features)
+		inferModes(features)
+		smoothPoints(features)
+	}
+
 	stored := []*geojson.Feature{}
 	for _, feature := range features {
 		// storePoint can modify the point, like tp.ID, tp.imgS3 field
@@ -216,6 +257,9 @@ func storePoints(features []*geojson.Feature) ([]*geojson.Feature, error) {
 			continue
 		}
 		stored = append(stored, feature)
+		if _, e := storeVisitFromFeature(feature); e != nil {
+			log.Println("store visit error: ", e)
+		}
 		if tracksGZPath != "" {
 			featureChan <- feature
 		}
@@ -224,7 +268,21 @@ func storePoints(features []*geojson.Feature) ([]*geojson.Feature, error) {
 		}
 	}
 
-	if err == nil {
+	if opts.Restored {
+		if err := updateSignificantPlaces(); err != nil {
+			log.Println("update significant places error:", err)
+		}
+		return stored, err
+	}
+
+	detectStayPoints(stored)
+	if err := updateSignificantPlaces(); err != nil {
+		log.Println("update significant places error:", err)
+	}
+	segmentTrips(stored)
+	evaluateGeofences(stored)
+
+	if err == nil && len(features) > 0 {
 		l := len(features)
 		// err = storemetadata(features[l-1], l)
 		storeLastKnown(features[l-1])
@@ -369,20 +427,24 @@ func storePoint(feat *geojson.Feature) error {
 	// define 'key' for s3 upload
 	k := fmt.Sprintf("%s_%s_%d", catnames.AliasOrSanitizedName(feat.Properties["Name"].(string)),
 		feat.Properties["UUID"].(string), tpTime.Unix()) // RandStringRunes(32)
-	if os.Getenv("AWS_BUCKETNAME") != "" {
-		feat.Properties["imgS3"] = os.Getenv("AWS_BUCKETNAME") + "/" + k
-	} else {
-		// won't be an s3 url, but will have a sufficient filename for indexing
-		feat.Properties["imgS3"] = k
-	}
+	feat.Properties["imgS3"] = catsnapImgS3(k)
 
 	// decode base64 -> image
 	b64 := feat.Properties["imgB64"].(string)
 
-	jpegBytes, jpegErr := b64ToJPGBytes(b64)
-	if jpegErr != nil {
-		log.Println("Error converting b64 to jpeg bytes: err=", jpegErr)
-		return jpegErr
+	imgBytes, contentType, imgErr := b64ToImageBytes(b64)
+	if imgErr != nil {
+		log.Println("Error decoding b64 image: err=", imgErr)
+		return imgErr
+	}
+	feat.Properties["imgMIME"] = contentType
+	hash, hashed, skip := dedupeCatsnap(feat, imgBytes)
+	if skip {
+		// Keep the point, but not the image it already sent.
+		delete(feat.Properties, "imgB64")
+		delete(feat.Properties, "imgS3")
+		delete(feat.Properties, "imgMIME")
+		return nil
 	}
 
 	// remove the b64 from the properties
@@ -390,23 +452,10 @@ func storePoint(feat *geojson.Feature) error {
 
 	_db := GetDB("master")
 
-	go func() {
-		// save jpg to fs
-		dbRootDir := filepath.Dir(_db.Path())
-		catsnapsDir := filepath.Join(dbRootDir, "catsnaps")
-		os.MkdirAll(catsnapsDir, 0755)
-		imagePath := filepath.Join(catsnapsDir, k+".jpg")
-		if e := os.WriteFile(imagePath, jpegBytes, 0644); e != nil {
-			log.Println("Error writing catsnap to fs: err=", e)
-			err = e
-		}
-	}()
-	if os.Getenv("AWS_BUCKETNAME") != "" {
-		go func() {
-			if e := storeImageS3(k, jpegBytes); e != nil {
-				err = e
-			}
-		}()
+	// The local copy is kept before the catsnap is, so it's there to be served and uploaded.
+	if err := catsnapLocalStore().Put(context.Background(), k+catsnapExt(contentType), imgBytes, contentType); err != nil {
+		log.Println("Error writing catsnap to fs: err=", err)
+		return err
 	}
 
 	err = _db.Update(func(tx *bolt.Tx) error {
@@ -426,89 +475,28 @@ func storePoint(feat *geojson.Feature) error {
 			err = e
 			return err
 		}
+		if e := indexCatSnap(tx, tpBoltKey, feat); e != nil {
+			log.Println("Error indexing catsnap: err=", e)
+			return e
+		}
 		log.Println("Saved catsnap: ", feat)
 		return err
 	})
 
 	if err != nil {
 		log.Println(err)
+		return err
 	}
-	return err
-}
-
-func b64ToJPGBytes(b64 string) ([]byte, error) {
-	// Decode
-	unbased, err := base64.StdEncoding.DecodeString(b64)
-	if err != nil {
-		return nil, err
-	}
-
-	r := bytes.NewReader(unbased)
-	im, err := jpeg.Decode(r)
-	if err != nil {
-		return nil, err
-	}
-
-	b := []byte{}
-	buf := bytes.NewBuffer(b)
-	err = jpeg.Encode(buf, im, &jpeg.Options{Quality: 100})
-	if err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
-}
-
-func storeImageS3(key string, jpegBytes []byte) (err error) {
-
-	// S3
-
-	// All clients require a Session. The Session provides the client with
-	// shared configuration such as region, endpoint, and credentials. A
-	// Session should be shared where possible to take advantage of
-	// configuration and credential caching. See the session package for
-	// more information.
-	sess := session.Must(session.NewSession())
-
-	// Create a new instance of the service's client with a Session.
-	// Optional aws.Config values can also be provided as variadic arguments
-	// to the New function. This option allows you to provide service
-	// specific configuration.
-	svc := s3.New(sess)
-
-	// Create a context with a timeout that will abort the upload if it takes
-	// more than the passed in timeout.
-	ctx := context.Background()
-	var cancelFn func()
-	timeout := time.Second * 10
-	if timeout > 0 {
-		ctx, cancelFn = context.WithTimeout(ctx, timeout)
-	}
-	// Ensure the context is canceled to prevent leaking.
-	// See context package for more information, https://golang.org/pkg/context/
-	defer cancelFn()
-
-	bucket := os.Getenv("AWS_BUCKETNAME")
-	// Uploads the object to S3. The Context will interrupt the request if the
-	// timeout expires.
-	_, err = svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
-		Bucket:        aws.String(bucket),
-		Key:           aws.String(key),
-		Body:          bytes.NewReader(jpegBytes),
-		ContentType:   aws.String("image/jpeg"),
-		ContentLength: aws.Int64(int64(len(jpegBytes))),
-	})
-	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == request.CanceledErrorCode {
-			// If the SDK can determine the request or retry delay was canceled
-			// by a context the CanceledErrorCode error code will be returned.
-			fmt.Fprintf(os.Stderr, "upload canceled due to timeout, %v\n", err)
-		} else {
-			fmt.Fprintf(os.Stderr, "failed to upload object, %v\n", err)
+	if hashed {
+		if err := putCatsnapHash(feat.Properties["Name"].(string), k, hash); err != nil {
+			log.Println("Error indexing catsnap hash: err=", err)
 		}
-		return err
 	}
 
-	fmt.Printf("successfully uploaded file to %s/%s\n", bucket, key)
+	// A failed upload is left pending and retried, so the catsnap is kept either way.
+	if e := uploadCatsnap(k, imgBytes, contentType); e != nil {
+		log.Println("Error uploading catsnap, left pending: key=", k, "err=", e)
+	}
 	return nil
 }
 
@@ -557,7 +545,7 @@ func migrateCatSnaps() error {
 			if err != nil {
 				return err
 			}
-			return nil
+			return indexCatSnap(tx, append([]byte(nil), k...), f)
 		})
 		return nil
 	})
@@ -0,0 +1,341 @@
+package catTrackslib
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+)
+
+// Transport modes inferred from the motion of a cat's points,
+// for when the Activity reported by the phone is missing, "Unknown", or plain wrong
+// (iOS calls trains Automotive).
+// The inferred mode is stored in the InferredMode and InferredModeConfidence properties,
+// alongside whatever Activity the phone reported.
+const (
+	modeStationary = "Stationary"
+	modeWalking    = "Walking"
+	modeRunning    = "Running"
+	modeCycling    = "Cycling"
+	modeAutomotive = "Automotive"
+	modeTrain      = "Train"
+	modeFlying     = "Flying"
+)
+
+var inferredModes = []string{modeStationary, modeWalking, modeRunning, modeCycling, modeAutomotive, modeTrain, modeFlying}
+
+// ModeClassifierOptions configures the transport mode classifier.
+type ModeClassifierOptions struct {
+	// Window is how much of the cat's recent track the features of a point are computed over.
+	Window time.Duration
+	// MaxGap forgets the window when there are no points for this long.
+	MaxGap time.Duration
+}
+
+var DefaultModeClassifierOptions = ModeClassifierOptions{
+	Window: 2 * time.Minute,
+	MaxGap: 5 * time.Minute,
+}
+
+type modeSample struct {
+	pt       orb.Point
+	time     time.Time
+	speed    float64 // m/s
+	course   float64 // degrees, NaN if unknown
+	acc      float64 // m
+	motion   float64 // user acceleration magnitude (g), -1 if unknown
+	rotation float64 // rotation rate magnitude (rad/s), -1 if unknown
+}
+
+// modeFeatures summarize a window of samples.
+type modeFeatures struct {
+	Speed      float64 // median speed, m/s
+	HighSpeed  float64 // 90th percentile speed, m/s
+	AccelStd   float64 // (robust) standard deviation of acceleration, m/s²
+	HeadingVar float64 // circular variance of courses, 0 (straight) to 1
+	StopFrac   float64 // fraction of samples below 1 m/s
+	Accuracy   float64 // median accuracy, m
+	Motion     float64 // mean user acceleration magnitude, g; -1 if unknown
+	Rotation   float64 // mean rotation rate magnitude, rad/s; -1 if unknown
+	N          int
+}
+
+// modeClassifier keeps the recent window of one cat's points.
+type modeClassifier struct {
+	opts    ModeClassifierOptions
+	samples []modeSample
+}
+
+func newModeClassifier(opts ModeClassifierOptions) *modeClassifier {
+	return &modeClassifier{opts: opts}
+}
+
+func featureFloat(f *geojson.Feature, key string) (float64, bool) {
+	v, ok := f.Properties[key].(float64)
+	return v, ok
+}
+
+// featureVectorMagnitude returns the magnitude of the vector in the properties prefix+X, Y and Z,
+// or -1 if they're missing.
+func featureVectorMagnitude(f *geojson.Feature, prefix string) float64 {
+	x, okX := featureFloat(f, prefix+"X")
+	y, okY := featureFloat(f, prefix+"Y")
+	z, okZ := featureFloat(f, prefix+"Z")
+	if !okX || !okY || !okZ {
+		return -1
+	}
+	return math.Sqrt(x*x + y*y + z*z)
+}
+
+// sample builds a sample for the feature. Speed and course are as the phone reported them,
+// or as deriveMotion filled them in; missing speed counts as standing still, missing course as unknown.
+func (c *modeClassifier) sample(f *geojson.Feature) modeSample {
+	s := modeSample{
+		pt:       f.Geometry.(orb.Point),
+		time:     mustGetTime(f),
+		course:   math.NaN(),
+		motion:   featureVectorMagnitude(f, "UserAccelerometer"),
+		rotation: featureVectorMagnitude(f, "Gyroscope"),
+	}
+	s.acc, _ = featureFloat(f, "Accuracy")
+	if v, ok := featureFloat(f, "Speed"); ok && v >= 0 {
+		s.speed = v
+	}
+	if v, ok := featureFloat(f, "Heading"); ok && v >= 0 {
+		s.course = v
+	}
+	return s
+}
+
+// push adds the point to the window.
+func (c *modeClassifier) push(f *geojson.Feature) {
+	s := c.sample(f)
+	if len(c.samples) > 0 {
+		last := c.samples[len(c.samples)-1]
+		if !s.time.After(last.time) {
+			// Out of order or duplicate; the stream is assumed chronological.
+			return
+		}
+		if s.time.Sub(last.time) > c.opts.MaxGap {
+			c.samples = c.samples[:0]
+		}
+	}
+	c.samples = append(c.samples, s)
+	i := 0
+	for i < len(c.samples)-1 && s.time.Sub(c.samples[i].time) > c.opts.Window {
+		i++
+	}
+	c.samples = c.samples[i:]
+}
+
+func median(vals []float64) float64 {
+	return percentile(vals, 0.5)
+}
+
+func percentile(vals []float64, p float64) float64 {
+	if len(vals) == 0 {
+		return 0
+	}
+	sorted := append([]float64{}, vals...)
+	sort.Float64s(sorted)
+	return sorted[int(math.Round(p*float64(len(sorted)-1)))]
+}
+
+func (c *modeClassifier) features() modeFeatures {
+	ft := modeFeatures{N: len(c.samples), Motion: -1, Rotation: -1}
+	speeds := make([]float64, 0, len(c.samples))
+	accs := make([]float64, 0, len(c.samples))
+	var sumSin, sumCos float64
+	var nCourse, nMotion, nRotation int
+	var sumMotion, sumRotation float64
+	accels := make([]float64, 0, len(c.samples))
+
+	for i, s := range c.samples {
+		speeds = append(speeds, s.speed)
+		accs = append(accs, s.acc)
+		if s.speed < 1 {
+			ft.StopFrac++
+		}
+		if !math.IsNaN(s.course) && s.speed >= 1 {
+			r := s.course * math.Pi / 180
+			sumSin += math.Sin(r)
+			sumCos += math.Cos(r)
+			nCourse++
+		}
+		if s.motion >= 0 {
+			sumMotion += s.motion
+			nMotion++
+		}
+		if s.rotation >= 0 {
+			sumRotation += s.rotation
+			nRotation++
+		}
+		if i > 0 {
+			if dt := s.time.Sub(c.samples[i-1].time).Seconds(); dt > 0 {
+				accels = append(accels, (s.speed-c.samples[i-1].speed)/dt)
+			}
+		}
+	}
+
+	ft.Speed = median(speeds)
+	ft.HighSpeed = percentile(speeds, 0.9)
+	ft.Accuracy = median(accs)
+	ft.StopFrac /= float64(len(c.samples))
+	if nCourse > 1 {
+		ft.HeadingVar = 1 - math.Hypot(sumSin, sumCos)/float64(nCourse)
+	}
+	if len(accels) > 1 {
+		// Use the median absolute deviation, so that a few bad speeds don't make a train look like a car.
+		m := median(accels)
+		devs := make([]float64, len(accels))
+		for i, a := range accels {
+			devs[i] = math.Abs(a - m)
+		}
+		ft.AccelStd = 1.4826 * median(devs)
+	}
+	if nMotion > 0 {
+		ft.Motion = sumMotion / float64(nMotion)
+	}
+	if nRotation > 0 {
+		ft.Rotation = sumRotation / float64(nRotation)
+	}
+	return ft
+}
+
+// trapezoid is 0 below a, rises to 1 at b, stays 1 until c, and falls to 0 at d.
+func trapezoid(x, a, b, c, d float64) float64 {
+	switch {
+	case x <= a || x >= d:
+		return 0
+	case x < b:
+		return (x - a) / (b - a)
+	case x <= c:
+		return 1
+	default:
+		return (d - x) / (d - c)
+	}
+}
+
+func clamp01(x float64) float64 {
+	return math.Max(0, math.Min(1, x))
+}
+
+// scoreModes scores how well the features fit each mode.
+// Speed does most of the work; the rest tell apart modes with overlapping speeds.
+// The reported activity, if any, gets a small benefit of the doubt.
+func scoreModes(ft modeFeatures, activity string) map[string]float64 {
+	s := ft.Speed
+	scores := map[string]float64{
+		modeStationary: trapezoid(s, -1, -1, 0.3, 0.8),
+		modeWalking:    trapezoid(s, 0.3, 0.8, 1.9, 2.6),
+		modeRunning:    trapezoid(s, 1.9, 2.6, 4.5, 6.5),
+		modeCycling:    trapezoid(s, 2.5, 3.5, 8, 11),
+		modeAutomotive: trapezoid(s, 3, 7, 33, 45),
+		modeTrain:      trapezoid(s, 5, 12, 80, 95),
+		modeFlying:     trapezoid(s, 45, 70, 400, 500),
+	}
+
+	// Bikes don't often keep up with traffic.
+	scores[modeCycling] *= trapezoid(ft.HighSpeed, -1, -1, 10, 14)
+
+	// Feet shake the phone a lot, bikes some, vehicles hardly at all.
+	if ft.Motion >= 0 {
+		scores[modeRunning] *= 0.3 + 0.7*trapezoid(ft.Motion, 0.3, 0.5, 5, 6)
+		scores[modeWalking] *= 0.3 + 0.7*trapezoid(ft.Motion, 0.05, 0.1, 0.6, 1)
+		scores[modeCycling] *= 0.3 + 0.7*trapezoid(ft.Motion, -1, -1, 0.35, 0.6)
+		scores[modeAutomotive] *= 0.3 + 0.7*trapezoid(ft.Motion, -1, -1, 0.1, 0.2)
+	}
+
+	// Trains run smooth and straight; cars speed up, slow down, turn, and rattle.
+	// Each of these is weak evidence on its own, so they're averaged.
+	smooth := clamp01(1-ft.AccelStd/0.4) + clamp01(1-ft.HeadingVar/0.1)
+	if ft.Rotation >= 0 {
+		smooth = (smooth + clamp01(1-(ft.Rotation-0.03)/0.07)) / 3
+	} else {
+		smooth /= 2
+	}
+	scores[modeTrain] *= smooth
+	scores[modeAutomotive] *= 1 - 0.7*smooth
+
+	if _, ok := scores[activity]; ok && activity != modeStationary {
+		scores[activity] *= 1.1
+	}
+	return scores
+}
+
+// classify returns the most likely mode for the window, and a confidence between 0 and 1:
+// the share of the winning score, discounted for poor accuracy and short windows.
+func (ft modeFeatures) classify(activity string) (string, float64) {
+	scores := scoreModes(ft, activity)
+	best, bestScore, total := tripModeUnknown, 0.0, 0.0
+	for _, mode := range inferredModes {
+		total += scores[mode]
+		if scores[mode] > bestScore {
+			best, bestScore = mode, scores[mode]
+		}
+	}
+	if bestScore == 0 {
+		return tripModeUnknown, 0
+	}
+	conf := bestScore / total
+	conf *= 1 - 0.5*clamp01((ft.Accuracy-20)/180)
+	if ft.N < 3 {
+		conf *= 0.5
+	}
+	return best, toFixed(conf, 2)
+}
+
+// classify adds the point to the window and classifies it.
+func (c *modeClassifier) classify(f *geojson.Feature) (string, float64) {
+	c.push(f)
+	activity, _ := f.Properties["Activity"].(string)
+	return c.features().classify(activity)
+}
+
+// segmentMode votes for the mode of a segment from the modes of its points,
+// weighted by their confidence and the time until the next point.
+func segmentMode(modes []string, confs []float64, times []time.Time) (string, float64) {
+	votes := map[string]float64{}
+	total := 0.0
+	for i := 1; i < len(modes); i++ {
+		w := times[i].Sub(times[i-1]).Seconds() * confs[i-1]
+		votes[modes[i-1]] += w
+		total += w
+	}
+	best, bestVotes := tripModeUnknown, 0.0
+	for mode, v := range votes {
+		if v > bestVotes || (v == bestVotes && v > 0 && mode < best) {
+			best, bestVotes = mode, v
+		}
+	}
+	if total == 0 {
+		return tripModeUnknown, 0
+	}
+	return best, toFixed(bestVotes/total, 2)
+}
+
+// modeClassifiers holds the live classifiers, by cat name, for points arriving through storePoints.
+var modeClassifiers = map[string]*modeClassifier{}
+var modeClassifiersLock sync.Mutex
+
+// inferModes sets the InferredMode and InferredModeConfidence properties of the features,
+// which must be sorted by time, and have been through deriveMotion.
+func inferModes(features []*geojson.Feature) {
+	modeClassifiersLock.Lock()
+	defer modeClassifiersLock.Unlock()
+
+	for _, f := range features {
+		name, _ := f.Properties["Name"].(string)
+		c, ok := modeClassifiers[name]
+		if !ok {
+			c = newModeClassifier(modeClassifierOptions)
+			modeClassifiers[name] = c
+		}
+		mode, conf := c.classify(f)
+		f.Properties["InferredMode"] = mode
+		f.Properties["InferredModeConfidence"] = conf
+	}
+}
@@ -0,0 +1,72 @@
+package catTrackslib
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/paulmach/orb/geojson"
+)
+
+// TestModeClassifierLabeled runs the classifier over a labeled synthetic track.
+// See testdata/modes/generate.go.
+func TestModeClassifierLabeled(t *testing.T) {
+	file, err := os.Open("testdata/modes/labeled.ndgeojson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	type run struct {
+		label  string
+		modes  []string
+		confs  []float64
+		times  []time.Time
+		points int
+		right  int
+	}
+	runs := []*run{}
+
+	m := newMotionDeriver(DefaultMotionOptions)
+	c := newModeClassifier(DefaultModeClassifierOptions)
+	dec := json.NewDecoder(file)
+	for {
+		f := &geojson.Feature{}
+		if err := dec.Decode(f); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		label := f.Properties["Label"].(string)
+		if len(runs) == 0 || runs[len(runs)-1].label != label {
+			runs = append(runs, &run{label: label})
+		}
+		r := runs[len(runs)-1]
+
+		m.derive(f)
+		mode, conf := c.classify(f)
+		r.modes = append(r.modes, mode)
+		r.confs = append(r.confs, conf)
+		r.times = append(r.times, mustGetTime(f))
+		r.points++
+		if mode == label {
+			r.right++
+		}
+	}
+
+	var points, right int
+	for _, r := range runs {
+		points += r.points
+		right += r.right
+		mode, conf := segmentMode(r.modes, r.confs, r.times)
+		t.Logf("%-10s %3d/%3d points right, segment %s (%.2f)", r.label, r.right, r.points, mode, conf)
+		if mode != r.label {
+			t.Errorf("%s segment: got mode %s", r.label, mode)
+		}
+	}
+	if ratio := float64(right) / float64(points); ratio < 0.8 {
+		t.Errorf("got %.2f of points right, want at least 0.8", ratio)
+	}
+}
@@ -0,0 +1,102 @@
+package catTrackslib
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geo"
+	"github.com/paulmach/orb/geojson"
+)
+
+// Phones report -1 for Speed and Heading when they don't know them (iOS), or leave them out.
+// deriveMotion fills them in from the cat's previous point, and marks them
+// with SpeedSource and HeadingSource properties, so they can be told apart from what the phone measured.
+
+const motionSourceDerived = "derived"
+
+type MotionOptions struct {
+	// MaxGap is the longest time between points to derive speed and heading over.
+	MaxGap time.Duration
+}
+
+var DefaultMotionOptions = MotionOptions{
+	MaxGap: 5 * time.Minute,
+}
+
+type motionPoint struct {
+	pt   orb.Point
+	acc  float64
+	time time.Time
+}
+
+// motionDeriver remembers a cat's last point, to derive the next point's speed and heading from.
+type motionDeriver struct {
+	opts MotionOptions
+	last *motionPoint
+}
+
+func newMotionDeriver(opts MotionOptions) *motionDeriver {
+	return &motionDeriver{opts: opts}
+}
+
+// derive sets the feature's Speed and Heading if they're missing or negative,
+// and it can tell them from the last point.
+func (m *motionDeriver) derive(f *geojson.Feature) {
+	p := motionPoint{pt: f.Geometry.(orb.Point), time: mustGetTime(f)}
+	p.acc, _ = featureFloat(f, "Accuracy")
+
+	prev := m.last
+	if prev != nil && !p.time.After(prev.time) {
+		// Out of order, or a duplicate; leave it be, and keep the later point to derive from.
+		return
+	}
+	m.last = &p
+	if prev == nil || p.time.Sub(prev.time) > m.opts.MaxGap {
+		return
+	}
+
+	dt := p.time.Sub(prev.time).Seconds()
+	d := geo.Distance(prev.pt, p.pt)
+	// Don't count movement the accuracy of the fixes can explain.
+	moved := d > (prev.acc+p.acc)/2
+
+	if v, ok := featureFloat(f, "Speed"); !ok || v < 0 {
+		speed := 0.0
+		if moved {
+			speed = d / dt
+		}
+		f.Properties["Speed"] = toFixed(speed, 3)
+		f.Properties["SpeedSource"] = motionSourceDerived
+	}
+	if v, ok := featureFloat(f, "Heading"); (!ok || v < 0) && moved {
+		f.Properties["Heading"] = toFixed(math.Mod(geo.Bearing(prev.pt, p.pt)+360, 360), 1)
+		f.Properties["HeadingSource"] = motionSourceDerived
+	}
+}
+
+// isDerived returns true if the feature's property (Speed or Heading) was derived, not reported by the phone.
+func isDerived(f *geojson.Feature, key string) bool {
+	return f.Properties[key+"Source"] == motionSourceDerived
+}
+
+// motionDerivers holds the live derivers, by cat name, for points arriving through storePoints.
+var motionDerivers = map[string]*motionDeriver{}
+var motionDeriversLock sync.Mutex
+
+// deriveMotion fills in missing Speed and Heading for the features, which must be sorted by time.
+func deriveMotion(features []*geojson.Feature) {
+	motionDeriversLock.Lock()
+	defer motionDeriversLock.Unlock()
+
+	for _, f := range features {
+		name, _ := f.Properties["Name"].(string)
+		m, ok := motionDerivers[name]
+		if !ok {
+			m = newMotionDeriver(motionOptions)
+			motionDerivers[name] = m
+		}
+		m.derive(f)
+	}
+}
@@ -0,0 +1,68 @@
+package catTrackslib
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+)
+
+func TestMotionDeriver(t *testing.T) {
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	home := orb.Point{-93.25544, 44.98931}
+	// north returns the point m meters north of home.
+	north := func(m float64) orb.Point {
+		return orb.Point{home.Lon(), home.Lat() + m/111132}
+	}
+	point := func(pt orb.Point, sec int, speed, heading float64) *geojson.Feature {
+		f := geojson.NewFeature(pt)
+		f.Properties["Name"] = "rye"
+		f.Properties["Time"] = start.Add(time.Duration(sec) * time.Second).Format(time.RFC3339)
+		f.Properties["Accuracy"] = 5.0
+		f.Properties["Speed"] = speed
+		f.Properties["Heading"] = heading
+		return f
+	}
+
+	m := newMotionDeriver(DefaultMotionOptions)
+
+	first := point(home, 0, -1, -1)
+	m.derive(first)
+	if first.Properties["Speed"] != -1.0 || isDerived(first, "Speed") {
+		t.Errorf("first point: want nothing derived, got %v", first.Properties)
+	}
+
+	// Walking north, 100m in 60s; the phone doesn't know.
+	walking := point(north(100), 60, -1, -1)
+	m.derive(walking)
+	if v := walking.Properties["Speed"].(float64); math.Abs(v-100.0/60) > 0.05 || !isDerived(walking, "Speed") {
+		t.Errorf("walking: want derived speed ~1.67, got %v", walking.Properties)
+	}
+	if v := walking.Properties["Heading"].(float64); (v > 1 && v < 359) || !isDerived(walking, "Heading") {
+		t.Errorf("walking: want derived heading ~0, got %v", walking.Properties)
+	}
+
+	// The phone knows; leave it alone.
+	reported := point(north(200), 120, 1.5, 2)
+	m.derive(reported)
+	if reported.Properties["Speed"] != 1.5 || reported.Properties["Heading"] != 2.0 ||
+		isDerived(reported, "Speed") || isDerived(reported, "Heading") {
+		t.Errorf("reported: want untouched, got %v", reported.Properties)
+	}
+
+	// Jitter the accuracy explains is standing still, with no heading.
+	jitter := point(north(203), 180, -1, -1)
+	m.derive(jitter)
+	if jitter.Properties["Speed"] != 0.0 || jitter.Properties["Heading"] != -1.0 || isDerived(jitter, "Heading") {
+		t.Errorf("jitter: want speed 0 and no heading, got %v", jitter.Properties)
+	}
+
+	// Too long a gap to say.
+	later := point(north(1000), 3600, -1, -1)
+	m.derive(later)
+	if isDerived(later, "Speed") {
+		t.Errorf("after gap: want nothing derived, got %v", later.Properties)
+	}
+}
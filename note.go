@@ -3,7 +3,9 @@ package catTrackslib
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -243,21 +245,34 @@ type NoteVisit struct {
 	DepartureTimeString string      `json:"departureDate"`
 	Place               PlaceString `json:"place"`
 	PlaceParsed         Place
-	Valid               bool `json:"validVisit"`
+	Valid               bool   `json:"validVisit"`
+	Source              string `json:"source,omitempty"` // visitSourceIOS or visitSourceStayPoint
 	ReportedTime        time.Time
 	Duration            time.Duration
 	// GoogleNearby        *gm.PlacesSearchResponse `json:"googleNearby,omitempty"`
 	GoogleNearbyPhotos map[string]string `json:"googleNearbyPhotos,omitempty"` // photoreference:base64img
 }
 
-//	func (nv NoteVisit) GetDuration() time.Duration {
-//		calend := nv.DepartureTime
-//		// seen "departureDate\":\"4001-01-01T00:00:00.000Z\"}
-//		if nv.DepartureTime.Year() == 4001 || nv.DepartureTime.After(time.Now().Add(24*365*time.Hour)) {
-//			calend = time.Now()
-//		}
-//		return calend.Sub(nv.ArrivalTime)
-//	}
+// HasDeparture reports whether the visit has a real departure time.
+// iOS reports visits that are still ongoing with a far-future departure date.
+func (nv NoteVisit) HasDeparture() bool {
+	if nv.DepartureTime.IsZero() {
+		return false
+	}
+	// seen "departureDate\":\"4001-01-01T00:00:00.000Z\"}
+	return !(nv.DepartureTime.Year() == 4001 || nv.DepartureTime.After(time.Now().Add(24*365*time.Hour)))
+}
+
+// GetDuration returns the time spent at the visit.
+// Visits without a departure are measured until now.
+func (nv NoteVisit) GetDuration() time.Duration {
+	calend := nv.DepartureTime
+	if !nv.HasDeparture() {
+		calend = time.Now()
+	}
+	return calend.Sub(nv.ArrivalTime)
+}
+
 //
 // // map = photoreference:base64 encoded image
 //
@@ -360,50 +375,98 @@ type NoteVisit struct {
 //		// err = json.Unmarshal(b, &res)
 //		return
 //	}
+
+var (
+	ErrPlaceEmpty              = errors.New("empty place string")
+	ErrPlaceNoCoordinates      = errors.New("place string has no <lat,lng> coordinates")
+	ErrPlaceInvalidCoordinates = errors.New("place string has invalid coordinates")
+)
+
+var (
+	// placeEscapedSlashRe matches the (variously) backslash-escaped slash in '+/-'.
+	placeEscapedSlashRe = regexp.MustCompile(`\\+/`)
+	placeCoordsRe       = regexp.MustCompile(`<\s*([+-]?\d+(?:\.\d+)?)\s*,\s*([+-]?\d+(?:\.\d+)?)\s*>`)
+	placeAccuracyRe     = regexp.MustCompile(`^\s*\+\s*/\s*-\s*(\d+(?:\.\d+)?)\s*m`)
+	placeRadiusRe       = regexp.MustCompile(`radius:\s*(\d+(?:\.\d+)?)\s*m`)
+)
+
+// normalize unescapes the place string as it may arrive from the client,
+// where the slash in '+/-' is seen escaped once, twice, or not at all.
+func (ps PlaceString) normalize() string {
+	s := placeEscapedSlashRe.ReplaceAllString(string(ps), "/")
+	s = strings.ReplaceAll(s, "±", "+/-")
+	return strings.TrimSpace(s)
+}
+
+func (ps PlaceString) GetRadius() float64 {
+	m := placeRadiusRe.FindStringSubmatch(ps.normalize())
+	if m == nil {
+		return 0
+	}
+	rn, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0
+	}
+	return rn
+}
+
+// AsPlace parses the description of an iOS CLVisit place, eg.
 //
+//	25 Yeadon Ave, 25 Yeadon Ave, Charleston, SC  29407, United States @ <+32.78044829,-79.98285770> +/- 100.00m, region CLCircularRegion (identifier:'<+32.78044828,-79.98285770> radius 141.76', center:<+32.78044828,-79.98285770>, radius:141.76m)
 //
-// func (ps PlaceString) GetRadius() float64 {
-// 	r := strings.Split(string(ps), "radius:")[1]
-// 	// log.Println("r1", r)
-//
-// 	r = strings.Split(r, "m")[0]
-// 	// log.Println("r2", r)
-//
-// 	rn, err := strconv.ParseFloat(r, 64)
-// 	if err != nil {
-// 		return 0
-// 	}
-// 	return rn
-// }
-//
-// func (ps PlaceString) AsPlace() (p Place, err error) {
-// 	// slices will panic if oob
-// 	commas := strings.Split(string(ps), ",")
-// 	p.Identity = commas[0]
-// 	p.Address = strings.Split(string(ps), "@")[0] // TODO: remove 'identity' prefix?
-//
-// 	s1 := strings.Split(string(ps), "<")[1]
-// 	s1 = strings.Split(s1, ">")[0]
-// 	ll := strings.Split(s1, ",")
-// 	lat := strings.TrimPrefix(ll[0], "+")
-// 	lng := strings.TrimPrefix(ll[1], "+")
-//
-// 	p.Lat, err = strconv.ParseFloat(lat, 64)
-// 	if err != nil {
-// 		return
-// 	}
-// 	p.Lng, err = strconv.ParseFloat(lng, 64)
-// 	if err != nil {
-// 		return
-// 	}
-//
-// 	p.Radius = ps.GetRadius()
-//
-// 	// TODO p.Acc, p.Radius
-// 	return
-// }
-//
-// func (ps PlaceString) MustAsPlace() Place {
-// 	p, _ := ps.AsPlace()
-// 	return p
-// }
+// The placemark (identity and address) and region parts are optional;
+// the coordinates are not.
+func (ps PlaceString) AsPlace() (p Place, err error) {
+	s := ps.normalize()
+	if s == "" {
+		err = ErrPlaceEmpty
+		return
+	}
+
+	loc := placeCoordsRe.FindStringSubmatchIndex(s)
+	if loc == nil {
+		err = ErrPlaceNoCoordinates
+		return
+	}
+
+	p.Lat, err = strconv.ParseFloat(s[loc[2]:loc[3]], 64)
+	if err != nil {
+		err = fmt.Errorf("%w: %v", ErrPlaceInvalidCoordinates, err)
+		return
+	}
+	p.Lng, err = strconv.ParseFloat(s[loc[4]:loc[5]], 64)
+	if err != nil {
+		err = fmt.Errorf("%w: %v", ErrPlaceInvalidCoordinates, err)
+		return
+	}
+	if p.Lat > 90 || p.Lat < -90 || p.Lng > 180 || p.Lng < -180 {
+		err = fmt.Errorf("%w: lat=%v lng=%v", ErrPlaceInvalidCoordinates, p.Lat, p.Lng)
+		return
+	}
+
+	// Everything before the coordinates is the placemark, if any.
+	// Its first component is the name of the place, and the rest is its address.
+	// Where the placemark has no name, iOS repeats the street as the name.
+	placemark := strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(s[:loc[0]]), "@"))
+	if placemark != "" {
+		parts := strings.SplitN(placemark, ",", 2)
+		p.Identity = strings.TrimSpace(parts[0])
+		p.Address = p.Identity
+		if len(parts) == 2 {
+			if rest := strings.TrimSpace(parts[1]); rest != "" {
+				p.Address = rest
+			}
+		}
+	}
+
+	if m := placeAccuracyRe.FindStringSubmatch(s[loc[1]:]); m != nil {
+		p.Acc, _ = strconv.ParseFloat(m[1], 64)
+	}
+	p.Radius = ps.GetRadius()
+	return
+}
+
+func (ps PlaceString) MustAsPlace() Place {
+	p, _ := ps.AsPlace()
+	return p
+}
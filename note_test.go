@@ -2,6 +2,7 @@ package catTrackslib
 
 import (
 	"encoding/json"
+	"errors"
 	"testing"
 	"time"
 )
@@ -106,3 +107,99 @@ func TestNotesField_AsNoteStructured(t *testing.T) {
 		})
 	}
 }
+
+func TestPlaceString_AsPlace(t *testing.T) {
+	tests := []struct {
+		name    string
+		place   PlaceString
+		want    Place
+		wantErr error
+	}{
+		{
+			name:  "placemark and region",
+			place: `25 Yeadon Ave, 25 Yeadon Ave, Charleston, SC  29407, United States @ <+32.78044829,-79.98285770> +/- 100.00m, region CLCircularRegion (identifier:'<+32.78044828,-79.98285770> radius 141.76', center:<+32.78044828,-79.98285770>, radius:141.76m)`,
+			want: Place{
+				Identity: "25 Yeadon Ave",
+				Address:  "25 Yeadon Ave, Charleston, SC  29407, United States",
+				Lat:      32.78044829,
+				Lng:      -79.98285770,
+				Acc:      100,
+				Radius:   141.76,
+			},
+		},
+		{
+			name:  "escaped slash",
+			place: `25 Yeadon Ave, 25 Yeadon Ave, Charleston, SC  29407, United States @ <+32.78044829,-79.98285770> +\/- 100.00m, region CLCircularRegion (identifier:'<+32.78044828,-79.98285770> radius 141.76', center:<+32.78044828,-79.98285770>, radius:141.76m)`,
+			want: Place{
+				Identity: "25 Yeadon Ave",
+				Address:  "25 Yeadon Ave, Charleston, SC  29407, United States",
+				Lat:      32.78044829,
+				Lng:      -79.98285770,
+				Acc:      100,
+				Radius:   141.76,
+			},
+		},
+		{
+			name:  "double escaped slash",
+			place: `Hard Rock Cafe, 1 Main St, Saint Louis, MO  63101, United States @ <+38.63369750,-90.26709747> +\\\/- 65.00m, region CLCircularRegion (identifier:'<+38.63369750,-90.26709747> radius 70.71', center:<+38.63369750,-90.26709747>, radius:70.71m)`,
+			want: Place{
+				Identity: "Hard Rock Cafe",
+				Address:  "1 Main St, Saint Louis, MO  63101, United States",
+				Lat:      38.63369750,
+				Lng:      -90.26709747,
+				Acc:      65,
+				Radius:   70.71,
+			},
+		},
+		{
+			name:  "no placemark",
+			place: `<+44.98931121,-93.25544738> +/- 50.00m, region CLCircularRegion (identifier:'<+44.98931121,-93.25544738> radius 141.76', center:<+44.98931121,-93.25544738>, radius:141.76m)`,
+			want: Place{
+				Lat:    44.98931121,
+				Lng:    -93.25544738,
+				Acc:    50,
+				Radius: 141.76,
+			},
+		},
+		{
+			name:  "no region",
+			place: `Home @ <+45.57102830,-111.69024170> +/- 10.00m`,
+			want: Place{
+				Identity: "Home",
+				Address:  "Home",
+				Lat:      45.57102830,
+				Lng:      -111.69024170,
+				Acc:      10,
+			},
+		},
+		{
+			name:    "empty",
+			place:   ``,
+			wantErr: ErrPlaceEmpty,
+		},
+		{
+			name:    "no coordinates",
+			place:   `25 Yeadon Ave, Charleston, SC  29407, United States`,
+			wantErr: ErrPlaceNoCoordinates,
+		},
+		{
+			name:    "out of range coordinates",
+			place:   `Nowhere @ <+132.78044829,-79.98285770> +/- 100.00m`,
+			wantErr: ErrPlaceInvalidCoordinates,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.place.AsPlace()
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("AsPlace() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got != tt.want {
+				t.Errorf("AsPlace() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
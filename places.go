@@ -0,0 +1,395 @@
+package catTrackslib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geo"
+	"github.com/paulmach/orb/geojson"
+	catnames "github.com/rotblauer/cattracks-names"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Significant places are clusters of a cat's visits (both iOS and stay point),
+// like home, work, and the regular coffee shop.
+// They are stored in a bucket nested in the places bucket, keyed by cat name and rank.
+// A cat's places are re-clustered after each batch of its points that stores a visit, iOS or stay point.
+const significantPlacesKey = "significant"
+
+const (
+	placeLabelHome    = "home"
+	placeLabelWork    = "work"
+	placeLabelRegular = "regular"
+)
+
+// SignificantPlaceOptions configures the DBSCAN clustering of visits into significant places.
+type SignificantPlaceOptions struct {
+	// Radius is the DBSCAN epsilon, in meters.
+	Radius float64
+	// MinVisits is the DBSCAN minimum points; places with fewer visits are ignored.
+	MinVisits int
+}
+
+var DefaultSignificantPlaceOptions = SignificantPlaceOptions{
+	Radius:    150,
+	MinVisits: 3,
+}
+
+type SignificantPlace struct {
+	Name         string        `json:"name"`
+	Rank         int           `json:"rank"` // by total dwell time, 0 is most
+	Label        string        `json:"label"`
+	Lat          float64       `json:"lat"`
+	Lng          float64       `json:"lng"`
+	Radius       float64       `json:"radius"`
+	VisitCount   int           `json:"visitCount"`
+	TotalDwell   time.Duration `json:"totalDwell"`
+	ArrivalHours []int         `json:"arrivalHours"` // most common local hours of arrival, most common first
+	FirstVisit   time.Time     `json:"firstVisit"`
+	LastVisit    time.Time     `json:"lastVisit"`
+
+	nightDwell   time.Duration
+	workDwell    time.Duration
+	workdaysSeen map[string]bool
+}
+
+func buildSignificantPlaceKey(name string, rank int) []byte {
+	return []byte(fmt.Sprintf("%s+%04d", name, rank))
+}
+
+// localTime approximates the local time at a longitude by its nominal time zone.
+// It's wrong near zone borders and ignores daylight saving, but it's close enough to tell night from day.
+func localTime(t time.Time, lng float64) time.Time {
+	offset := int(math.Round(lng/15)) * 3600
+	return t.In(time.FixedZone("", offset))
+}
+
+// visitDwellSpan returns the arrival and (best known) departure of a visit.
+// Visits still ongoing are counted until now, but at most for a day.
+func visitDwellSpan(nv NoteVisit) (time.Time, time.Time) {
+	end := nv.DepartureTime
+	if !nv.HasDeparture() {
+		end = time.Now()
+		if end.Sub(nv.ArrivalTime) > 24*time.Hour {
+			end = nv.ArrivalTime.Add(24 * time.Hour)
+		}
+	}
+	return nv.ArrivalTime, end
+}
+
+// dbscanVisits clusters visits within eps meters of each other,
+// returning clusters as slices of indexes into visits. Noise is dropped.
+func dbscanVisits(visits []NoteVisit, eps float64, minPts int) [][]int {
+	pt := func(i int) orb.Point {
+		return orb.Point{visits[i].PlaceParsed.Lng, visits[i].PlaceParsed.Lat}
+	}
+	neighbors := func(i int) []int {
+		out := []int{}
+		for j := range visits {
+			if geo.Distance(pt(i), pt(j)) <= eps {
+				out = append(out, j)
+			}
+		}
+		return out
+	}
+
+	const (
+		unvisited = 0
+		noise     = -1
+	)
+	labels := make([]int, len(visits))
+	clusters := [][]int{}
+
+	for i := range visits {
+		if labels[i] != unvisited {
+			continue
+		}
+		nbrs := neighbors(i)
+		if len(nbrs) < minPts {
+			labels[i] = noise
+			continue
+		}
+		clusterID := len(clusters) + 1
+		labels[i] = clusterID
+		cluster := []int{i}
+		for queue := nbrs; len(queue) > 0; queue = queue[1:] {
+			j := queue[0]
+			if labels[j] == noise {
+				labels[j] = clusterID
+				cluster = append(cluster, j)
+			}
+			if labels[j] != unvisited {
+				continue
+			}
+			labels[j] = clusterID
+			cluster = append(cluster, j)
+			if jn := neighbors(j); len(jn) >= minPts {
+				queue = append(queue, jn...)
+			}
+		}
+		clusters = append(clusters, cluster)
+	}
+	return clusters
+}
+
+// clusterSignificantPlaces groups one cat's visits into significant places and guesses their labels.
+func clusterSignificantPlaces(name string, visits []NoteVisit, opts SignificantPlaceOptions) []*SignificantPlace {
+	places := []*SignificantPlace{}
+	for _, cluster := range dbscanVisits(visits, opts.Radius, opts.MinVisits) {
+		sp := &SignificantPlace{Name: name, workdaysSeen: map[string]bool{}}
+		hours := make([]int, 24)
+		var sumW float64
+
+		for _, i := range cluster {
+			nv := visits[i]
+			arrival, departure := visitDwellSpan(nv)
+			dwell := departure.Sub(arrival)
+
+			// Weight the center by dwell time, so long stays pin it down.
+			w := math.Max(dwell.Minutes(), 1)
+			sumW += w
+			sp.Lat += nv.PlaceParsed.Lat * w
+			sp.Lng += nv.PlaceParsed.Lng * w
+
+			sp.VisitCount++
+			sp.TotalDwell += dwell
+			hours[localTime(arrival, nv.PlaceParsed.Lng).Hour()]++
+			if sp.FirstVisit.IsZero() || arrival.Before(sp.FirstVisit) {
+				sp.FirstVisit = arrival
+			}
+			if arrival.After(sp.LastVisit) {
+				sp.LastVisit = arrival
+			}
+
+			// Tally the dwell falling at night and during working hours, in 15 minute steps.
+			const step = 15 * time.Minute
+			for t := arrival; t.Before(departure); t = t.Add(step) {
+				lt := localTime(t, nv.PlaceParsed.Lng)
+				h := lt.Hour()
+				if h >= 22 || h < 6 {
+					sp.nightDwell += step
+				}
+				if wd := lt.Weekday(); wd != time.Saturday && wd != time.Sunday && h >= 9 && h < 17 {
+					sp.workDwell += step
+					sp.workdaysSeen[lt.Format("2006-01-02")] = true
+				}
+			}
+		}
+		sp.Lat /= sumW
+		sp.Lng /= sumW
+		for _, i := range cluster {
+			c := orb.Point{sp.Lng, sp.Lat}
+			d := geo.Distance(c, orb.Point{visits[i].PlaceParsed.Lng, visits[i].PlaceParsed.Lat})
+			sp.Radius = math.Max(sp.Radius, toFixed(d, 2))
+		}
+
+		for h, n := range hours {
+			if n > 0 {
+				sp.ArrivalHours = append(sp.ArrivalHours, h)
+			}
+		}
+		sort.SliceStable(sp.ArrivalHours, func(i, j int) bool {
+			return hours[sp.ArrivalHours[i]] > hours[sp.ArrivalHours[j]]
+		})
+		if len(sp.ArrivalHours) > 3 {
+			sp.ArrivalHours = sp.ArrivalHours[:3]
+		}
+		places = append(places, sp)
+	}
+
+	sort.Slice(places, func(i, j int) bool {
+		return places[i].TotalDwell > places[j].TotalDwell
+	})
+	for i, sp := range places {
+		sp.Rank = i
+	}
+	labelSignificantPlaces(places)
+	return places
+}
+
+// labelSignificantPlaces guesses which place is home (where the nights are spent)
+// and which is work (where weekdays are spent, on several different days).
+func labelSignificantPlaces(places []*SignificantPlace) {
+	var home, work *SignificantPlace
+	for _, sp := range places {
+		if sp.nightDwell >= 6*time.Hour && (home == nil || sp.nightDwell > home.nightDwell) {
+			home = sp
+		}
+	}
+	for _, sp := range places {
+		if sp == home || len(sp.workdaysSeen) < 3 {
+			continue
+		}
+		if work == nil || sp.workDwell > work.workDwell {
+			work = sp
+		}
+	}
+	for _, sp := range places {
+		switch sp {
+		case home:
+			sp.Label = placeLabelHome
+		case work:
+			sp.Label = placeLabelWork
+		default:
+			sp.Label = placeLabelRegular
+		}
+	}
+}
+
+// ClusterSignificantPlaces finds each cat's significant places from all their visits,
+// replacing any previously stored. If gzPath is given, the track archive there is first
+// run through stay-point detection so that cats without iOS visits are included.
+// It's for backfills; as points arrive, updateSignificantPlaces keeps cats' places up to date.
+func ClusterSignificantPlaces(gzPath string) error {
+	if gzPath != "" {
+		if _, err := BackfillStayPoints(gzPath); err != nil {
+			return err
+		}
+	}
+
+	visitsByCat := map[string][]NoteVisit{}
+	if err := GetDB("master").View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(placesKey)).ForEach(func(k, v []byte) error {
+			if v == nil {
+				return nil // nested bucket
+			}
+			nv := NoteVisit{}
+			if err := json.Unmarshal(v, &nv); err != nil {
+				log.Println("error unmarshalling visit for clustering:", err)
+				return nil
+			}
+			visitsByCat[nv.Name] = append(visitsByCat[nv.Name], nv)
+			return nil
+		})
+	}); err != nil {
+		return err
+	}
+	return putSignificantPlaces(visitsByCat)
+}
+
+// significantPlacesStale are the cats whose visits have changed since their places were clustered.
+var significantPlacesStale = map[string]bool{}
+var significantPlacesStaleLock sync.Mutex
+
+func markSignificantPlacesStale(name string) {
+	significantPlacesStaleLock.Lock()
+	significantPlacesStale[name] = true
+	significantPlacesStaleLock.Unlock()
+}
+
+// updateSignificantPlaces re-clusters the significant places of cats whose visits have changed.
+// It's run after each batch of points is stored, and reads only those cats' visits.
+func updateSignificantPlaces() error {
+	significantPlacesStaleLock.Lock()
+	stale := significantPlacesStale
+	significantPlacesStale = map[string]bool{}
+	significantPlacesStaleLock.Unlock()
+	if len(stale) == 0 {
+		return nil
+	}
+
+	visitsByCat := map[string][]NoteVisit{}
+	if err := GetDB("master").View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(placesKey)).Cursor()
+		for name := range stale {
+			// Visits are keyed by cat name and arrival time.
+			prefix := []byte(name + "+")
+			for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+				nv := NoteVisit{}
+				if v == nil || json.Unmarshal(v, &nv) != nil || nv.Name != name {
+					continue
+				}
+				visitsByCat[name] = append(visitsByCat[name], nv)
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	return putSignificantPlaces(visitsByCat)
+}
+
+// putSignificantPlaces clusters each cat's visits, replacing the cat's stored places.
+func putSignificantPlaces(visitsByCat map[string][]NoteVisit) error {
+	return GetDB("master").Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket([]byte(placesKey)).CreateBucketIfNotExists([]byte(significantPlacesKey))
+		if err != nil {
+			return err
+		}
+		for name, visits := range visitsByCat {
+			places := clusterSignificantPlaces(name, visits, significantPlaceOptions)
+
+			// Replace the cat's places wholesale; ranks may have shifted.
+			prefix := []byte(name + "+")
+			c := b.Cursor()
+			for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Seek(prefix) {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+			for _, sp := range places {
+				v, err := json.Marshal(sp)
+				if err != nil {
+					return err
+				}
+				if err := b.Put(buildSignificantPlaceKey(name, sp.Rank), v); err != nil {
+					return err
+				}
+			}
+			log.Println("Clustered", len(visits), "visits into", len(places), "significant places for", name)
+		}
+		return nil
+	})
+}
+
+// SignificantPlaceToFeature converts a significant place to a GeoJSON point feature at its center.
+func SignificantPlaceToFeature(sp SignificantPlace) *geojson.Feature {
+	p := geojson.NewFeature(orb.Point{sp.Lng, sp.Lat})
+
+	props := make(map[string]interface{})
+	if alias := catnames.AliasOrName(sp.Name); alias != sp.Name {
+		props["Alias"] = alias
+	}
+	props["Name"] = sp.Name
+	props["Rank"] = sp.Rank
+	props["Label"] = sp.Label
+	props["Radius"] = sp.Radius
+	props["VisitCount"] = sp.VisitCount
+	props["TotalDwell"] = toFixed(sp.TotalDwell.Seconds(), 0)
+	props["ArrivalHours"] = sp.ArrivalHours
+	props["FirstVisit"] = sp.FirstVisit
+	props["LastVisit"] = sp.LastVisit
+
+	p.Properties = props
+	return p
+}
+
+// getSignificantPlaces returns the stored significant places, optionally for one cat (by name or alias).
+func getSignificantPlaces(cat string) ([]*geojson.Feature, error) {
+	features := []*geojson.Feature{}
+	err := GetDB("master").View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(placesKey)).Bucket([]byte(significantPlacesKey))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			sp := SignificantPlace{}
+			if err := json.Unmarshal(v, &sp); err != nil {
+				return err
+			}
+			if cat != "" && cat != sp.Name && cat != catnames.AliasOrSanitizedName(sp.Name) {
+				return nil
+			}
+			features = append(features, SignificantPlaceToFeature(sp))
+			return nil
+		})
+	})
+	return features, err
+}
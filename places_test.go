@@ -0,0 +1,103 @@
+package catTrackslib
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+)
+
+func TestClusterSignificantPlaces(t *testing.T) {
+	// Minneapolis, UTC-6 by longitude.
+	home := Place{Lat: 44.98931, Lng: -93.25544}
+	work := Place{Lat: 44.97740, Lng: -93.26500}
+	cafe := Place{Lat: 44.94800, Lng: -93.29400}
+	nudge := func(p Place, i int) Place {
+		p.Lat += float64(i%3) * 0.0002
+		return p
+	}
+	local := time.FixedZone("", -6*3600)
+
+	visits := []NoteVisit{}
+	// Monday 2024-03-04 through Friday.
+	for day := 4; day <= 8; day++ {
+		visits = append(visits,
+			NoteVisit{ArrivalTime: time.Date(2024, 3, day, 8, 45, 0, 0, local), DepartureTime: time.Date(2024, 3, day, 17, 10, 0, 0, local), PlaceParsed: nudge(work, day)},
+			NoteVisit{ArrivalTime: time.Date(2024, 3, day, 18, 0, 0, 0, local), DepartureTime: time.Date(2024, 3, day+1, 8, 15, 0, 0, local), PlaceParsed: nudge(home, day)},
+		)
+	}
+	// Saturday coffee, a couple weekends running.
+	for _, day := range []int{9, 16, 23} {
+		visits = append(visits, NoteVisit{ArrivalTime: time.Date(2024, 3, day, 10, 0, 0, 0, local), DepartureTime: time.Date(2024, 3, day, 11, 0, 0, 0, local), PlaceParsed: nudge(cafe, day)})
+	}
+	// A one-off.
+	visits = append(visits, NoteVisit{ArrivalTime: time.Date(2024, 3, 10, 12, 0, 0, 0, local), DepartureTime: time.Date(2024, 3, 10, 13, 0, 0, 0, local), PlaceParsed: Place{Lat: 45.5, Lng: -93.0}})
+
+	places := clusterSignificantPlaces("rye", visits, DefaultSignificantPlaceOptions)
+	if len(places) != 3 {
+		t.Fatalf("got %d places, want 3", len(places))
+	}
+
+	want := map[string]struct {
+		place  Place
+		visits int
+		hour   int
+	}{
+		placeLabelHome:    {home, 5, 18},
+		placeLabelWork:    {work, 5, 8},
+		placeLabelRegular: {cafe, 3, 10},
+	}
+	for _, sp := range places {
+		w, ok := want[sp.Label]
+		if !ok {
+			t.Fatalf("unexpected label %q", sp.Label)
+		}
+		if sp.VisitCount != w.visits {
+			t.Errorf("%s: got %d visits, want %d", sp.Label, sp.VisitCount, w.visits)
+		}
+		if sp.Lat-w.place.Lat > 0.001 || sp.Lng-w.place.Lng > 0.001 {
+			t.Errorf("%s: got center %v,%v, want %v,%v", sp.Label, sp.Lat, sp.Lng, w.place.Lat, w.place.Lng)
+		}
+		if len(sp.ArrivalHours) == 0 || sp.ArrivalHours[0] != w.hour {
+			t.Errorf("%s: got arrival hours %v, want %d first", sp.Label, sp.ArrivalHours, w.hour)
+		}
+	}
+	if places[0].Label != placeLabelHome {
+		t.Errorf("got rank 0 %q, want home", places[0].Label)
+	}
+}
+
+func TestSignificantPlacesOnIngest(t *testing.T) {
+	SetDBPath("master", filepath.Join(t.TempDir(), "m.db"))
+	if err := InitBoltDB(); err != nil {
+		t.Fatal(err)
+	}
+	defer GetDB("master").Close()
+	// Leave no live plausibility state behind for other tests' cats.
+	defer func(c map[string]*plausibilityChecker) { plausibilityCheckers = c }(plausibilityCheckers)
+	plausibilityCheckers = map[string]*plausibilityChecker{}
+
+	// Three evenings at home, reported by iOS, then a point stored as it arrives.
+	for day := 1; day <= 3; day++ {
+		arrival := time.Date(2024, 3, day, 18, 0, 0, 0, time.UTC)
+		storeVisit(NoteVisit{Name: "rye", ArrivalTime: arrival, DepartureTime: arrival.Add(14 * time.Hour),
+			PlaceParsed: Place{Lat: 44.98931, Lng: -93.25544}})
+	}
+	storeVisit(NoteVisit{Name: "ia", ArrivalTime: time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC), PlaceParsed: Place{Lat: 50, Lng: 10}})
+	f := geojson.NewFeature(orb.Point{-93.2, 44.9})
+	f.Properties["Name"], f.Properties["UUID"], f.Properties["Accuracy"] = "rye", "rye-uuid", 5.0
+	f.Properties["Time"] = time.Now().UTC().Format(time.RFC3339)
+	if _, err := storePoints([]*geojson.Feature{f}); err != nil {
+		t.Fatal(err)
+	}
+
+	places, err := getSignificantPlaces("rye")
+	if err != nil || len(places) != 1 || places[0].Properties["VisitCount"] != 3 {
+		t.Fatalf("got %v (%v), want rye's home clustered once the batch was stored", places, err)
+	}
+	if places, _ := getSignificantPlaces("ia"); len(places) != 0 {
+		t.Errorf("got %d places, want none from one visit", len(places))
+	}
+}
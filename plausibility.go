@@ -0,0 +1,286 @@
+package catTrackslib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geo"
+	"github.com/paulmach/orb/geojson"
+	catnames "github.com/rotblauer/cattracks-names"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Plausibility rules catch points that are valid but can't be right:
+// cell tower fixes from across the country, fixes with km-wide accuracy, clocks gone wrong.
+// Points failing a rule are rejected or quarantined, with a reason code.
+// Quarantined points are kept in the quarantine bucket, keyed by time of quarantine,
+// where they can be reviewed, and restored (stored as if they'd passed) or discarded.
+
+// Reason codes for implausible points.
+const (
+	implausibleSpeed    = "implied_speed"
+	implausibleAccuracy = "accuracy"
+	implausibleFuture   = "future_time"
+	implausibleAncient  = "ancient_time"
+)
+
+type PlausibilityAction string
+
+const (
+	PlausibilityActionOff        PlausibilityAction = "off"
+	PlausibilityActionReject     PlausibilityAction = "reject"
+	PlausibilityActionQuarantine PlausibilityAction = "quarantine"
+)
+
+var ErrQuarantineNotFound = errors.New("quarantined point not found")
+
+// PlausibilityOptions configures the plausibility rules. Zero values disable a rule.
+type PlausibilityOptions struct {
+	Action PlausibilityAction
+	// MaxSpeed is the fastest (m/s) a cat may have gone since its last plausible point,
+	// after allowing for the accuracy of both.
+	MaxSpeed float64
+	// MaxAccuracy is the worst accuracy (m) a point may have.
+	MaxAccuracy float64
+	// MaxFuture is how far ahead of the server's clock a point may be.
+	MaxFuture time.Duration
+	// MaxAge is how far behind the server's clock a point may be.
+	MaxAge time.Duration
+	// ReanchorAfter accepts a point failing the speed rule if it's the latest of this many
+	// in a row that are plausible with respect to each other; the cat really did move
+	// (or the previous point was the bad one).
+	ReanchorAfter int
+}
+
+var DefaultPlausibilityOptions = PlausibilityOptions{
+	Action:        PlausibilityActionQuarantine,
+	MaxSpeed:      350, // faster than an airliner
+	MaxAccuracy:   1000,
+	MaxFuture:     time.Hour,
+	MaxAge:        2 * 365 * 24 * time.Hour,
+	ReanchorAfter: 3,
+}
+
+type QuarantinedPoint struct {
+	Key           string           `json:"key"`
+	Reason        string           `json:"reason"`
+	Detail        string           `json:"detail"`
+	QuarantinedAt time.Time        `json:"quarantinedAt"`
+	Feature       *geojson.Feature `json:"feature"`
+}
+
+type plausibilityPoint struct {
+	pt   orb.Point
+	acc  float64
+	time time.Time
+}
+
+// plausibilityChecker remembers a cat's last plausible point, to check the next against.
+type plausibilityChecker struct {
+	opts PlausibilityOptions
+	last *plausibilityPoint
+
+	// candidate is the last point failing the speed rule, and run how many
+	// such points in a row have been plausible with respect to each other.
+	candidate *plausibilityPoint
+	run       int
+}
+
+func newPlausibilityChecker(opts PlausibilityOptions) *plausibilityChecker {
+	return &plausibilityChecker{opts: opts}
+}
+
+// impliedSpeed returns the speed (m/s) needed to get from a to b, given the benefit of the doubt of their accuracies.
+func impliedSpeed(a, b plausibilityPoint) float64 {
+	d := math.Max(0, geo.Distance(a.pt, b.pt)-a.acc-b.acc)
+	dt := math.Max(math.Abs(b.time.Sub(a.time).Seconds()), 1)
+	return d / dt
+}
+
+// check returns a reason code and detail if the point is implausible, or "" if it's fine.
+func (c *plausibilityChecker) check(f *geojson.Feature, now time.Time) (reason, detail string) {
+	p := plausibilityPoint{pt: f.Geometry.(orb.Point), time: mustGetTime(f)}
+	p.acc, _ = featureFloat(f, "Accuracy")
+
+	if c.opts.MaxAccuracy > 0 && p.acc > c.opts.MaxAccuracy {
+		return implausibleAccuracy, fmt.Sprintf("accuracy %.0fm exceeds %.0fm", p.acc, c.opts.MaxAccuracy)
+	}
+	if c.opts.MaxFuture > 0 && p.time.After(now.Add(c.opts.MaxFuture)) {
+		return implausibleFuture, fmt.Sprintf("time %s is %s in the future", p.time.Format(time.RFC3339), p.time.Sub(now).Round(time.Second))
+	}
+	if c.opts.MaxAge > 0 && p.time.Before(now.Add(-c.opts.MaxAge)) {
+		return implausibleAncient, fmt.Sprintf("time %s is older than %s", p.time.Format(time.RFC3339), c.opts.MaxAge)
+	}
+
+	if c.opts.MaxSpeed > 0 && c.last != nil {
+		if v := impliedSpeed(*c.last, p); v > c.opts.MaxSpeed {
+			if c.candidate != nil && impliedSpeed(*c.candidate, p) <= c.opts.MaxSpeed {
+				c.run++
+			} else {
+				c.run = 1
+			}
+			c.candidate = &p
+			if c.opts.ReanchorAfter <= 0 || c.run < c.opts.ReanchorAfter {
+				return implausibleSpeed, fmt.Sprintf("implied speed %.0fm/s from last point exceeds %.0fm/s", v, c.opts.MaxSpeed)
+			}
+			log.Println("Plausibility reanchored", f.Properties["Name"], "after", c.run, "consistent points")
+		}
+	}
+	c.last = &p
+	c.candidate, c.run = nil, 0
+	return "", ""
+}
+
+// plausibilityCheckers holds the live checkers, by cat name, for points arriving through storePoints.
+var plausibilityCheckers = map[string]*plausibilityChecker{}
+var plausibilityCheckersLock sync.Mutex
+
+// checkPlausibility returns the features passing the plausibility rules,
+// rejecting or quarantining the rest. The features must be sorted by time.
+// Features restored from quarantine don't come through here; see storePointsOptions.
+func checkPlausibility(features []*geojson.Feature) []*geojson.Feature {
+	if plausibilityOptions.Action == PlausibilityActionOff || plausibilityOptions.Action == "" {
+		return features
+	}
+	plausibilityCheckersLock.Lock()
+	defer plausibilityCheckersLock.Unlock()
+
+	now := time.Now()
+	out := features[:0]
+	for _, f := range features {
+		name, _ := f.Properties["Name"].(string)
+		c, ok := plausibilityCheckers[name]
+		if !ok {
+			c = newPlausibilityChecker(plausibilityOptions)
+			plausibilityCheckers[name] = c
+		}
+		reason, detail := c.check(f, now)
+		if reason == "" {
+			out = append(out, f)
+			continue
+		}
+		if plausibilityOptions.Action == PlausibilityActionReject {
+			log.Println("Rejected implausible point", name, reason, detail)
+			continue
+		}
+		if err := quarantinePoint(f, reason, detail); err != nil {
+			log.Println("quarantine point error:", err)
+			continue
+		}
+		log.Println("Quarantined implausible point", name, reason, detail)
+	}
+	// Let go of the features dropped from the end.
+	for j := len(out); j < len(features); j++ {
+		features[j] = nil
+	}
+	return out
+}
+
+func quarantinePoint(f *geojson.Feature, reason, detail string) error {
+	now := time.Now()
+	q := QuarantinedPoint{
+		Key:           fmt.Sprintf("%d-%s", now.UnixNano(), randomHex(4)),
+		Reason:        reason,
+		Detail:        detail,
+		QuarantinedAt: now,
+		Feature:       f,
+	}
+	v, err := json.Marshal(q)
+	if err != nil {
+		return err
+	}
+	return GetDB("master").Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(quarantineKey)).Put([]byte(q.Key), v)
+	})
+}
+
+// getQuarantinedPoints returns the quarantined points, oldest first,
+// optionally only a cat's (by name or alias) or those for a reason.
+func getQuarantinedPoints(cat, reason string) ([]QuarantinedPoint, error) {
+	points := []QuarantinedPoint{}
+	err := GetDB("master").View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(quarantineKey)).ForEach(func(k, v []byte) error {
+			q := QuarantinedPoint{}
+			if err := json.Unmarshal(v, &q); err != nil {
+				log.Println("error unmarshalling quarantined point:", err)
+				return nil
+			}
+			if reason != "" && q.Reason != reason {
+				return nil
+			}
+			if cat != "" {
+				name, _ := q.Feature.Properties["Name"].(string)
+				if cat != name && cat != catnames.AliasOrSanitizedName(name) {
+					return nil
+				}
+			}
+			points = append(points, q)
+			return nil
+		})
+	})
+	return points, err
+}
+
+// getQuarantinedPoint returns the quarantined point.
+func getQuarantinedPoint(key string) (QuarantinedPoint, error) {
+	q := QuarantinedPoint{}
+	err := GetDB("master").View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(quarantineKey)).Get([]byte(key))
+		if v == nil {
+			return ErrQuarantineNotFound
+		}
+		return json.Unmarshal(v, &q)
+	})
+	return q, err
+}
+
+// deleteQuarantinedPoint removes the point from the quarantine.
+func deleteQuarantinedPoint(key string) error {
+	return GetDB("master").Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(quarantineKey))
+		if b.Get([]byte(key)) == nil {
+			return ErrQuarantineNotFound
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+// RestoreQuarantinedPoint stores a quarantined point as if it had passed the plausibility rules.
+// It's stored as it's likely come, late and out of order: with its visit and catsnap, but without
+// disturbing the live detectors, or the cat's last known, which have moved on.
+// The stored point is marked with the QuarantineRestored property, holding the reason it was quarantined;
+// it's only a label, and a point populated with it is checked like any other.
+// The point leaves the quarantine only once it's stored, so a restore that fails can be tried again, or discarded.
+func RestoreQuarantinedPoint(key string) (*geojson.Feature, error) {
+	q, err := getQuarantinedPoint(key)
+	if err != nil {
+		return nil, err
+	}
+	q.Feature.Properties["QuarantineRestored"] = q.Reason
+	if err := validatePoint(q.Feature); err != nil {
+		return nil, err
+	}
+	stored, err := storePointsWith([]*geojson.Feature{q.Feature}, storePointsOptions{Restored: true})
+	if err != nil {
+		return nil, err
+	}
+	if len(stored) == 0 {
+		return nil, fmt.Errorf("restored point %s was not stored", key)
+	}
+	if err := deleteQuarantinedPoint(key); err != nil {
+		// It's stored; left in the quarantine, it'd only be stored again.
+		log.Println("error removing restored point from quarantine:", key, err)
+	}
+	return stored[0], nil
+}
+
+// DiscardQuarantinedPoint deletes a quarantined point for good.
+func DiscardQuarantinedPoint(key string) error {
+	return deleteQuarantinedPoint(key)
+}
@@ -0,0 +1,169 @@
+package catTrackslib
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+)
+
+func TestPlausibilityChecker(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	home := orb.Point{-93.25544, 44.98931}
+	faraway := orb.Point{-122.4194, 37.7749} // ~2500km
+
+	point := func(pt orb.Point, at time.Time, acc float64) *geojson.Feature {
+		f := geojson.NewFeature(pt)
+		f.Properties["Name"] = "rye"
+		f.Properties["Time"] = at.Format(time.RFC3339)
+		f.Properties["Accuracy"] = acc
+		return f
+	}
+
+	cases := []struct {
+		name string
+		f    *geojson.Feature
+		want string
+	}{
+		{"first point", point(home, now, 10), ""},
+		{"walking on", point(orb.Point{home.Lon(), home.Lat() + 0.001}, now.Add(time.Minute), 10), ""},
+		{"poor accuracy", point(home, now.Add(2*time.Minute), 5000), implausibleAccuracy},
+		{"future clock", point(home, now.Add(2*time.Hour), 10), implausibleFuture},
+		{"ancient clock", point(home, now.AddDate(-5, 0, 0), 10), implausibleAncient},
+		{"teleport", point(faraway, now.Add(3*time.Minute), 10), implausibleSpeed},
+		{"back home", point(home, now.Add(4*time.Minute), 10), ""},
+		{"teleport again", point(faraway, now.Add(5*time.Minute), 10), implausibleSpeed},
+		{"still there", point(faraway, now.Add(6*time.Minute), 10), implausibleSpeed},
+		{"still there, reanchored", point(faraway, now.Add(7*time.Minute), 10), ""},
+		{"stays there", point(faraway, now.Add(8*time.Minute), 10), ""},
+	}
+
+	c := newPlausibilityChecker(DefaultPlausibilityOptions)
+	for _, tc := range cases {
+		if got, detail := c.check(tc.f, now); got != tc.want {
+			t.Errorf("%s: got reason %q (%s), want %q", tc.name, got, detail, tc.want)
+		}
+	}
+}
+
+func TestQuarantineRestore(t *testing.T) {
+	SetDBPath("master", filepath.Join(t.TempDir(), "m.db"))
+	if err := InitBoltDB(); err != nil {
+		t.Fatal(err)
+	}
+	defer GetDB("master").Close()
+	t.Setenv("COTOKEN", "legacy-secret")
+
+	point := func(uuid string) *geojson.Feature {
+		f := geojson.NewFeature(orb.Point{-93.25, 44.98})
+		f.Properties["Name"] = "rye"
+		f.Properties["Time"] = time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+		f.Properties["Accuracy"] = 5000.0
+		if uuid != "" {
+			f.Properties["UUID"] = uuid
+		}
+		return f
+	}
+	// A point, and one that won't validate.
+	for _, f := range []*geojson.Feature{point("rye-uuid"), point("")} {
+		if err := quarantinePoint(f, implausibleAccuracy, "accuracy 5000m exceeds 1000m"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	quarantined, _ := getQuarantinedPoints("", "")
+	if len(quarantined) != 2 {
+		t.Fatalf("got %d quarantined, want 2", len(quarantined))
+	}
+
+	srv := httptest.NewServer(NewRouter(&RouterOpts{DisableWebsocket: true}))
+	defer srv.Close()
+	do := func(method, path string) int {
+		req, _ := http.NewRequest(method, srv.URL+path, nil)
+		req.Header.Set("AuthorizationOfCats", "legacy-secret")
+		res, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	stillQuarantined := func(key string) bool {
+		_, err := getQuarantinedPoint(key)
+		return err == nil
+	}
+
+	if code := do("POST", "/quarantine/"+quarantined[0].Key+"/restore"); code != http.StatusOK || stillQuarantined(quarantined[0].Key) {
+		t.Errorf("got %d, want the point restored and out of the quarantine", code)
+	}
+	// A failed restore leaves the point where it was, to be fixed or discarded.
+	if code := do("POST", "/quarantine/"+quarantined[1].Key+"/restore"); code != http.StatusUnprocessableEntity || !stillQuarantined(quarantined[1].Key) {
+		t.Errorf("got %d, want the failed restore kept in the quarantine", code)
+	}
+	if code := do("DELETE", "/quarantine/"+quarantined[1].Key); code != http.StatusNoContent || stillQuarantined(quarantined[1].Key) {
+		t.Errorf("got %d discarding", code)
+	}
+	if code := do("POST", "/quarantine/"+quarantined[1].Key+"/restore"); code != http.StatusNotFound {
+		t.Errorf("got %d, want the discarded point gone", code)
+	}
+}
+
+func TestQuarantineRestoreIsOutOfBand(t *testing.T) {
+	SetDBPath("master", filepath.Join(t.TempDir(), "m.db"))
+	if err := InitBoltDB(); err != nil {
+		t.Fatal(err)
+	}
+	defer GetDB("master").Close()
+	defer func(c map[string]*plausibilityChecker) { plausibilityCheckers = c }(plausibilityCheckers)
+	plausibilityCheckers = map[string]*plausibilityChecker{}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	point := func(pt orb.Point, at time.Time) *geojson.Feature {
+		f := geojson.NewFeature(pt)
+		f.Properties["Name"] = "rye"
+		f.Properties["UUID"] = "rye-uuid"
+		f.Properties["Time"] = at.Format(time.RFC3339)
+		f.Properties["Accuracy"] = 5.0
+		return f
+	}
+	home := orb.Point{-93.25544, 44.98931}
+	if _, err := storePoints([]*geojson.Feature{point(home, now.Add(-time.Minute))}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The restored label is only a label; a populated teleport wearing it is still quarantined.
+	teleport := point(orb.Point{-122.4194, 37.7749}, now)
+	teleport.Properties["QuarantineRestored"] = implausibleSpeed
+	if stored, _ := storePoints([]*geojson.Feature{teleport}); len(stored) != 0 {
+		t.Errorf("got the labeled teleport stored, want it quarantined")
+	}
+	quarantined, _ := getQuarantinedPoints("", "")
+	if len(quarantined) != 1 {
+		t.Fatalf("got %d quarantined, want the teleport", len(quarantined))
+	}
+
+	// An old point restored from the quarantine doesn't become the last known.
+	if err := quarantinePoint(point(orb.Point{-93.1, 44.9}, now.Add(-48*time.Hour)), implausibleAccuracy, "reviewed"); err != nil {
+		t.Fatal(err)
+	}
+	quarantined, _ = getQuarantinedPoints("", "")
+	for _, q := range quarantined {
+		if q.Reason == implausibleAccuracy {
+			if _, err := RestoreQuarantinedPoint(q.Key); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	b, _ := getLastKnownData()
+	lk := LastKnownGeoJSON{}
+	if err := json.Unmarshal(b, &lk); err != nil {
+		t.Fatal(err)
+	}
+	if got := lk["rye"]; got == nil || got.Point() != home {
+		t.Errorf("got last known %v, want the fresh point at home", got)
+	}
+}
@@ -0,0 +1,326 @@
+package catTrackslib
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	catnames "github.com/rotblauer/cattracks-names"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Presence is whether a cat is reporting: online when its points are arriving, quiet when
+// they've stopped for a bit, and stale when they've stopped for a while.
+// Transitions are pushed over the live feeds as presence events, and kept in the presence events bucket.
+// A cat coming back after a long absence is "back_online" rather than just "online".
+
+const (
+	presenceOnline     = "online"
+	presenceQuiet      = "quiet"
+	presenceStale      = "stale"
+	presenceBackOnline = "back_online" // an event, not a state; the cat is online
+)
+
+type PresenceOptions struct {
+	// QuietAfter is how long after its last push a cat is quiet.
+	QuietAfter time.Duration
+	// StaleAfter is how long after its last push a cat is stale.
+	StaleAfter time.Duration
+	// BackOnlineAfter is how long a cat must have been gone for it to be back online.
+	BackOnlineAfter time.Duration
+	// CheckInterval is how often cats are checked for going quiet or stale.
+	CheckInterval time.Duration
+}
+
+var DefaultPresenceOptions = PresenceOptions{
+	QuietAfter:      15 * time.Minute,
+	StaleAfter:      2 * time.Hour,
+	BackOnlineAfter: 12 * time.Hour,
+	CheckInterval:   time.Minute,
+}
+
+// CatPresence is a cat's current presence, as kept in the presence bucket.
+type CatPresence struct {
+	Name     string    `json:"name"`
+	UUID     string    `json:"uuid"`
+	State    string    `json:"state"`
+	Since    time.Time `json:"since"`         // when it got to this state
+	LastSeen time.Time `json:"lastSeen"`      // when its last push arrived
+	Lng      float64   `json:"lng,omitempty"` // where it was last, unless that's hidden
+	Lat      float64   `json:"lat,omitempty"`
+}
+
+type PresenceEvent struct {
+	Name     string    `json:"name"`
+	UUID     string    `json:"uuid"`
+	Type     string    `json:"type"`
+	State    string    `json:"state"`
+	Time     time.Time `json:"time"`
+	LastSeen time.Time `json:"lastSeen"`
+	Lng      float64   `json:"lng"`
+	Lat      float64   `json:"lat"`
+}
+
+type presenceEventsQuery struct {
+	Cat   string
+	Start time.Time
+	End   time.Time
+}
+
+// arrive records a push arriving at now, with the last point of it,
+// and returns the event type if the cat's presence changed.
+func (p *CatPresence) arrive(now time.Time, f *geojson.Feature, opts PresenceOptions) string {
+	prev, lastSeen := p.State, p.LastSeen
+	p.LastSeen = now
+	if pt, ok := f.Geometry.(orb.Point); ok {
+		p.Lng, p.Lat = pt.Lon(), pt.Lat()
+	}
+	if uuid, ok := f.Properties["UUID"].(string); ok && uuid != "" {
+		p.UUID = uuid
+	}
+	if prev == presenceOnline {
+		return ""
+	}
+	p.State, p.Since = presenceOnline, now
+	if prev == presenceStale && opts.BackOnlineAfter > 0 && now.Sub(lastSeen) >= opts.BackOnlineAfter {
+		return presenceBackOnline
+	}
+	return presenceOnline
+}
+
+// check returns the event type if the cat's presence changed by now, with no pushes arriving.
+func (p *CatPresence) check(now time.Time, opts PresenceOptions) string {
+	silence := now.Sub(p.LastSeen)
+	next := p.State
+	switch {
+	case opts.StaleAfter > 0 && silence >= opts.StaleAfter:
+		next = presenceStale
+	case opts.QuietAfter > 0 && silence >= opts.QuietAfter && p.State == presenceOnline:
+		next = presenceQuiet
+	}
+	if next == p.State {
+		return ""
+	}
+	p.State, p.Since = next, now
+	return next
+}
+
+func (p *CatPresence) event(typ string, now time.Time) PresenceEvent {
+	return PresenceEvent{
+		Name:     p.Name,
+		UUID:     p.UUID,
+		Type:     typ,
+		State:    p.State,
+		Time:     now,
+		LastSeen: p.LastSeen,
+		Lng:      p.Lng,
+		Lat:      p.Lat,
+	}
+}
+
+func buildPresenceEventKey(ev PresenceEvent) []byte {
+	return append(i64tob(ev.Time.UnixNano()), []byte(ev.Name)...)
+}
+
+// presenceLock keeps pushes arriving and the monitor from racing on a cat's presence.
+var presenceLock sync.Mutex
+
+// updatePresence updates the named cats' presences with fn, which is given each cat's presence
+// and its feature (if any), and returns the event type if the presence changed.
+// Transitions are stored and broadcast.
+func updatePresence(fn func(p *CatPresence, f *geojson.Feature) string, names []string, features map[string]*geojson.Feature) {
+	presenceLock.Lock()
+	defer presenceLock.Unlock()
+
+	now := time.Now()
+	events := []PresenceEvent{}
+	if err := GetDB("master").Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(presenceKey))
+		eb := tx.Bucket([]byte(presenceEventsKey))
+		for _, name := range names {
+			p := &CatPresence{Name: name}
+			if v := b.Get([]byte(name)); v != nil {
+				if err := json.Unmarshal(v, p); err != nil {
+					log.Println("error unmarshalling presence:", err)
+				}
+			}
+			typ := fn(p, features[name])
+			v, err := json.Marshal(p)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(name), v); err != nil {
+				return err
+			}
+			if typ == "" {
+				continue
+			}
+			ev := p.event(typ, now)
+			if v, err = json.Marshal(ev); err != nil {
+				return err
+			}
+			if err := eb.Put(buildPresenceEventKey(ev), v); err != nil {
+				return err
+			}
+			events = append(events, ev)
+		}
+		return nil
+	}); err != nil {
+		log.Println("update presence error:", err)
+		return
+	}
+
+	if len(events) == 0 {
+		return
+	}
+	evFeatures := make([]*geojson.Feature, 0, len(events))
+	for _, ev := range events {
+		log.Println("Presence", ev.Name, ev.Type)
+		evFeatures = append(evFeatures, PresenceEventToFeature(ev))
+	}
+	broadcastFeatures(websocketActionPresence, evFeatures)
+}
+
+// arrivePresence marks the cats the stored features are from as online.
+func arrivePresence(stored []*geojson.Feature) {
+	last := map[string]*geojson.Feature{}
+	names := []string{}
+	for _, f := range stored {
+		name, _ := f.Properties["Name"].(string)
+		if _, ok := last[name]; !ok {
+			names = append(names, name)
+		}
+		last[name] = f
+	}
+	if len(names) == 0 {
+		return
+	}
+	now := time.Now()
+	updatePresence(func(p *CatPresence, f *geojson.Feature) string {
+		return p.arrive(now, f, presenceOptions)
+	}, names, last)
+}
+
+// checkPresence moves cats that have stopped pushing to quiet or stale.
+func checkPresence() {
+	presences, err := getPresences()
+	if err != nil {
+		log.Println("check presence error:", err)
+		return
+	}
+	now := time.Now()
+	names := []string{}
+	for _, p := range presences {
+		// Only bother with a write when there's something to do.
+		if p.check(now, presenceOptions) != "" {
+			names = append(names, p.Name)
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+	updatePresence(func(p *CatPresence, _ *geojson.Feature) string {
+		return p.check(now, presenceOptions)
+	}, names, nil)
+}
+
+var startPresenceMonitorOnce sync.Once
+
+// startPresenceMonitor starts checking for cats going quiet or stale, once.
+func startPresenceMonitor() {
+	startPresenceMonitorOnce.Do(func() {
+		if presenceOptions.CheckInterval <= 0 {
+			return
+		}
+		go func() {
+			ticker := time.NewTicker(presenceOptions.CheckInterval)
+			for range ticker.C {
+				checkPresence()
+			}
+		}()
+	})
+}
+
+// getPresences returns the cats' current presences, by name.
+func getPresences() (map[string]CatPresence, error) {
+	presences := map[string]CatPresence{}
+	err := GetDB("master").View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(presenceKey)).ForEach(func(k, v []byte) error {
+			p := CatPresence{}
+			if err := json.Unmarshal(v, &p); err != nil {
+				log.Println("error unmarshalling presence:", err)
+				return nil
+			}
+			presences[string(k)] = p
+			return nil
+		})
+	})
+	return presences, err
+}
+
+func PresenceEventToFeature(ev PresenceEvent) *geojson.Feature {
+	p := geojson.NewFeature(orb.Point{ev.Lng, ev.Lat})
+
+	props := make(map[string]interface{})
+	if alias := catnames.AliasOrName(ev.Name); alias != ev.Name {
+		props["Alias"] = alias
+	}
+	props["Name"] = ev.Name
+	props["UUID"] = ev.UUID
+	props["Time"] = ev.Time
+	props["Event"] = ev.Type
+	props["Presence"] = ev.State
+	props["LastSeen"] = ev.LastSeen
+
+	p.Properties = props
+	return p
+}
+
+func (q presenceEventsQuery) match(ev PresenceEvent) bool {
+	return q.Cat == "" || q.Cat == ev.Name || q.Cat == catnames.AliasOrSanitizedName(ev.Name)
+}
+
+// getPresenceEvents returns the presence history matching the query, newest first.
+func getPresenceEvents(q presenceEventsQuery) ([]*geojson.Feature, error) {
+	events := []PresenceEvent{}
+	err := GetDB("master").View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(presenceEventsKey)).Cursor()
+		var k, v []byte
+		if q.Start.IsZero() {
+			k, v = c.First()
+		} else {
+			k, v = c.Seek(i64tob(q.Start.UnixNano()))
+		}
+		for ; k != nil; k, v = c.Next() {
+			if !q.End.IsZero() && i64fromb(k[:8]) > q.End.UnixNano() {
+				break
+			}
+			ev := PresenceEvent{}
+			if err := json.Unmarshal(v, &ev); err != nil {
+				log.Println("error unmarshalling presence event:", err)
+				continue
+			}
+			if q.match(ev) {
+				events = append(events, ev)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.After(events[j].Time)
+	})
+
+	features := make([]*geojson.Feature, 0, len(events))
+	for _, ev := range events {
+		features = append(features, PresenceEventToFeature(ev))
+	}
+	return features, nil
+}
@@ -0,0 +1,52 @@
+package catTrackslib
+
+import (
+	"testing"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+)
+
+func TestCatPresenceTransitions(t *testing.T) {
+	opts := PresenceOptions{QuietAfter: 10 * time.Minute, StaleAfter: time.Hour, BackOnlineAfter: 6 * time.Hour}
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	f := geojson.NewFeature(orb.Point{-93.25, 44.98})
+	f.Properties["UUID"] = "rye-uuid"
+
+	p := &CatPresence{Name: "rye"}
+	steps := []struct {
+		name    string
+		after   time.Duration
+		arrive  bool
+		want    string
+		wantNow string
+	}{
+		{"first push", 0, true, presenceOnline, presenceOnline},
+		{"pushing", 5 * time.Minute, true, "", presenceOnline},
+		{"not yet quiet", 14 * time.Minute, false, "", presenceOnline},
+		{"quiet", 16 * time.Minute, false, presenceQuiet, presenceQuiet},
+		{"still quiet", 30 * time.Minute, false, "", presenceQuiet},
+		{"back from quiet", 40 * time.Minute, true, presenceOnline, presenceOnline},
+		{"stale, skipping quiet", 2 * time.Hour, false, presenceStale, presenceStale},
+		{"back from stale, not long gone", 3 * time.Hour, true, presenceOnline, presenceOnline},
+		{"stale again", 5 * time.Hour, false, presenceStale, presenceStale},
+		{"still stale", 8 * time.Hour, false, "", presenceStale},
+		{"back from a long absence", 10 * time.Hour, true, presenceBackOnline, presenceOnline},
+	}
+	for _, s := range steps {
+		now := start.Add(s.after)
+		var got string
+		if s.arrive {
+			got = p.arrive(now, f, opts)
+		} else {
+			got = p.check(now, opts)
+		}
+		if got != s.want || p.State != s.wantNow {
+			t.Errorf("%s: got event %q state %q, want %q %q", s.name, got, p.State, s.want, s.wantNow)
+		}
+	}
+	if p.UUID != "rye-uuid" || p.Lng != -93.25 {
+		t.Errorf("want the last push's uuid and location, got %+v", p)
+	}
+}
@@ -0,0 +1,419 @@
+package catTrackslib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geo"
+	"github.com/paulmach/orb/geojson"
+	catnames "github.com/rotblauer/cattracks-names"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Privacy zones are circles, like around our homes, whose points aren't shown exactly to the public.
+// A point inside one of its cat's zones is hidden, snapped to the zone's center, or jittered to somewhere
+// in the zone, on every public read path: the last known, catsnaps and their images' EXIF, visits, places, trips,
+// presence, geofence events, the quarantine, the live feeds, and forwarding. Owners, authenticated with a token for the cat, and admins,
+// see the points raw; read tokens, like dashboards', don't. The zones are stored in the privacy zones bucket keyed by ID.
+// Points are stored raw; the zones only change what's read, so editing one changes the past too.
+
+const (
+	PrivacyHide   = "hide"
+	PrivacySnap   = "snap"
+	PrivacyJitter = "jitter"
+)
+
+var (
+	ErrPrivacyZoneNoName   = errors.New("privacy zone has no name")
+	ErrPrivacyZoneAction   = errors.New("privacy zone action must be hide, snap or jitter")
+	ErrPrivacyZoneNotFound = errors.New("privacy zone not found")
+)
+
+type PrivacyZone struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Cat limits the zone to one cat, by name or alias. Empty means everyone.
+	Cat string `json:"cat,omitempty"`
+
+	Center orb.Point `json:"center"` // [lng, lat]
+	Radius float64   `json:"radius"` // meters
+	// Action is what's done with points inside: hide, snap or jitter.
+	Action string `json:"action"`
+
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+func (z *PrivacyZone) validate() error {
+	if z.Name == "" {
+		return ErrPrivacyZoneNoName
+	}
+	if z.Radius <= 0 {
+		return fmt.Errorf("privacy zone radius must be positive, got %v", z.Radius)
+	}
+	if z.Center.Lat() < -90 || z.Center.Lat() > 90 || z.Center.Lon() < -180 || z.Center.Lon() > 180 {
+		return fmt.Errorf("privacy zone center out of range: %v", z.Center)
+	}
+	switch z.Action {
+	case "":
+		z.Action = PrivacySnap
+	case PrivacyHide, PrivacySnap, PrivacyJitter:
+	default:
+		return fmt.Errorf("%w, got %q", ErrPrivacyZoneAction, z.Action)
+	}
+	return nil
+}
+
+func (z PrivacyZone) appliesTo(name string) bool {
+	return z.Cat == "" || z.Cat == name || z.Cat == catnames.AliasOrSanitizedName(name)
+}
+
+func (z PrivacyZone) contains(pt orb.Point) bool {
+	return geo.Distance(z.Center, pt) <= z.Radius
+}
+
+// jitter returns a point in the zone, picked by the seed, so the same point is always jittered the same way.
+// It's uniform over the zone, and doesn't depend on where the point was, so it gives away nothing but the zone.
+func (z PrivacyZone) jitter(seed string) orb.Point {
+	h := fnv.New64a()
+	h.Write([]byte(z.ID + "+" + seed))
+	rnd := rand.New(rand.NewSource(int64(h.Sum64())))
+	d := z.Radius * math.Sqrt(rnd.Float64())
+	return geo.PointAtBearingAndDistance(z.Center, rnd.Float64()*360, d)
+}
+
+// PutPrivacyZone validates and stores the zone, creating an ID for new zones.
+func PutPrivacyZone(z *PrivacyZone) error {
+	if err := z.validate(); err != nil {
+		return err
+	}
+	z.Updated = time.Now()
+	z.Created = z.Updated
+	if z.ID == "" {
+		z.ID = randomHex(8)
+	}
+	err := GetDB("master").Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(privacyZonesKey))
+		if existing := b.Get([]byte(z.ID)); existing != nil {
+			old := PrivacyZone{}
+			if err := json.Unmarshal(existing, &old); err == nil {
+				z.Created = old.Created
+			}
+		}
+		v, err := json.Marshal(z)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(z.ID), v)
+	})
+	invalidatePrivacyZones()
+	return err
+}
+
+func DeletePrivacyZone(id string) error {
+	err := GetDB("master").Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(privacyZonesKey))
+		if b.Get([]byte(id)) == nil {
+			return ErrPrivacyZoneNotFound
+		}
+		return b.Delete([]byte(id))
+	})
+	invalidatePrivacyZones()
+	return err
+}
+
+// getPrivacyZones returns the stored zones, optionally only those applying to a cat (by name or alias), oldest first.
+func getPrivacyZones(cat string) ([]PrivacyZone, error) {
+	zones := []PrivacyZone{}
+	err := GetDB("master").View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(privacyZonesKey)).ForEach(func(k, v []byte) error {
+			z := PrivacyZone{}
+			if err := json.Unmarshal(v, &z); err != nil {
+				log.Println("error unmarshalling privacy zone:", err)
+				return nil
+			}
+			if cat != "" && !z.appliesTo(cat) {
+				return nil
+			}
+			zones = append(zones, z)
+			return nil
+		})
+	})
+	sort.Slice(zones, func(i, j int) bool {
+		return zones[i].Created.Before(zones[j].Created)
+	})
+	return zones, err
+}
+
+// The zones are read on every public read, and for every live broadcast, so they're cached,
+// until they're changed or the db is.
+var (
+	privacyZonesCache   []PrivacyZone
+	privacyZonesCacheDB *bolt.DB
+	privacyZonesLock    sync.Mutex
+)
+
+// cachedPrivacyZones returns all the zones, oldest first. They're shared, so mustn't be changed.
+func cachedPrivacyZones() ([]PrivacyZone, error) {
+	privacyZonesLock.Lock()
+	defer privacyZonesLock.Unlock()
+	if db := GetDB("master"); privacyZonesCacheDB != db {
+		zones, err := getPrivacyZones("")
+		if err != nil {
+			return nil, err
+		}
+		privacyZonesCache, privacyZonesCacheDB = zones, db
+	}
+	return privacyZonesCache, nil
+}
+
+func invalidatePrivacyZones() {
+	privacyZonesLock.Lock()
+	defer privacyZonesLock.Unlock()
+	privacyZonesCache, privacyZonesCacheDB = nil, nil
+}
+
+// privacyView is who's reading, and the zones they read through.
+// A nil view reads everything raw, as we do ourselves.
+type privacyView struct {
+	owner *APIToken // nil for the public
+	zones []PrivacyZone
+}
+
+// newPrivacyView returns the view for the token's owner, or for the public if it's nil.
+func newPrivacyView(owner *APIToken) *privacyView {
+	zones, err := cachedPrivacyZones()
+	if err != nil {
+		// Without the zones we can't tell what to keep private, so keep it all back.
+		log.Println("error reading privacy zones:", err)
+		zones = []PrivacyZone{{ID: "all", Center: orb.Point{0, 0}, Radius: math.Inf(1), Action: PrivacyHide}}
+	}
+	return &privacyView{owner: owner, zones: zones}
+}
+
+// privacyViews are views by their owner's token ID, the public's by "", made as they're first wanted,
+// for reading one thing, like a broadcast, through each owner's view once.
+type privacyViews map[string]*privacyView
+
+func (vs privacyViews) of(owner *APIToken) *privacyView {
+	id := ""
+	if owner != nil {
+		id = owner.ID
+	}
+	v, ok := vs[id]
+	if !ok {
+		v = newPrivacyView(owner)
+		vs[id] = v
+	}
+	return v
+}
+
+// requestToken authenticates the request's token, if it has one, on a route that doesn't need one.
+func requestToken(r *http.Request) *APIToken {
+	token := r.Header.Get("AuthorizationOfCats")
+	if token == "" {
+		token = r.URL.Query().Get("api_token")
+	}
+	if token == "" {
+		return nil
+	}
+	t, err := authenticateToken(token)
+	if err != nil {
+		return nil
+	}
+	noteAccessToken(r.Context(), t)
+	return t
+}
+
+// requestPrivacyView returns the view for whoever's making the request.
+func requestPrivacyView(r *http.Request) *privacyView {
+	return newPrivacyView(requestToken(r))
+}
+
+// owns reports whether the viewer sees the cat's points raw:
+// they've a token for the cat, or they're an admin, as COTOKEN is.
+func (v *privacyView) owns(name string) bool {
+	t := v.owner
+	if t == nil {
+		return false
+	}
+	if t.HasScope(ScopeAdmin) {
+		return true
+	}
+	return t.Cat != "" && (t.Cat == name || t.Cat == catnames.AliasOrSanitizedName(name))
+}
+
+// zoneFor returns the first of the cat's zones containing any of the points, or nil.
+func (v *privacyView) zoneFor(name string, pts ...orb.Point) *PrivacyZone {
+	for i, z := range v.zones {
+		if !z.appliesTo(name) {
+			continue
+		}
+		for _, pt := range pts {
+			if z.contains(pt) {
+				return &v.zones[i]
+			}
+		}
+	}
+	return nil
+}
+
+// point returns where the cat's point is shown, and false if it's hidden.
+func (v *privacyView) point(name, seed string, pt orb.Point) (orb.Point, bool) {
+	if v == nil || v.owns(name) {
+		return pt, true
+	}
+	z := v.zoneFor(name, pt)
+	if z == nil {
+		return pt, true
+	}
+	return z.place(seed)
+}
+
+// place returns where a point in the zone is shown, and false if it's hidden.
+func (z PrivacyZone) place(seed string) (orb.Point, bool) {
+	switch z.Action {
+	case PrivacyHide:
+		return orb.Point{}, false
+	case PrivacyJitter:
+		return z.jitter(seed), true
+	}
+	return z.Center, true
+}
+
+// privacyProperties are properties giving away where a point was, or naming the place, or the geofence, it was in.
+var privacyProperties = []string{"SmoothedLng", "SmoothedLat", "RawLng", "RawLat", "Visit", "PlaceIdentity", "PlaceAddress", "FenceID", "FenceName"}
+
+// featureSeed identifies the feature, for jittering it the same way each time.
+func featureSeed(f *geojson.Feature) string {
+	name, _ := f.Properties["Name"].(string)
+	return fmt.Sprintf("%s+%d", name, mustGetTime(f).UnixNano())
+}
+
+// feature returns the feature as the viewer sees it, and false if it's hidden.
+// A feature that's changed is a copy; the one given isn't touched.
+func (v *privacyView) feature(f *geojson.Feature) (*geojson.Feature, bool) {
+	name, _ := f.Properties["Name"].(string)
+	if v == nil || v.owns(name) {
+		return f, true
+	}
+	switch g := f.Geometry.(type) {
+	case orb.Point:
+		pts := []orb.Point{g}
+		for _, pair := range [][2]string{{"SmoothedLng", "SmoothedLat"}, {"RawLng", "RawLat"}} {
+			lng, okLng := f.Properties[pair[0]].(float64)
+			lat, okLat := f.Properties[pair[1]].(float64)
+			if okLng && okLat {
+				pts = append(pts, orb.Point{lng, lat})
+			}
+		}
+		z := v.zoneFor(name, pts...)
+		if z == nil {
+			return f, true
+		}
+		pt, ok := z.place(featureSeed(f))
+		if !ok {
+			return nil, false
+		}
+		return privateCopy(f, pt), true
+
+	case orb.LineString:
+		seed := featureSeed(f)
+		ls := make(orb.LineString, 0, len(g))
+		changed := false
+		for i, pt := range g {
+			z := v.zoneFor(name, pt)
+			if z == nil {
+				ls = append(ls, pt)
+				continue
+			}
+			changed = true
+			if p, ok := z.place(fmt.Sprintf("%s+%d", seed, i)); ok {
+				ls = append(ls, p)
+			}
+		}
+		if !changed {
+			return f, true
+		}
+		if len(ls) < 2 {
+			return nil, false
+		}
+		out := privateCopy(f, ls)
+		if f.BBox != nil {
+			out.BBox = geojson.NewBBox(ls.Bound())
+		}
+		return out, true
+	}
+	return f, true
+}
+
+func privateCopy(f *geojson.Feature, g orb.Geometry) *geojson.Feature {
+	out := geojson.NewFeature(g)
+	out.ID = f.ID
+	out.Properties = f.Properties.Clone()
+	for _, k := range privacyProperties {
+		delete(out.Properties, k)
+	}
+	return out
+}
+
+// features returns the features as the viewer sees them, without the hidden ones.
+func (v *privacyView) features(features []*geojson.Feature) []*geojson.Feature {
+	if v == nil {
+		return features
+	}
+	out := make([]*geojson.Feature, 0, len(features))
+	for _, f := range features {
+		if f, ok := v.feature(f); ok {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// withinBBox returns the features shown inside the box.
+// Boxes are matched against where features are shown, so a small box can't find where they really were.
+func withinBBox(features []*geojson.Feature, bbox *orb.Bound) []*geojson.Feature {
+	if bbox == nil {
+		return features
+	}
+	out := make([]*geojson.Feature, 0, len(features))
+	for _, f := range features {
+		if pt, ok := f.Geometry.(orb.Point); ok && bbox.Contains(pt) {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// publicPopulateBody returns the populate body to forward, its features as the public sees them,
+// and false if they're all hidden. It's the body as it came unless a zone changed it.
+func publicPopulateBody(body []byte, features []*geojson.Feature) ([]byte, bool) {
+	public := newPrivacyView(nil).features(features)
+	if len(public) == 0 {
+		return nil, false
+	}
+	changed := len(public) != len(features)
+	for i := 0; !changed && i < len(public); i++ {
+		changed = public[i] != features[i]
+	}
+	if !changed {
+		return body, true
+	}
+	b, err := json.Marshal(public)
+	if err != nil {
+		log.Println("error marshalling public populate:", err)
+		return nil, false
+	}
+	return b, true
+}
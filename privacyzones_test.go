@@ -0,0 +1,255 @@
+package catTrackslib
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geo"
+	"github.com/paulmach/orb/geojson"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestPrivacyZones(t *testing.T) {
+	SetDBPath("master", filepath.Join(t.TempDir(), "m.db"))
+	if err := InitBoltDB(); err != nil {
+		t.Fatal(err)
+	}
+	defer GetDB("master").Close()
+
+	home := orb.Point{-93.25, 44.98}
+	if err := PutPrivacyZone(&PrivacyZone{Name: "home", Center: home, Radius: 200, Action: "blur"}); err == nil {
+		t.Error("want an unknown action refused")
+	}
+	zone := &PrivacyZone{Name: "home", Cat: "rye", Center: home, Radius: 200}
+	if err := PutPrivacyZone(zone); err != nil || zone.Action != PrivacySnap {
+		t.Fatalf("got %+v, %v, want snapping by default", zone, err)
+	}
+
+	at := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	point := func(name string, pt orb.Point) *geojson.Feature {
+		f := geojson.NewFeature(pt)
+		f.Properties["Name"] = name
+		f.Properties["Time"] = at.Format(time.RFC3339)
+		f.Properties["SmoothedLng"], f.Properties["SmoothedLat"] = pt.Lon(), pt.Lat()
+		return f
+	}
+	inside := orb.Point{-93.2505, 44.9801}
+	outside := orb.Point{-93.2, 44.98}
+
+	public := newPrivacyView(nil)
+	f, ok := public.feature(point("rye", inside))
+	if !ok || f.Point() != home || f.Properties["SmoothedLng"] != nil {
+		t.Errorf("got %v %v, want snapped to home without its smoothed position", f.Geometry, f.Properties)
+	}
+	if f, _ := public.feature(point("rye", outside)); f.Point() != outside {
+		t.Errorf("got %v, want a point outside the zone as it is", f.Geometry)
+	}
+	if f, _ := public.feature(point("ia", inside)); f.Point() != inside {
+		t.Errorf("got %v, want another cat's point as it is", f.Geometry)
+	}
+
+	// A broadcast is read through one view per owner.
+	owner := &APIToken{ID: "rye-token", Cat: "rye"}
+	views := privacyViews{}
+	if views.of(nil) != views.of(nil) || views.of(owner) != views.of(&APIToken{ID: "rye-token", Cat: "rye"}) || views.of(owner) == views.of(nil) {
+		t.Error("want one view per owner")
+	}
+
+	// Changing a zone changes what's read straight away.
+	zone.Action = PrivacyJitter
+	PutPrivacyZone(zone)
+	public = newPrivacyView(nil)
+	j1, _ := public.feature(point("rye", inside))
+	j2, _ := public.feature(point("rye", inside))
+	if j1.Point() != j2.Point() || j1.Point() == inside || geo.Distance(home, j1.Point()) > zone.Radius {
+		t.Errorf("got %v and %v, want the same point in the zone", j1.Point(), j2.Point())
+	}
+
+	zone.Action = PrivacyHide
+	PutPrivacyZone(zone)
+	public = newPrivacyView(nil)
+	if _, ok := public.feature(point("rye", inside)); ok {
+		t.Error("want the point hidden")
+	}
+	trip := geojson.NewFeature(orb.LineString{home, inside, outside, {-93.1, 44.9}})
+	trip.Properties["Name"] = "rye"
+	trip.BBox = geojson.NewBBox(trip.Geometry.Bound())
+	if f, ok := public.feature(trip); !ok || len(f.Geometry.(orb.LineString)) != 2 || f.BBox.Bound().Contains(home) {
+		t.Errorf("got %v, want the trip leaving home from the zone's edge", f.Geometry)
+	}
+	if _, ok := public.feature(point("rye", outside)); !ok {
+		t.Error("want a point outside the zone kept")
+	}
+
+	// Forwarding sends on what the public sees.
+	if _, ok := publicPopulateBody([]byte("raw"), []*geojson.Feature{point("rye", inside)}); ok {
+		t.Error("want nothing forwarded when it's all hidden")
+	}
+	if body, ok := publicPopulateBody([]byte("raw"), []*geojson.Feature{point("ia", inside)}); !ok || string(body) != "raw" {
+		t.Errorf("got %q, want the body as it came", body)
+	}
+	body, _ := publicPopulateBody([]byte("raw"), []*geojson.Feature{point("rye", inside), point("rye", outside)})
+	if fc, err := geojson.UnmarshalFeatureCollection([]byte(`{"type":"FeatureCollection","features":` + string(body) + `}`)); err != nil || len(fc.Features) != 1 {
+		t.Errorf("got %s, want the point outside the zone", body)
+	}
+
+	// Over HTTP: the public and readers get the zones, the owner and admins get it raw.
+	storeLastKnown(point("rye", inside))
+	storeLastKnown(point("ia", inside))
+	t.Setenv("COTOKEN", "legacy-secret")
+	ryeToken, _, _ := CreateAPIToken("rye's phone", "rye", "", []string{ScopePopulate}, time.Time{})
+	iaToken, _, _ := CreateAPIToken("ia's phone", "ia", "", []string{ScopePopulate}, time.Time{})
+	readToken, _, _ := CreateAPIToken("dashboard", "", "", []string{ScopeRead}, time.Time{})
+
+	srv := httptest.NewServer(NewRouter(&RouterOpts{DisableWebsocket: true}))
+	defer srv.Close()
+	do := func(method, path, token, body string) (int, []byte) {
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		req.Header.Set("AuthorizationOfCats", token)
+		res, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := io.ReadAll(res.Body)
+		return res.StatusCode, b
+	}
+	lastKnown := func(token string) LastKnownGeoJSON {
+		_, b := do("GET", "/lastknown", token, "")
+		lk := LastKnownGeoJSON{}
+		if err := json.Unmarshal(b, &lk); err != nil {
+			t.Fatalf("got %s: %v", b, err)
+		}
+		return lk
+	}
+	for _, c := range []struct {
+		token   string
+		wantRye bool
+	}{{"", false}, {"nope", false}, {iaToken, false}, {readToken, false}, {ryeToken, true}, {"legacy-secret", true}} {
+		lk := lastKnown(c.token)
+		if _, ok := lk["rye"]; ok != c.wantRye {
+			t.Errorf("with %.12q: got rye %v, want %v", c.token, ok, c.wantRye)
+		}
+		if _, ok := lk["ia"]; !ok {
+			t.Errorf("with %.12q: want ia, with no zones of their own", c.token)
+		}
+	}
+
+	// A photo taken at home, its GPS EXIF written by the phone, and one without EXIF.
+	jpg := &bytes.Buffer{}
+	jpeg.Encode(jpg, image.NewRGBA(image.Rect(0, 0, 8, 8)), nil)
+	snap := func(uuid string, img []byte) string {
+		f := point("rye", inside)
+		f.Properties["UUID"] = uuid
+		f.Properties["imgB64"] = base64.StdEncoding.EncodeToString(img)
+		if err := storePoint(f); err != nil {
+			t.Fatal(err)
+		}
+		return "/catsnaps/" + catsnapKeyFromImgS3(f.Properties["imgS3"].(string)) + ".jpg"
+	}
+	phone := addJPEGEXIF(jpg.Bytes(), inside.Lon(), inside.Lat(), at)
+	d, m, sec := exifDMS(inside.Lat())
+	rawLat := exifRationalsEntry(0x0002, 10000, d, m, sec).value
+	fromPhone := snap("rye-phone", phone)
+	plain := snap("rye-plain", jpg.Bytes())
+	// gpsLat returns the JPEG's EXIF GPS latitude, or false if it has none.
+	gpsLat := func(b []byte) (float64, bool) {
+		i := bytes.Index(b, []byte("Exif\x00\x00"))
+		if i < 0 {
+			return 0, false
+		}
+		tiff := b[i+6:]
+		lat := exifTag(tiff, int(binary.BigEndian.Uint32(exifTag(tiff, 8, 0x8825))), 0x0002)
+		if lat == nil {
+			return 0, false
+		}
+		deg := 0.0
+		for i, div := range []float64{1, 60, 3600} {
+			deg += float64(binary.BigEndian.Uint32(lat[8*i:])) / float64(binary.BigEndian.Uint32(lat[8*i+4:])) / div
+		}
+		return deg, true
+	}
+	latNear := func(b []byte, want float64) bool {
+		lat, ok := gpsLat(b)
+		return ok && math.Abs(lat-want) < 1e-6
+	}
+	if code, b := do("GET", fromPhone, "", ""); code != http.StatusOK || !jpegHasEXIF(b) {
+		t.Errorf("got %d, want the phone's EXIF kept", code)
+	} else if lat, ok := gpsLat(b); ok || bytes.Contains(b, rawLat) {
+		t.Errorf("got latitude %v, want the photo's GPS blanked", lat)
+	}
+	if _, b := do("GET", fromPhone, readToken, ""); bytes.Equal(b, phone) {
+		t.Error("want a reader given the photo without its GPS")
+	}
+	if _, b := do("GET", fromPhone, ryeToken, ""); !bytes.Equal(b, phone) {
+		t.Error("want the owner given the photo as it was sent")
+	}
+	// EXIF written as it's served is where the one asking sees the snap, with the zones as they are now.
+	defer SetCatsnapImageOptions(catsnapImageOptions)
+	SetCatsnapImageOptions(CatsnapImageOptions{WriteEXIF: true})
+	if _, b := do("GET", plain, "", ""); jpegHasEXIF(b) {
+		t.Error("want no EXIF written for a hidden snap")
+	}
+	zone.Action = PrivacySnap
+	PutPrivacyZone(zone)
+	if _, b := do("GET", plain, "", ""); !latNear(b, home.Lat()) {
+		t.Error("want the snap written at home's center")
+	}
+	if _, b := do("GET", plain, ryeToken, ""); !latNear(b, inside.Lat()) {
+		t.Error("want the owner given the snap where it was")
+	}
+
+	// Geofence events and the quarantine too, with the fence's name, giving away where it was, kept back.
+	ev := GeofenceEvent{FenceID: "f1", FenceName: "rye's bed", Type: "enter", Name: "rye", Time: at, Lat: inside.Lat(), Lng: inside.Lon()}
+	GetDB("master").Update(func(tx *bolt.Tx) error {
+		v, _ := json.Marshal(ev)
+		return tx.Bucket([]byte(geofenceEventsKey)).Put(buildGeofenceEventKey(ev), v)
+	})
+	if err := quarantinePoint(point("rye", inside), implausibleSpeed, "too fast"); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		token string
+		want  orb.Point
+	}{{readToken, home}, {"legacy-secret", inside}} {
+		_, b := do("GET", "/geofences/events", c.token, "")
+		fc, err := geojson.UnmarshalFeatureCollection(b)
+		if err != nil || len(fc.Features) != 1 || fc.Features[0].Point() != c.want {
+			t.Fatalf("with %.12q: got %s, want the event at %v", c.token, b, c.want)
+		}
+		if name := fc.Features[0].Properties["FenceName"]; (name == nil) != (c.want == home) {
+			t.Errorf("with %.12q: got fence name %v", c.token, name)
+		}
+		_, b = do("GET", "/quarantine", c.token, "")
+		quarantined := []QuarantinedPoint{}
+		if err := json.Unmarshal(b, &quarantined); err != nil || len(quarantined) != 1 || quarantined[0].Feature.Point() != c.want {
+			t.Errorf("with %.12q: got %s, want the quarantined point at %v", c.token, b, c.want)
+		}
+	}
+
+	if code, _ := do("GET", "/privacy-zones", readToken, ""); code != http.StatusForbidden {
+		t.Errorf("got %d, want the zones admin only", code)
+	}
+	if code, b := do("GET", "/privacy-zones", "legacy-secret", ""); code != http.StatusOK || !strings.Contains(string(b), zone.ID) {
+		t.Errorf("got %d %s", code, b)
+	}
+	if code, _ := do("DELETE", "/privacy-zones/"+zone.ID, "legacy-secret", ""); code != http.StatusNoContent {
+		t.Errorf("got %d deleting", code)
+	}
+	if _, ok := lastKnown("")["rye"]; !ok {
+		t.Error("want rye shown once the zone's gone")
+	}
+}
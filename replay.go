@@ -0,0 +1,95 @@
+package catTrackslib
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Every broadcast gets the next number of a monotonic sequence, and is kept in the broadcasts bucket for a while,
+// so live clients that drop off can catch up on what they missed: they resume since the last sequence number
+// (or time) they saw, and are replayed everything broadcast after it, before going live again.
+
+type ReplayOptions struct {
+	// Retention is how long broadcasts are kept to replay.
+	Retention time.Duration
+	// MaxReplay is the most broadcasts replayed for one resume.
+	// Clients are told when there's more, and resume again from the last they got.
+	MaxReplay int
+}
+
+var DefaultReplayOptions = ReplayOptions{
+	Retention: 72 * time.Hour,
+	MaxReplay: 200,
+}
+
+// storedBroadcast is a broadcast as kept for replay.
+type storedBroadcast struct {
+	broadcats
+	Time time.Time `json:"time"`
+}
+
+// storeBroadcast gives the broadcast its sequence number and stores it,
+// pruning broadcasts older than the retention.
+func storeBroadcast(bc *broadcats) error {
+	now := time.Now()
+	return GetDB("master").Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(broadcastsKey))
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		bc.Seq = seq
+		v, err := json.Marshal(storedBroadcast{broadcats: *bc, Time: now})
+		if err != nil {
+			return err
+		}
+		if err := b.Put(i64tob(int64(seq)), v); err != nil {
+			return err
+		}
+
+		// Broadcasts are stored in time order, so the old ones are first.
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.First() {
+			sb := storedBroadcast{}
+			if err := json.Unmarshal(v, &sb); err == nil && now.Sub(sb.Time) < replayOptions.Retention {
+				break
+			}
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// replayBroadcasts calls fn with the stored broadcasts after the sequence number since,
+// or if since is 0, those after the time sinceTime, oldest first, up to the max.
+// It returns the last sequence number replayed, and true if there are more.
+func replayBroadcasts(since uint64, sinceTime time.Time, max int, fn func(sb storedBroadcast)) (last uint64, more bool, err error) {
+	err = GetDB("master").View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(broadcastsKey)).Cursor()
+		n := 0
+		for k, v := c.Seek(i64tob(int64(since + 1))); k != nil; k, v = c.Next() {
+			sb := storedBroadcast{}
+			if err := json.Unmarshal(v, &sb); err != nil {
+				log.Println("error unmarshalling stored broadcast:", err)
+				continue
+			}
+			if since == 0 && !sb.Time.After(sinceTime) {
+				continue
+			}
+			if max > 0 && n >= max {
+				more = true
+				return nil
+			}
+			fn(sb)
+			last = sb.Seq
+			n++
+		}
+		return nil
+	})
+	return last, more, err
+}
@@ -0,0 +1,59 @@
+package catTrackslib
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReplayBroadcasts(t *testing.T) {
+	SetDBPath("master", filepath.Join(t.TempDir(), "master.db"))
+	if err := InitBoltDB(); err != nil {
+		t.Fatal(err)
+	}
+	defer GetDB("master").Close()
+	defer SetReplayOptions(replayOptions)
+	SetReplayOptions(ReplayOptions{Retention: time.Hour, MaxReplay: 3})
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		bc := &broadcats{Action: websocketActionPopulate}
+		if err := storeBroadcast(bc); err != nil {
+			t.Fatal(err)
+		}
+		if want := uint64(i + 1); bc.Seq != want {
+			t.Fatalf("got seq %d, want %d", bc.Seq, want)
+		}
+	}
+
+	replay := func(since uint64, sinceTime time.Time) (seqs []uint64, last uint64, more bool) {
+		last, more, err := replayBroadcasts(since, sinceTime, replayOptions.MaxReplay, func(sb storedBroadcast) {
+			seqs = append(seqs, sb.Seq)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return seqs, last, more
+	}
+
+	seqs, last, more := replay(0, start.Add(-time.Second))
+	if len(seqs) != 3 || seqs[0] != 1 || last != 3 || !more {
+		t.Errorf("since time: got %v last %d more %v, want [1 2 3] last 3 more", seqs, last, more)
+	}
+	seqs, last, more = replay(last, time.Time{})
+	if len(seqs) != 2 || seqs[0] != 4 || last != 5 || more {
+		t.Errorf("since seq: got %v last %d more %v, want [4 5] last 5", seqs, last, more)
+	}
+	if seqs, _, _ = replay(5, time.Time{}); len(seqs) != 0 {
+		t.Errorf("caught up: got %v, want none", seqs)
+	}
+
+	// Storing prunes those past the retention.
+	SetReplayOptions(ReplayOptions{Retention: time.Nanosecond, MaxReplay: 3})
+	if err := storeBroadcast(&broadcats{Action: websocketActionPopulate}); err != nil {
+		t.Fatal(err)
+	}
+	if seqs, _, _ = replay(0, start.Add(-time.Second)); len(seqs) > 1 {
+		t.Errorf("after prune: got %v, want at most the latest", seqs)
+	}
+}
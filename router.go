@@ -1,160 +1,19 @@
 package catTrackslib
 
 import (
-	"io"
 	"log"
 	"net"
 	"net/http"
-	"net/url"
 	"os"
-	"strconv"
+	"strings"
+	"sync"
 	"time"
-	"unicode/utf8"
 
-	ghandlers "github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 )
 
 // https://github.com/gorilla/mux#middleware
 
-const lowerhex = "0123456789abcdef"
-
-func appendQuoted(buf []byte, s string) []byte {
-	var runeTmp [utf8.UTFMax]byte
-	for width := 0; len(s) > 0; s = s[width:] { // nolint: wastedassign //TODO: why width starts from 0and reassigned as 1
-		r := rune(s[0])
-		width = 1
-		if r >= utf8.RuneSelf {
-			r, width = utf8.DecodeRuneInString(s)
-		}
-		if width == 1 && r == utf8.RuneError {
-			buf = append(buf, `\x`...)
-			buf = append(buf, lowerhex[s[0]>>4])
-			buf = append(buf, lowerhex[s[0]&0xF])
-			continue
-		}
-		if r == rune('"') || r == '\\' { // always backslashed
-			buf = append(buf, '\\')
-			buf = append(buf, byte(r))
-			continue
-		}
-		if strconv.IsPrint(r) {
-			n := utf8.EncodeRune(runeTmp[:], r)
-			buf = append(buf, runeTmp[:n]...)
-			continue
-		}
-		switch r {
-		case '\a':
-			buf = append(buf, `\a`...)
-		case '\b':
-			buf = append(buf, `\b`...)
-		case '\f':
-			buf = append(buf, `\f`...)
-		case '\n':
-			buf = append(buf, `\n`...)
-		case '\r':
-			buf = append(buf, `\r`...)
-		case '\t':
-			buf = append(buf, `\t`...)
-		case '\v':
-			buf = append(buf, `\v`...)
-		default:
-			switch {
-			case r < ' ':
-				buf = append(buf, `\x`...)
-				buf = append(buf, lowerhex[s[0]>>4])
-				buf = append(buf, lowerhex[s[0]&0xF])
-			case r > utf8.MaxRune:
-				r = 0xFFFD
-				fallthrough
-			case r < 0x10000:
-				buf = append(buf, `\u`...)
-				for s := 12; s >= 0; s -= 4 {
-					buf = append(buf, lowerhex[r>>uint(s)&0xF])
-				}
-			default:
-				buf = append(buf, `\U`...)
-				for s := 28; s >= 0; s -= 4 {
-					buf = append(buf, lowerhex[r>>uint(s)&0xF])
-				}
-			}
-		}
-	}
-	return buf
-}
-
-// buildCommonLogLine builds a log entry for req in Apache Common Log Format.
-// ts is the timestamp with which the entry should be logged.
-// status and size are used to provide the response HTTP status and size.
-func buildCommonLogLine(req *http.Request, url url.URL, ts time.Time, status int, size int) []byte {
-	username := "-"
-	if url.User != nil {
-		if name := url.User.Username(); name != "" {
-			username = name
-		}
-	}
-
-	host, _, err := net.SplitHostPort(req.RemoteAddr)
-	if err != nil {
-		host = req.RemoteAddr
-	}
-
-	for _, v := range req.Header.Values("X-Forwarded-For") {
-		host += "->" + v
-	}
-
-	uri := req.RequestURI
-
-	// Requests using the CONNECT method over HTTP/2.0 must use
-	// the authority field (aka r.Host) to identify the target.
-	// Refer: https://httpwg.github.io/specs/rfc7540.html#CONNECT
-	if req.ProtoMajor == 2 && req.Method == "CONNECT" {
-		uri = req.Host
-	}
-	if uri == "" {
-		uri = url.RequestURI()
-	}
-
-	buf := make([]byte, 0, 3*(len(host)+len(username)+len(req.Method)+len(uri)+len(req.Proto)+50)/2)
-	buf = append(buf, host...)
-	buf = append(buf, " - "...)
-	buf = append(buf, username...)
-	buf = append(buf, " ["...)
-	buf = append(buf, ts.Format("02/Jan/2006:15:04:05 -0700")...)
-	buf = append(buf, `] "`...)
-	buf = append(buf, req.Method...)
-	buf = append(buf, " "...)
-	buf = appendQuoted(buf, uri)
-	buf = append(buf, " "...)
-	buf = append(buf, req.Proto...)
-	buf = append(buf, `" `...)
-	buf = append(buf, strconv.Itoa(status)...)
-	buf = append(buf, " "...)
-	buf = append(buf, strconv.Itoa(size)...)
-	return buf
-}
-
-// writeLog writes a log entry for req to w in Apache Common Log Format.
-// ts is the timestamp with which the entry should be logged.
-// status and size are used to provide the response HTTP status and size.
-func writeLog(writer io.Writer, params ghandlers.LogFormatterParams) {
-	buf := buildCommonLogLine(params.Request, params.URL, params.TimeStamp, params.StatusCode, params.Size)
-	buf = append(buf, '\n')
-	_, _ = writer.Write(buf)
-}
-
-func loggingMiddleware(next http.Handler) http.Handler {
-	return ghandlers.CustomLoggingHandler(os.Stdout, next, writeLog)
-	// return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-	// 	// Do stuff here
-	// 	dump, _ := httputil.DumpRequest(r, false)
-	// 	log.Println(string(dump))
-	//
-	// 	// Call the next handler, which can be another middleware in the chain, or the final handler.
-	// 	next.ServeHTTP(w, r)
-	// })
-}
-
 func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Do stuff here
@@ -176,11 +35,17 @@ func contentTypeMiddlewareFor(contentType string) func(http.Handler) http.Handle
 	}
 }
 
+var warnNoTokensOnce sync.Once
+
+// tokenAuthenticationMiddleware authenticates the request's token, from the AuthorizationOfCats header
+// or the api_token param, and puts it in the request's context for the scopes to be checked.
+// With no COTOKEN and no API tokens, nothing's checked.
 func tokenAuthenticationMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		validToken := os.Getenv("COTOKEN")
-		if validToken == "" {
-			log.Printf("WARN: No COTOKEN set, allowing all requests")
+		if os.Getenv("COTOKEN") == "" && !haveAPITokens() {
+			warnNoTokensOnce.Do(func() {
+				log.Printf("WARN: No COTOKEN set and no API tokens, allowing all requests")
+			})
 			next.ServeHTTP(w, r)
 			return
 		}
@@ -194,34 +59,91 @@ func tokenAuthenticationMiddleware(next http.Handler) http.Handler {
 		}
 
 		// Enforce token validation.
-		if token != validToken {
+		t, err := authenticateToken(token)
+		if err != nil {
+			// The token itself is never logged, just its ID, if it has one.
+			id, _ := parseToken(token)
 			log.Println("Invalid token",
-				"token:", token, "validToken:", "***REDACTED***",
-				"method:", r.Method, "url:", r.URL, "proto:", r.Proto,
-				"host:", r.Host, "remote-addr:", r.RemoteAddr,
-				"request-URI:", r.RequestURI, "content-length:", r.ContentLength,
+				"id:", id, "error:", err, "request-id:", requestIDFromContext(r.Context()),
+				"method:", r.Method, "url:", accessLogOptions.redactURI(r), "proto:", r.Proto,
+				"host:", r.Host, "remote-addr:", r.RemoteAddr, "content-length:", r.ContentLength,
 				"user-agent:", r.UserAgent())
 			http.Error(w, "Forbidden", http.StatusForbidden)
 			return
 		}
 
+		touchAPIToken(t, requestIP(r), time.Now())
+		noteAccessToken(r.Context(), t)
+
 		// Pass down the request to the next middleware (or final handler)
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, r.WithContext(withAPIToken(r.Context(), t)))
 	})
 }
 
-type RouterOpts struct {
-	DisableWebsocket bool
+// shareLinkMiddleware authenticates the share link in the path, and puts it in the request's context.
+func shareLinkMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, err := authenticateShareLink(mux.Vars(r)["token"], time.Now())
+		if err != nil {
+			log.Println("Share link refused:", err, "remote-addr:", requestIP(r))
+			http.Error(w, http.StatusText(shareLinkErrorStatus(err)), shareLinkErrorStatus(err))
+			return
+		}
+		noteAccessShare(r.Context(), s)
+		next.ServeHTTP(w, r.WithContext(withShareLink(r.Context(), s)))
+	})
 }
 
-func NewRouter(opts *RouterOpts) *mux.Router {
+// requestIP returns the IP the request came from, as the proxy in front of us says if there is one.
+func requestIP(r *http.Request) string {
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+		first, _, _ := strings.Cut(fwd, ",")
+		return strings.TrimSpace(first)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
 
-	if !opts.DisableWebsocket {
-		m := InitMelody()
-		http.HandleFunc("/socat", func(w http.ResponseWriter, r *http.Request) {
-			m.HandleRequest(w, r)
+// scopeMiddleware requires the request's token to have the scope.
+// Requests let through without a token, when there are none, have every scope.
+func scopeMiddleware(scope func(r *http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			want := scope(r)
+			if t := apiTokenFromContext(r.Context()); t != nil && !t.HasScope(want) {
+				log.Println("Token", t.ID, "missing scope", want, "for", r.Method, r.URL.Path)
+				http.Error(w, "Forbidden: want scope "+want, http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
 		})
 	}
+}
+
+// readOrAdminScope wants read for reading, and admin for anything else.
+func readOrAdminScope(r *http.Request) string {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return ScopeRead
+	}
+	return ScopeAdmin
+}
+
+type RouterOpts struct {
+	DisableWebsocket bool
+}
+
+// Start starts the work done in the background while serving: the presence monitor, marking cats quiet and stale,
+// and the catsnap uploader, retrying pending uploads. The server calls it once, after InitBoltDB and setting the options;
+// NewRouter doesn't, so routers made elsewhere, like in tests, don't leave it running.
+func Start() {
+	startPresenceMonitor()
+	startCatsnapUploader()
+}
+
+func NewRouter(opts *RouterOpts) *mux.Router {
 
 	/*
 		StrictSlash defines the trailing slash behavior for new routes. The initial value is false.
@@ -244,17 +166,76 @@ func NewRouter(opts *RouterOpts) *mux.Router {
 		w.Write([]byte("pong"))
 	})
 
+	// Live feeds: the websocket, and server-sent events.
+	if !opts.DisableWebsocket {
+		m := InitMelody()
+		apiRoutes.Path("/socat").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			m.HandleRequest(w, r)
+		})
+	}
+	apiRoutes.Path("/events").HandlerFunc(handleGetEvents).Methods(http.MethodGet)
+
+	apiRoutes.Path("/catsnaps/{key}.{ext:[a-z]+}").HandlerFunc(handleGetCatSnapImage).Methods(http.MethodGet, http.MethodHead)
+	apiRoutes.Path("/catsnaps/{key}/thumb").HandlerFunc(handleGetCatSnapThumb).Methods(http.MethodGet, http.MethodHead)
+
 	apiJSONRoutes := apiRoutes.NewRoute().Subrouter()
 	jsonMiddleware := contentTypeMiddlewareFor("application/json")
 	apiJSONRoutes.Use(jsonMiddleware)
 
+	// Share links, for following one cat without a token.
+	shareRoutes := apiRoutes.NewRoute().Subrouter()
+	shareRoutes.Use(shareLinkMiddleware)
+	shareRoutes.Path("/share/{token}/events").HandlerFunc(handleGetShareEvents).Methods(http.MethodGet)
+	shareJSONRoutes := shareRoutes.NewRoute().Subrouter()
+	shareJSONRoutes.Use(jsonMiddleware)
+	shareJSONRoutes.Path("/share/{token}").HandlerFunc(handleGetShare).Methods(http.MethodGet)
+	shareJSONRoutes.Path("/share/{token}/lastknown").HandlerFunc(handleGetShareLastKnown).Methods(http.MethodGet)
+	shareJSONRoutes.Path("/share/{token}/track").HandlerFunc(handleGetShareTrack).Methods(http.MethodGet)
+
 	apiJSONRoutes.Path("/lastknown").HandlerFunc(getLastKnown).Methods(http.MethodGet)
 	apiJSONRoutes.Path("/catsnaps").HandlerFunc(handleGetCatSnaps).Methods(http.MethodGet)
+	apiJSONRoutes.Path("/visits").HandlerFunc(handleGetVisits).Methods(http.MethodGet)
+	apiJSONRoutes.Path("/places").HandlerFunc(handleGetPlaces).Methods(http.MethodGet)
+	apiJSONRoutes.Path("/trips").HandlerFunc(handleGetTrips).Methods(http.MethodGet)
+	apiJSONRoutes.Path("/presence").HandlerFunc(handleGetPresence).Methods(http.MethodGet)
+	apiJSONRoutes.Path("/presence/events").HandlerFunc(handleGetPresenceEvents).Methods(http.MethodGet)
 
 	authenticatedAPIRoutes := apiJSONRoutes.NewRoute().Subrouter()
-	authenticatedAPIRoutes.Use(tokenAuthenticationMiddleware)
-
-	populateRoutes := authenticatedAPIRoutes.NewRoute().Subrouter()
+	authenticatedAPIRoutes.Use(tokenAuthenticationMiddleware, scopeMiddleware(readOrAdminScope))
+
+	authenticatedAPIRoutes.Path("/geofences").HandlerFunc(handleGetGeofences).Methods(http.MethodGet)
+	authenticatedAPIRoutes.Path("/geofences").HandlerFunc(handlePutGeofence).Methods(http.MethodPost)
+	authenticatedAPIRoutes.Path("/geofences/events").HandlerFunc(handleGetGeofenceEvents).Methods(http.MethodGet)
+	authenticatedAPIRoutes.Path("/geofences/{id}").HandlerFunc(handlePutGeofence).Methods(http.MethodPut)
+	authenticatedAPIRoutes.Path("/geofences/{id}").HandlerFunc(handleDeleteGeofence).Methods(http.MethodDelete)
+	authenticatedAPIRoutes.Path("/quarantine").HandlerFunc(handleGetQuarantine).Methods(http.MethodGet)
+	authenticatedAPIRoutes.Path("/quarantine/{key}/restore").HandlerFunc(handleRestoreQuarantined).Methods(http.MethodPost)
+	authenticatedAPIRoutes.Path("/quarantine/{key}").HandlerFunc(handleDeleteQuarantined).Methods(http.MethodDelete)
+	authenticatedAPIRoutes.Path("/catsnaps/uploads").HandlerFunc(handleGetCatsnapUploads).Methods(http.MethodGet)
+	authenticatedAPIRoutes.Path("/catsnaps/duplicates").HandlerFunc(handleGetCatsnapDuplicates).Methods(http.MethodGet)
+	authenticatedAPIRoutes.Path("/catsnaps/{key}").HandlerFunc(handlePatchCatSnap).Methods(http.MethodPatch)
+	authenticatedAPIRoutes.Path("/catsnaps/{key}").HandlerFunc(handleDeleteCatSnap).Methods(http.MethodDelete)
+	authenticatedAPIRoutes.Path("/live/sessions").HandlerFunc(handleGetLiveSessions).Methods(http.MethodGet)
+
+	adminRoutes := apiJSONRoutes.NewRoute().Subrouter()
+	adminRoutes.Use(tokenAuthenticationMiddleware, scopeMiddleware(func(*http.Request) string { return ScopeAdmin }))
+
+	adminRoutes.Path("/tokens").HandlerFunc(handleGetTokens).Methods(http.MethodGet)
+	adminRoutes.Path("/tokens").HandlerFunc(handleCreateToken).Methods(http.MethodPost)
+	adminRoutes.Path("/tokens/{id}/rotate").HandlerFunc(handleRotateToken).Methods(http.MethodPost)
+	adminRoutes.Path("/tokens/{id}/expire").HandlerFunc(handleExpireToken).Methods(http.MethodPost)
+	adminRoutes.Path("/tokens/{id}").HandlerFunc(handleRevokeToken).Methods(http.MethodDelete)
+	adminRoutes.Path("/shares").HandlerFunc(handleGetShareLinks).Methods(http.MethodGet)
+	adminRoutes.Path("/shares").HandlerFunc(handleCreateShareLink).Methods(http.MethodPost)
+	adminRoutes.Path("/shares/{id}").HandlerFunc(handleRevokeShareLink).Methods(http.MethodDelete)
+	// Where the privacy zones are gives away what they hide, so they're admin only.
+	adminRoutes.Path("/privacy-zones").HandlerFunc(handleGetPrivacyZones).Methods(http.MethodGet)
+	adminRoutes.Path("/privacy-zones").HandlerFunc(handlePutPrivacyZone).Methods(http.MethodPost)
+	adminRoutes.Path("/privacy-zones/{id}").HandlerFunc(handlePutPrivacyZone).Methods(http.MethodPut)
+	adminRoutes.Path("/privacy-zones/{id}").HandlerFunc(handleDeletePrivacyZone).Methods(http.MethodDelete)
+
+	populateRoutes := apiJSONRoutes.NewRoute().Subrouter()
+	populateRoutes.Use(tokenAuthenticationMiddleware, scopeMiddleware(func(*http.Request) string { return ScopePopulate }))
 
 	populateRoutes.Path("/populate/").HandlerFunc(populatePoints).Methods(http.MethodPost)
 	populateRoutes.Path("/populate").HandlerFunc(populatePoints).Methods(http.MethodPost)
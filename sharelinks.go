@@ -0,0 +1,398 @@
+package catTrackslib
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/paulmach/orb/geojson"
+	catnames "github.com/rotblauer/cattracks-names"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Share links let someone follow one cat for a while without a token: its last known position,
+// its recent track and its live feed, through the privacy zones as the public sees them, and nothing else.
+// A link can be limited to a window of the cat's points, and always expires.
+// The link's token is <id>.<expires>.<signature>, the signature an HMAC of the link's ID, cat and expiry,
+// so links can't be made up or changed. Links are kept in the share links bucket keyed by ID,
+// so they can be revoked, and their accesses counted. Following a link only reads the db.
+
+type ShareLinkOptions struct {
+	// Secret signs the links. If it's empty, one's made and kept in the database.
+	Secret string
+	// RecentTrack is how far back a link's track goes, when its window has no start.
+	// The track comes from the broadcasts kept for replay, so it goes no further back than their retention.
+	RecentTrack time.Duration
+}
+
+var DefaultShareLinkOptions = ShareLinkOptions{
+	RecentTrack: 12 * time.Hour,
+}
+
+var (
+	ErrShareLinkNotFound = errors.New("share link not found")
+	ErrInvalidShareLink  = errors.New("invalid share link")
+	ErrShareLinkRevoked  = errors.New("share link revoked")
+	ErrShareLinkExpired  = errors.New("share link expired")
+	errShareLinkInvalid  = errors.New("share link needs a cat, an expiry in the future, and a window that ends after it starts")
+)
+
+type ShareLink struct {
+	ID    string `json:"id"`
+	Label string `json:"label,omitempty"` // who, or what, it's for
+	// Cat is the cat shared, by name or alias.
+	Cat string `json:"cat"`
+	// Start and End are the window of the cat's points shown. Either can be left open.
+	Start   *time.Time `json:"start,omitempty"`
+	End     *time.Time `json:"end,omitempty"`
+	Expires time.Time  `json:"expires"`
+	Created time.Time  `json:"created"`
+	Revoked *time.Time `json:"revoked,omitempty"`
+
+	Accesses   int64      `json:"accesses"`
+	LastAccess *time.Time `json:"lastAccess,omitempty"`
+}
+
+// usable returns why the link can't be used now, if it can't.
+func (s *ShareLink) usable(now time.Time) error {
+	if s.Revoked != nil {
+		return ErrShareLinkRevoked
+	}
+	if !now.Before(s.Expires) {
+		return ErrShareLinkExpired
+	}
+	return nil
+}
+
+func (s *ShareLink) matchCat(name string) bool {
+	return s.Cat == name || s.Cat == catnames.AliasOrSanitizedName(name)
+}
+
+// inWindow reports whether a point at t is in the link's window.
+func (s *ShareLink) inWindow(t time.Time) bool {
+	if s.Start != nil && t.Before(*s.Start) {
+		return false
+	}
+	return s.End == nil || !t.After(*s.End)
+}
+
+// allows reports whether the link shows the feature: it's the cat's, and in the window.
+func (s *ShareLink) allows(f *geojson.Feature) bool {
+	name, _ := f.Properties["Name"].(string)
+	return s.matchCat(name) && s.inWindow(mustGetTime(f))
+}
+
+// features returns the features the link shows.
+func (s *ShareLink) features(features []*geojson.Feature) []*geojson.Feature {
+	out := []*geojson.Feature{}
+	for _, f := range features {
+		if s.allows(f) {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// The secret's read on every link followed, so it's cached, until the db changes.
+var (
+	shareLinkSecretCache []byte
+	shareLinkSecretDB    *bolt.DB
+	shareLinkSecretLock  sync.Mutex
+)
+
+// shareLinkSecret returns the key links are signed with.
+func shareLinkSecret() ([]byte, error) {
+	if shareLinkOptions.Secret != "" {
+		return []byte(shareLinkOptions.Secret), nil
+	}
+	shareLinkSecretLock.Lock()
+	defer shareLinkSecretLock.Unlock()
+	db := GetDB("master")
+	if shareLinkSecretDB == db {
+		return shareLinkSecretCache, nil
+	}
+	var secret []byte
+	db.View(func(tx *bolt.Tx) error {
+		secret = append(secret, tx.Bucket([]byte(secretsKey)).Get([]byte(shareLinksKey))...)
+		return nil
+	})
+	if len(secret) == 0 {
+		err := db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(secretsKey))
+			if v := b.Get([]byte(shareLinksKey)); v != nil {
+				secret = append(secret, v...)
+				return nil
+			}
+			secret = []byte(randomHex(32))
+			return b.Put([]byte(shareLinksKey), secret)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	shareLinkSecretCache, shareLinkSecretDB = secret, db
+	return secret, nil
+}
+
+func signShareLink(secret []byte, s *ShareLink) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%d", s.ID, s.Cat, s.Expires.Unix())
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// shareLinkToken returns the link's token.
+func shareLinkToken(s *ShareLink) (string, error) {
+	secret, err := shareLinkSecret()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s.%d.%s", s.ID, s.Expires.Unix(), signShareLink(secret, s)), nil
+}
+
+func putShareLink(tx *bolt.Tx, s *ShareLink) error {
+	v, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(shareLinksKey)).Put([]byte(s.ID), v)
+}
+
+func getShareLink(tx *bolt.Tx, id string) (*ShareLink, error) {
+	v := tx.Bucket([]byte(shareLinksKey)).Get([]byte(id))
+	if v == nil {
+		return nil, ErrShareLinkNotFound
+	}
+	s := &ShareLink{}
+	if err := json.Unmarshal(v, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// CreateShareLink makes a link to the cat, expiring then, and showing the window of its points, if there is one.
+// It returns the link's token with the link.
+func CreateShareLink(label, cat string, start, end *time.Time, expires time.Time) (string, *ShareLink, error) {
+	now := time.Now()
+	if cat == "" || !expires.After(now) || (start != nil && end != nil && !end.After(*start)) {
+		return "", nil, errShareLinkInvalid
+	}
+	s := &ShareLink{ID: randomHex(8), Label: label, Cat: cat, Start: start, End: end,
+		Expires: expires.Truncate(time.Second), Created: now}
+	token, err := shareLinkToken(s)
+	if err != nil {
+		return "", nil, err
+	}
+	err = GetDB("master").Update(func(tx *bolt.Tx) error {
+		return putShareLink(tx, s)
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return token, s, nil
+}
+
+// updateShareLink changes the stored link.
+func updateShareLink(id string, fn func(s *ShareLink) error) (*ShareLink, error) {
+	var s *ShareLink
+	err := GetDB("master").Update(func(tx *bolt.Tx) error {
+		var err error
+		if s, err = getShareLink(tx, id); err != nil {
+			return err
+		}
+		if err := fn(s); err != nil {
+			return err
+		}
+		return putShareLink(tx, s)
+	})
+	return s, err
+}
+
+func GetShareLink(id string) (*ShareLink, error) {
+	var s *ShareLink
+	err := GetDB("master").View(func(tx *bolt.Tx) error {
+		var err error
+		s, err = getShareLink(tx, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return withPendingAccesses(s), nil
+}
+
+// ListShareLinks returns all the links, revoked and expired too, newest first.
+func ListShareLinks() ([]*ShareLink, error) {
+	links := []*ShareLink{}
+	err := GetDB("master").View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(shareLinksKey)).ForEach(func(k, v []byte) error {
+			s := &ShareLink{}
+			if err := json.Unmarshal(v, s); err != nil {
+				log.Println("error reading share link:", err)
+				return nil
+			}
+			links = append(links, withPendingAccesses(s))
+			return nil
+		})
+	})
+	sort.Slice(links, func(i, j int) bool {
+		return links[i].Created.After(links[j].Created)
+	})
+	return links, err
+}
+
+// RevokeShareLink stops the link working for good. It's kept, to be listed.
+func RevokeShareLink(id string) (*ShareLink, error) {
+	return updateShareLink(id, func(s *ShareLink) error {
+		if s.Revoked == nil {
+			now := time.Now()
+			s.Revoked = &now
+		}
+		return nil
+	})
+}
+
+// authenticateShareLink returns the token's link, if it's signed and still usable, counting the access.
+func authenticateShareLink(token string, now time.Time) (*ShareLink, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidShareLink
+	}
+	id, sig := parts[0], parts[2]
+	if exp, err := strconv.ParseInt(parts[1], 10, 64); err != nil || !now.Before(time.Unix(exp, 0)) {
+		// Expired links are turned away without looking them up.
+		return nil, fmt.Errorf("%w: %w", ErrInvalidShareLink, ErrShareLinkExpired)
+	}
+	secret, err := shareLinkSecret()
+	if err != nil {
+		return nil, err
+	}
+	s, err := GetShareLink(id)
+	if errors.Is(err, ErrShareLinkNotFound) {
+		return nil, ErrInvalidShareLink
+	}
+	if err != nil {
+		return nil, err
+	}
+	want := fmt.Sprintf("%d.%s", s.Expires.Unix(), signShareLink(secret, s))
+	if subtle.ConstantTimeCompare([]byte(parts[1]+"."+sig), []byte(want)) != 1 {
+		return nil, ErrInvalidShareLink
+	}
+	if err := s.usable(now); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidShareLink, err)
+	}
+	countShareLinkAccess(s, now)
+	return s, nil
+}
+
+// Accesses are counted in memory, and written at most every shareLinkAccessesEvery,
+// so following a link doesn't take the db's write lock. Links read count the ones not written yet.
+const shareLinkAccessesEvery = time.Minute
+
+type shareLinkAccesses struct {
+	n    int64
+	last time.Time
+}
+
+var (
+	pendingShareLinkAccesses = map[string]shareLinkAccesses{}
+	shareLinkAccessesWritten time.Time
+	shareLinkAccessesLock    sync.Mutex
+)
+
+// countShareLinkAccess counts an access to the link, as read with its pending accesses, adding it to the link,
+// and writes the accesses counted so far if they're due.
+func countShareLinkAccess(s *ShareLink, now time.Time) {
+	shareLinkAccessesLock.Lock()
+	a := pendingShareLinkAccesses[s.ID]
+	a.n++
+	a.last = now
+	pendingShareLinkAccesses[s.ID] = a
+	s.Accesses++
+	s.LastAccess = &a.last
+	if now.Sub(shareLinkAccessesWritten) < shareLinkAccessesEvery {
+		shareLinkAccessesLock.Unlock()
+		return
+	}
+	pending := pendingShareLinkAccesses
+	pendingShareLinkAccesses = map[string]shareLinkAccesses{}
+	shareLinkAccessesWritten = now
+	shareLinkAccessesLock.Unlock()
+
+	err := GetDB("master").Update(func(tx *bolt.Tx) error {
+		for id, a := range pending {
+			s, err := getShareLink(tx, id)
+			if errors.Is(err, ErrShareLinkNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			s.Accesses += a.n
+			s.LastAccess = &a.last
+			if err := putShareLink(tx, s); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("error recording share link accesses:", err)
+	}
+}
+
+// withPendingAccesses adds the link's accesses not written yet.
+func withPendingAccesses(s *ShareLink) *ShareLink {
+	shareLinkAccessesLock.Lock()
+	defer shareLinkAccessesLock.Unlock()
+	if a, ok := pendingShareLinkAccesses[s.ID]; ok {
+		s.Accesses += a.n
+		last := a.last
+		s.LastAccess = &last
+	}
+	return s
+}
+
+// getShareTrack returns the link's cat's recent points, from the broadcasts kept for replay, oldest first.
+func getShareTrack(s *ShareLink, now time.Time) ([]*geojson.Feature, error) {
+	from := now.Add(-shareLinkOptions.RecentTrack)
+	if s.Start != nil {
+		from = *s.Start
+	}
+	track := []*geojson.Feature{}
+	_, _, err := replayBroadcasts(0, from, 0, func(sb storedBroadcast) {
+		if sb.Action != websocketActionPopulate {
+			return
+		}
+		for _, f := range s.features(sb.Features) {
+			if !mustGetTime(f).Before(from) {
+				track = append(track, f)
+			}
+		}
+	})
+	sort.SliceStable(track, func(i, j int) bool {
+		return mustGetTime(track[i]).Before(mustGetTime(track[j]))
+	})
+	return track, err
+}
+
+type shareLinkContextKey struct{}
+
+func withShareLink(ctx context.Context, s *ShareLink) context.Context {
+	return context.WithValue(ctx, shareLinkContextKey{}, s)
+}
+
+func shareLinkFromContext(ctx context.Context) *ShareLink {
+	s, _ := ctx.Value(shareLinkContextKey{}).(*ShareLink)
+	return s
+}
@@ -0,0 +1,140 @@
+package catTrackslib
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestShareLinks(t *testing.T) {
+	SetDBPath("master", filepath.Join(t.TempDir(), "m.db"))
+	if err := InitBoltDB(); err != nil {
+		t.Fatal(err)
+	}
+	defer GetDB("master").Close()
+	t.Setenv("COTOKEN", "legacy-secret")
+	shareLinkAccessesWritten = time.Time{}
+
+	now := time.Now()
+	later := now.Add(time.Hour)
+	for _, c := range []struct {
+		cat        string
+		start, end *time.Time
+		expires    time.Time
+	}{
+		{"", nil, nil, later},
+		{"rye", nil, nil, now.Add(-time.Minute)},
+		{"rye", &later, &now, later},
+	} {
+		if _, _, err := CreateShareLink("", c.cat, c.start, c.end, c.expires); !errors.Is(err, errShareLinkInvalid) {
+			t.Errorf("%+v: got %v, want invalid", c, err)
+		}
+	}
+
+	token, link, err := CreateShareLink("a friend", "rye", nil, nil, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err := authenticateShareLink(token, now); err != nil || s.ID != link.ID || s.Accesses != 1 {
+		t.Fatalf("got %+v, %v", s, err)
+	}
+	// Accesses are written a minute apart, and counted in between.
+	authenticateShareLink(token, now)
+	if s, err := authenticateShareLink(token, now.Add(time.Second)); err != nil || s.Accesses != 3 {
+		t.Errorf("got %+v, %v, want its third access", s, err)
+	}
+	var stored *ShareLink
+	GetDB("master").View(func(tx *bolt.Tx) error {
+		stored, _ = getShareLink(tx, link.ID)
+		return nil
+	})
+	if s, _ := GetShareLink(link.ID); stored.Accesses != 1 || s.Accesses != 3 || !s.LastAccess.Equal(now.Add(time.Second)) {
+		t.Errorf("got %d written and %+v read, want 1 and 3", stored.Accesses, s)
+	}
+	authenticateShareLink(token, now.Add(time.Minute))
+	GetDB("master").View(func(tx *bolt.Tx) error {
+		stored, _ = getShareLink(tx, link.ID)
+		return nil
+	})
+	if stored.Accesses != 4 {
+		t.Errorf("got %d written, want all 4 a minute on", stored.Accesses)
+	}
+	parts := strings.Split(token, ".")
+	for _, bad := range []string{"", "nope", parts[0] + "." + parts[1] + ".beef", parts[0] + ".9999999999." + parts[2]} {
+		if _, err := authenticateShareLink(bad, now); !errors.Is(err, ErrInvalidShareLink) {
+			t.Errorf("%q: got %v, want invalid", bad, err)
+		}
+	}
+	if _, err := authenticateShareLink(token, later); !errors.Is(err, ErrShareLinkExpired) {
+		t.Errorf("got %v, want expired", err)
+	}
+
+	// The shared cat's points, and another cat's, an hour ago and just now.
+	point := func(name string, at time.Time) *geojson.Feature {
+		f := geojson.NewFeature(orb.Point{-93.2, 44.9})
+		f.Properties["Name"] = name
+		f.Properties["UUID"] = name + "-uuid"
+		f.Properties["Time"] = at.UTC().Format(time.RFC3339)
+		return f
+	}
+	broadcastFeatures(websocketActionPopulate, []*geojson.Feature{point("rye", now.Add(-time.Hour)), point("ia", now.Add(-time.Hour))})
+	broadcastFeatures(websocketActionPopulate, []*geojson.Feature{point("rye", now)})
+	storeLastKnown(point("rye", now))
+	storeLastKnown(point("ia", now))
+
+	srv := httptest.NewServer(NewRouter(&RouterOpts{DisableWebsocket: true}))
+	defer srv.Close()
+	do := func(method, path, token, body string) (int, []byte) {
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		req.Header.Set("AuthorizationOfCats", token)
+		res, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := io.ReadAll(res.Body)
+		return res.StatusCode, b
+	}
+
+	code, b := do("POST", "/shares", "legacy-secret", `{"cat":"rye","start":"`+now.Add(-time.Minute).Format(time.RFC3339)+`","expires":"4h"}`)
+	created := createdShareLink{}
+	if err := json.Unmarshal(b, &created); code != http.StatusCreated || err != nil || !strings.HasSuffix(created.URL, "/share/"+created.Token) {
+		t.Fatalf("got %d %s", code, b)
+	}
+	share := "/share/" + created.Token
+
+	if code, b := do("GET", share+"/lastknown", "", ""); code != http.StatusOK || !strings.Contains(string(b), `"rye"`) {
+		t.Errorf("got %d %s, want rye's last known", code, b)
+	}
+	code, b = do("GET", share+"/track", "", "")
+	fc, err := geojson.UnmarshalFeatureCollection(b)
+	if code != http.StatusOK || err != nil || len(fc.Features) != 1 || fc.Features[0].Properties["Name"] != "rye" {
+		t.Errorf("got %d %s, want rye's point in the window", code, b)
+	}
+	if code, _ := do("GET", "/share/"+token+"/track", "", ""); code != http.StatusOK {
+		t.Errorf("got %d for the link without a window", code)
+	}
+	if code, _ := do("GET", "/geofences", created.Token, ""); code != http.StatusForbidden {
+		t.Errorf("got %d, want the link good for nothing else", code)
+	}
+
+	if code, _ := do("DELETE", "/shares/"+created.Info.ID, "legacy-secret", ""); code != http.StatusOK {
+		t.Errorf("got %d revoking", code)
+	}
+	if code, _ := do("GET", share+"/lastknown", "", ""); code != http.StatusGone {
+		t.Errorf("got %d, want the revoked link gone", code)
+	}
+	if s, _ := GetShareLink(created.Info.ID); s.Accesses != 2 || s.Revoked == nil {
+		t.Errorf("got %+v, want its 2 accesses counted", s)
+	}
+}
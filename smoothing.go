@@ -0,0 +1,386 @@
+package catTrackslib
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geo"
+	"github.com/paulmach/orb/geojson"
+)
+
+// Smoothed coordinates come from a per-cat Kalman filter over position and velocity,
+// fed by Accuracy, and by Speed and Heading (and their accuracies) when the phone reports them.
+// They're stored in the SmoothedLng, SmoothedLat and SmoothedAccuracy properties;
+// the geometry is always the raw fix.
+
+// SmoothingOptions configures the Kalman filter smoothing cats' tracks.
+type SmoothingOptions struct {
+	// ProcessNoise is the standard deviation of the acceleration (m/s²) the filter expects.
+	// Higher follows the fixes more closely, lower smooths more.
+	ProcessNoise float64
+	// MinAccuracy floors the Accuracy (m) of fixes, which phones can be optimistic about.
+	MinAccuracy float64
+	// MaxGap restarts the filter when there are no points for this long.
+	MaxGap time.Duration
+}
+
+var DefaultSmoothingOptions = SmoothingOptions{
+	ProcessNoise: 1.0,
+	MinAccuracy:  3,
+	MaxGap:       10 * time.Minute,
+}
+
+type mat4 [4][4]float64
+
+// kalmanFilter tracks one cat's position and velocity.
+// Position is kept as a lat/lng; the state's x and y are meters east and north
+// of it, so are zero between steps. Velocity is m/s east and north.
+type kalmanFilter struct {
+	opts   SmoothingOptions
+	origin orb.Point
+	x      [4]float64
+	p      mat4
+	last   time.Time
+}
+
+func newKalmanFilter(opts SmoothingOptions) *kalmanFilter {
+	return &kalmanFilter{opts: opts}
+}
+
+func (k *kalmanFilter) initialized() bool {
+	return !k.last.IsZero()
+}
+
+// reset starts the filter over at the fix, with unknown velocity.
+func (k *kalmanFilter) reset(pt orb.Point, acc float64, t time.Time) {
+	k.origin = pt
+	k.x = [4]float64{}
+	k.p = mat4{}
+	k.p[0][0], k.p[1][1] = acc*acc, acc*acc
+	// Unknown velocity, up to highway speeds.
+	k.p[2][2], k.p[3][3] = 30*30, 30*30
+	k.last = t
+}
+
+// toLocal returns meters east and north of the origin.
+func (k *kalmanFilter) toLocal(pt orb.Point) (float64, float64) {
+	kx := 111320 * math.Cos(k.origin.Lat()*math.Pi/180)
+	return (pt.Lon() - k.origin.Lon()) * kx, (pt.Lat() - k.origin.Lat()) * 110540
+}
+
+// recenter moves the origin to the current estimate, so the flat projection stays local.
+func (k *kalmanFilter) recenter() {
+	kx := 111320 * math.Cos(k.origin.Lat()*math.Pi/180)
+	k.origin = orb.Point{k.origin.Lon() + k.x[0]/kx, k.origin.Lat() + k.x[1]/110540}
+	k.x[0], k.x[1] = 0, 0
+}
+
+func (k *kalmanFilter) predict(dt float64) {
+	// x = F x
+	k.x[0] += k.x[2] * dt
+	k.x[1] += k.x[3] * dt
+
+	// P = F P Fᵀ + Q
+	f := mat4{{1, 0, dt, 0}, {0, 1, 0, dt}, {0, 0, 1, 0}, {0, 0, 0, 1}}
+	var fp, p mat4
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 4; j++ {
+			for l := 0; l < 4; l++ {
+				fp[i][j] += f[i][l] * k.p[l][j]
+			}
+		}
+	}
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 4; j++ {
+			for l := 0; l < 4; l++ {
+				p[i][j] += fp[i][l] * f[j][l]
+			}
+		}
+	}
+	q := k.opts.ProcessNoise * k.opts.ProcessNoise
+	dt2, dt3, dt4 := dt*dt, dt*dt*dt, dt*dt*dt*dt
+	for axis := 0; axis < 2; axis++ {
+		pos, vel := axis, axis+2
+		p[pos][pos] += q * dt4 / 4
+		p[pos][vel] += q * dt3 / 2
+		p[vel][pos] += q * dt3 / 2
+		p[vel][vel] += q * dt2
+	}
+	k.p = p
+}
+
+// update corrects the state with a measurement z of the state components a and b,
+// with measurement covariance r.
+func (k *kalmanFilter) update(a, b int, z [2]float64, r [2][2]float64) {
+	y := [2]float64{z[0] - k.x[a], z[1] - k.x[b]}
+	s := [2][2]float64{
+		{k.p[a][a] + r[0][0], k.p[a][b] + r[0][1]},
+		{k.p[b][a] + r[1][0], k.p[b][b] + r[1][1]},
+	}
+	det := s[0][0]*s[1][1] - s[0][1]*s[1][0]
+	if det <= 0 {
+		return
+	}
+	si := [2][2]float64{{s[1][1] / det, -s[0][1] / det}, {-s[1][0] / det, s[0][0] / det}}
+
+	// K = P Hᵀ S⁻¹
+	var kg [4][2]float64
+	for i := 0; i < 4; i++ {
+		kg[i][0] = k.p[i][a]*si[0][0] + k.p[i][b]*si[1][0]
+		kg[i][1] = k.p[i][a]*si[0][1] + k.p[i][b]*si[1][1]
+	}
+	for i := 0; i < 4; i++ {
+		k.x[i] += kg[i][0]*y[0] + kg[i][1]*y[1]
+	}
+	// P = (I - K H) P
+	var p mat4
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 4; j++ {
+			p[i][j] = k.p[i][j] - kg[i][0]*k.p[a][j] - kg[i][1]*k.p[b][j]
+		}
+	}
+	k.p = p
+}
+
+// velocityMeasurement returns the velocity (east, north) and its covariance from the
+// feature's Speed and Heading, if the phone reported them.
+// Derived ones come from the positions the filter already has, so they aren't measurements.
+func velocityMeasurement(f *geojson.Feature) ([2]float64, [2][2]float64, bool) {
+	speed, ok := featureFloat(f, "Speed")
+	if !ok || speed < 0 || isDerived(f, "Speed") {
+		return [2]float64{}, [2][2]float64{}, false
+	}
+	speedAcc, ok := featureFloat(f, "speed_accuracy")
+	if !ok || speedAcc <= 0 {
+		// Without a reported accuracy, take the speed with a pinch of salt.
+		speedAcc = 1 + speed*0.1
+	}
+	heading, okH := featureFloat(f, "Heading")
+	if !okH || heading < 0 || isDerived(f, "Heading") {
+		if speed > 0.5 {
+			// Direction unknown; a speed alone doesn't fit this filter.
+			return [2]float64{}, [2][2]float64{}, false
+		}
+		// Stopped: the direction doesn't matter.
+		v := speedAcc * speedAcc
+		return [2]float64{}, [2][2]float64{{v, 0}, {0, v}}, true
+	}
+	headingAcc, ok := featureFloat(f, "heading_accuracy")
+	if !ok || headingAcc <= 0 {
+		headingAcc = 30
+	}
+
+	h := heading * math.Pi / 180
+	sin, cos := math.Sin(h), math.Cos(h)
+	z := [2]float64{speed * sin, speed * cos}
+
+	// Uncertainty along the heading comes from the speed, and across it from the heading.
+	along := speedAcc * speedAcc
+	across := math.Pow(speed*headingAcc*math.Pi/180, 2) + 0.01
+	r := [2][2]float64{
+		{along*sin*sin + across*cos*cos, (along - across) * sin * cos},
+		{(along - across) * sin * cos, along*cos*cos + across*sin*sin},
+	}
+	return z, r, true
+}
+
+// push runs the filter forward to the feature, returning the smoothed position and its accuracy (m).
+func (k *kalmanFilter) push(f *geojson.Feature) (orb.Point, float64) {
+	pt := f.Geometry.(orb.Point)
+	t := mustGetTime(f)
+	acc, _ := featureFloat(f, "Accuracy")
+	acc = math.Max(acc, k.opts.MinAccuracy)
+
+	if !k.initialized() || t.Sub(k.last) > k.opts.MaxGap {
+		k.reset(pt, acc, t)
+	} else if dt := t.Sub(k.last).Seconds(); dt > 0 {
+		k.predict(dt)
+		k.last = t
+	}
+
+	zx, zy := k.toLocal(pt)
+	k.update(0, 1, [2]float64{zx, zy}, [2][2]float64{{acc * acc, 0}, {0, acc * acc}})
+	if z, r, ok := velocityMeasurement(f); ok {
+		k.update(2, 3, z, r)
+	}
+	k.recenter()
+	return k.origin, math.Sqrt((k.p[0][0] + k.p[1][1]) / 2)
+}
+
+// prediction returns where the filter expects the cat to be at t, without changing it.
+func (k *kalmanFilter) prediction(t time.Time) orb.Point {
+	dt := t.Sub(k.last).Seconds()
+	kx := 111320 * math.Cos(k.origin.Lat()*math.Pi/180)
+	return orb.Point{k.origin.Lon() + k.x[2]*dt/kx, k.origin.Lat() + k.x[3]*dt/110540}
+}
+
+// smoothers holds the live filters, by cat name, for points arriving through storePoints.
+var smoothers = map[string]*kalmanFilter{}
+var smoothersLock sync.Mutex
+
+// smoothPoints sets the smoothed coordinate properties of the features, which must be sorted by time.
+func smoothPoints(features []*geojson.Feature) {
+	smoothersLock.Lock()
+	defer smoothersLock.Unlock()
+
+	for _, f := range features {
+		name, _ := f.Properties["Name"].(string)
+		k, ok := smoothers[name]
+		if !ok {
+			k = newKalmanFilter(smoothingOptions)
+			smoothers[name] = k
+		}
+		if k.initialized() && !mustGetTime(f).After(k.last) {
+			// Out of order or duplicate; the stream is assumed chronological.
+			continue
+		}
+		pt, acc := k.push(f)
+		f.Properties["SmoothedLng"] = toFixed(pt.Lon(), 7)
+		f.Properties["SmoothedLat"] = toFixed(pt.Lat(), 7)
+		f.Properties["SmoothedAccuracy"] = toFixed(acc, 2)
+	}
+}
+
+// smoothedFeature returns a copy of the feature with its geometry moved to the smoothed coordinates,
+// if it has them. The raw coordinates are kept in the RawLng and RawLat properties.
+func smoothedFeature(f *geojson.Feature) *geojson.Feature {
+	lng, okLng := f.Properties["SmoothedLng"].(float64)
+	lat, okLat := f.Properties["SmoothedLat"].(float64)
+	pt, okPt := f.Geometry.(orb.Point)
+	if !okLng || !okLat || !okPt {
+		return f
+	}
+	out := geojson.NewFeature(orb.Point{lng, lat})
+	out.ID = f.ID
+	out.Properties = f.Properties.Clone()
+	out.Properties["RawLng"] = pt.Lon()
+	out.Properties["RawLat"] = pt.Lat()
+	return out
+}
+
+// wantSmoothed reports whether a query asked for smoothed geometries, eg. ?smoothed=true.
+func wantSmoothed(raw string) bool {
+	return raw == "true" || raw == "1"
+}
+
+// SmoothingReport summarizes how a smoothing filter did over an archive of tracks.
+// There's no ground truth in the archives, so the filter is judged by how well it predicts
+// each next fix compared to assuming the cat stayed put, and by how much it steadies the track.
+type SmoothingReport struct {
+	Cats   map[string]*SmoothingCatReport
+	Points int
+}
+
+type SmoothingCatReport struct {
+	Points int
+	// PredictionRMSE and PredictionMedian are the errors (m) of the filter's predictions of each next fix.
+	PredictionRMSE   float64
+	PredictionMedian float64
+	// NaiveRMSE is the error (m) of predicting each next fix to be where the last one was.
+	NaiveRMSE float64
+	// MeanCorrection is the mean distance (m) between raw and smoothed positions.
+	MeanCorrection float64
+	// RawLength and SmoothedLength are the total lengths (m) of the raw and smoothed tracks.
+	// Jitter makes raw tracks longer than the cat went.
+	RawLength      float64
+	SmoothedLength float64
+
+	predErrs   []float64
+	sumPred2   float64
+	sumNaive2  float64
+	nPred      int
+	sumCorrect float64
+	lastRaw    orb.Point
+	lastSmooth orb.Point
+}
+
+func (r *SmoothingCatReport) finish() {
+	if r.nPred > 0 {
+		r.PredictionRMSE = toFixed(math.Sqrt(r.sumPred2/float64(r.nPred)), 2)
+		r.NaiveRMSE = toFixed(math.Sqrt(r.sumNaive2/float64(r.nPred)), 2)
+		r.PredictionMedian = toFixed(median(r.predErrs), 2)
+	}
+	if r.Points > 0 {
+		r.MeanCorrection = toFixed(r.sumCorrect/float64(r.Points), 2)
+	}
+	r.RawLength = toFixed(r.RawLength, 0)
+	r.SmoothedLength = toFixed(r.SmoothedLength, 0)
+	r.predErrs = nil
+}
+
+func (r SmoothingReport) String() string {
+	names := make([]string, 0, len(r.Cats))
+	for name := range r.Cats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	sb := strings.Builder{}
+	fmt.Fprintf(&sb, "%d points, %d cats\n", r.Points, len(r.Cats))
+	fmt.Fprintf(&sb, "%-24s %8s %10s %10s %10s %10s %12s %12s\n",
+		"cat", "points", "pred-rmse", "pred-med", "naive-rmse", "correction", "raw-length", "smooth-length")
+	for _, name := range names {
+		c := r.Cats[name]
+		fmt.Fprintf(&sb, "%-24s %8d %10.2f %10.2f %10.2f %10.2f %12.0f %12.0f\n",
+			name, c.Points, c.PredictionRMSE, c.PredictionMedian, c.NaiveRMSE, c.MeanCorrection, c.RawLength, c.SmoothedLength)
+	}
+	return sb.String()
+}
+
+// BacktestSmoothing replays an archive of tracks (eg. master.json.gz) through fresh smoothing
+// filters with the given options, reporting error metrics per cat.
+// The archive is expected to be in time order per cat, as the archives written by storePoints are.
+func BacktestSmoothing(gzPath string, opts SmoothingOptions) (SmoothingReport, error) {
+	report := SmoothingReport{Cats: map[string]*SmoothingCatReport{}}
+	filters := map[string]*kalmanFilter{}
+
+	err := readGZFeatures(gzPath, func(f *geojson.Feature) error {
+		if validatePoint(f) != nil {
+			return nil
+		}
+		name := f.Properties["Name"].(string)
+		k, ok := filters[name]
+		if !ok {
+			k = newKalmanFilter(opts)
+			filters[name] = k
+			report.Cats[name] = &SmoothingCatReport{}
+		}
+		r := report.Cats[name]
+		t := mustGetTime(f)
+		if k.initialized() && !t.After(k.last) {
+			return nil
+		}
+		raw := f.Geometry.(orb.Point)
+
+		continuing := k.initialized() && t.Sub(k.last) <= opts.MaxGap
+		if continuing {
+			pred := geo.Distance(k.prediction(t), raw)
+			naive := geo.Distance(r.lastRaw, raw)
+			r.predErrs = append(r.predErrs, pred)
+			r.sumPred2 += pred * pred
+			r.sumNaive2 += naive * naive
+			r.nPred++
+		}
+
+		smoothed, _ := k.push(f)
+		if continuing {
+			r.RawLength += geo.Distance(r.lastRaw, raw)
+			r.SmoothedLength += geo.Distance(r.lastSmooth, smoothed)
+		}
+		r.sumCorrect += geo.Distance(raw, smoothed)
+		r.lastRaw, r.lastSmooth = raw, smoothed
+		r.Points++
+		report.Points++
+		return nil
+	})
+
+	for _, r := range report.Cats {
+		r.finish()
+	}
+	return report, err
+}
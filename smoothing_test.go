@@ -0,0 +1,95 @@
+package catTrackslib
+
+import (
+	"compress/gzip"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geo"
+	"github.com/paulmach/orb/geojson"
+)
+
+// noisyDrive returns a cat's true positions and the fixes its phone reported, driving
+// a loop at 15 m/s for 10 minutes, with fixes every 5 seconds scattered by about 10 meters.
+func noisyDrive(name string, rng *rand.Rand) ([]orb.Point, []*geojson.Feature) {
+	t0 := time.Date(2024, 3, 2, 15, 0, 0, 0, time.UTC)
+	truth := []orb.Point{}
+	fixes := []*geojson.Feature{}
+	pt := orb.Point{-93.25544, 44.98931}
+	heading := 0.0
+	for i := 0; i < 120; i++ {
+		heading += 3 // a gentle curve, all the way round over 10 minutes
+		pt = geo.PointAtBearingAndDistance(pt, heading, 15*5)
+		truth = append(truth, pt)
+
+		fix := geo.PointAtBearingAndDistance(pt, rng.Float64()*360, math.Abs(rng.NormFloat64())*10)
+		f := geojson.NewFeature(fix)
+		f.Properties = map[string]interface{}{
+			"Name":             name,
+			"UUID":             "05C63745-BFA3-4DE3-AF2F-CDE2173C0E11",
+			"Time":             t0.Add(time.Duration(i*5) * time.Second),
+			"Accuracy":         15.0,
+			"Speed":            15 + rng.NormFloat64(),
+			"speed_accuracy":   1.0,
+			"Heading":          math.Mod(heading+rng.NormFloat64()*5+360, 360),
+			"heading_accuracy": 5.0,
+		}
+		fixes = append(fixes, f)
+	}
+	return truth, fixes
+}
+
+func TestKalmanFilterSmoothing(t *testing.T) {
+	truth, fixes := noisyDrive("rye", rand.New(rand.NewSource(1)))
+	k := newKalmanFilter(DefaultSmoothingOptions)
+
+	var rawErr2, smoothErr2 float64
+	for i, f := range fixes {
+		smoothed, acc := k.push(f)
+		if i < 10 {
+			continue // let it settle
+		}
+		if acc <= 0 || acc > 15 {
+			t.Errorf("point %d: got smoothed accuracy %v", i, acc)
+		}
+		rawErr2 += math.Pow(geo.Distance(f.Geometry.(orb.Point), truth[i]), 2)
+		smoothErr2 += math.Pow(geo.Distance(smoothed, truth[i]), 2)
+	}
+	raw, smooth := math.Sqrt(rawErr2/110), math.Sqrt(smoothErr2/110)
+	t.Logf("raw RMSE %.2fm, smoothed RMSE %.2fm", raw, smooth)
+	if smooth > raw*0.8 {
+		t.Errorf("smoothing didn't help enough: raw RMSE %.2fm, smoothed RMSE %.2fm", raw, smooth)
+	}
+}
+
+func TestBacktestSmoothing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "master.json.gz")
+	gz := CreateGZ(path, gzip.BestCompression)
+	_, fixes := noisyDrive("rye", rand.New(rand.NewSource(2)))
+	for _, f := range fixes {
+		if err := gz.JE().Encode(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	CloseGZ(gz)
+
+	report, err := BacktestSmoothing(path, DefaultSmoothingOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log("\n" + report.String())
+	r := report.Cats["rye"]
+	if r == nil || r.Points != len(fixes) {
+		t.Fatalf("got report %+v, want %d points for rye", r, len(fixes))
+	}
+	if r.PredictionRMSE >= r.NaiveRMSE {
+		t.Errorf("got prediction RMSE %v, want less than naive %v", r.PredictionRMSE, r.NaiveRMSE)
+	}
+	if r.SmoothedLength >= r.RawLength {
+		t.Errorf("got smoothed length %v, want less than raw %v", r.SmoothedLength, r.RawLength)
+	}
+}
@@ -2,42 +2,398 @@ package catTrackslib
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/olahol/melody"
+	"github.com/paulmach/orb"
 	"github.com/paulmach/orb/geojson"
+	catnames "github.com/rotblauer/cattracks-names"
 )
 
 type websocketAction string
 
 var websocketActionPopulate websocketAction = "populate"
+var websocketActionGeofence websocketAction = "geofence"
+var websocketActionPresence websocketAction = "presence"
 
+// Actions for the subscribe protocol.
+var websocketActionSubscribe websocketAction = "subscribe"
+var websocketActionSubscribed websocketAction = "subscribed"
+var websocketActionReplayed websocketAction = "replayed"
+var websocketActionError websocketAction = "error"
+
+// websocketEventActions are the actions a session can subscribe to.
+var websocketEventActions = []websocketAction{websocketActionPopulate, websocketActionGeofence, websocketActionPresence}
+
+// broadcats is a live message. Seq is its number in the sequence of all broadcasts,
+// and PrevSeq the number of the last broadcast the session was sent, so a session can tell if it missed any.
+// The last pushes sent on connect have no Seq.
 type broadcats struct {
+	Seq      uint64             `json:"seq,omitempty"`
+	PrevSeq  uint64             `json:"prevSeq,omitempty"`
 	Action   websocketAction    `json:"action"`
 	Features []*geojson.Feature `json:"features"`
 }
 
+// websocketSubscription is what a session wants to hear about.
+// Sessions start out subscribed to everything, and narrow it down by sending
+//
+//	{"action": "subscribe", "cats": ["rye", "ia"], "bbox": [minLng, minLat, maxLng, maxLat], "events": ["populate"]}
+//
+// where each of cats (names, aliases or UUIDs), bbox and events is optional, and empty means any.
+// A subscribe replaces the last one; the server answers with a "subscribed" message holding the subscription,
+// followed by the last pushes matching it, or an "error" message.
+// The same filters can be given on connect as query params: /socat?cats=rye,ia&bbox=minLng,minLat,maxLng,maxLat&events=populate
+//
+// A subscribe with "since" (a sequence number) or "sinceTime" (RFC3339 or unix seconds) resumes instead:
+// the session is replayed the matching broadcasts after it, instead of the last pushes, then a
+// {"action": "replayed", "seq": <last replayed>, "more": <bool>} message. If there's more, the session
+// resumes again since that seq to get the rest; after the last of them it's live.
+// The same can be given on connect as the since or sinceTime query params.
+type websocketSubscription struct {
+	Cats   []string          `json:"cats,omitempty"`
+	BBox   []float64         `json:"bbox,omitempty"`
+	Events []websocketAction `json:"events,omitempty"`
+
+	bound *orb.Bound
+}
+
+type websocketMessage struct {
+	websocketSubscription
+	Action    websocketAction `json:"action"`
+	Since     uint64          `json:"since,omitempty"`
+	SinceTime string          `json:"sinceTime,omitempty"`
+}
+
+type websocketReply struct {
+	Action       websocketAction        `json:"action"`
+	Subscription *websocketSubscription `json:"subscription,omitempty"`
+	Seq          uint64                 `json:"seq,omitempty"`
+	More         bool                   `json:"more,omitempty"`
+	Error        string                 `json:"error,omitempty"`
+}
+
+func (sub *websocketSubscription) validate() error {
+	sub.bound = nil
+	if len(sub.BBox) > 0 {
+		if len(sub.BBox) != 4 {
+			return errors.New("bbox must be [minLng, minLat, maxLng, maxLat]")
+		}
+		sub.bound = &orb.Bound{Min: orb.Point{sub.BBox[0], sub.BBox[1]}, Max: orb.Point{sub.BBox[2], sub.BBox[3]}}
+	}
+	for _, e := range sub.Events {
+		known := false
+		for _, a := range websocketEventActions {
+			known = known || e == a
+		}
+		if !known {
+			return fmt.Errorf("unknown event type %q", e)
+		}
+	}
+	return nil
+}
+
+func (sub *websocketSubscription) wantsAction(action websocketAction) bool {
+	if len(sub.Events) == 0 {
+		return true
+	}
+	for _, e := range sub.Events {
+		if e == action {
+			return true
+		}
+	}
+	return false
+}
+
+func (sub *websocketSubscription) wantsFeature(f *geojson.Feature) bool {
+	if len(sub.Cats) > 0 {
+		name, _ := f.Properties["Name"].(string)
+		uuid, _ := f.Properties["UUID"].(string)
+		alias := catnames.AliasOrSanitizedName(name)
+		found := false
+		for _, c := range sub.Cats {
+			if c == name || c == alias || (uuid != "" && c == uuid) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if sub.bound != nil && f.Geometry != nil && !sub.bound.Intersects(f.Geometry.Bound()) {
+		return false
+	}
+	return true
+}
+
+// filter returns the features the subscription wants, for the action.
+func (sub *websocketSubscription) filter(action websocketAction, features []*geojson.Feature) []*geojson.Feature {
+	if !sub.wantsAction(action) {
+		return nil
+	}
+	if len(sub.Cats) == 0 && sub.bound == nil {
+		return features
+	}
+	out := []*geojson.Feature{}
+	for _, f := range features {
+		if sub.wantsFeature(f) {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// liveSession is a live client's subscription and place in the broadcast sequence,
+// shared by the websocket and server-sent events transports.
+type liveSession struct {
+	// send writes a broadcats or websocketReply to the client, returning false if it couldn't.
+	send func(v interface{}) bool
+	// owner is the token the client connected with, if any, for seeing its cats' points raw.
+	owner *APIToken
+	// share is the share link the client connected with, if any, limiting what it's sent.
+	share *ShareLink
+
+	mu  sync.Mutex
+	sub websocketSubscription
+	// lastSeq is the number of the last broadcast sent.
+	lastSeq uint64
+	// replaying is set while catching up, when live broadcasts are held in pending.
+	replaying bool
+	pending   []broadcats
+	overflow  bool
+}
+
+func (ls *liveSession) subscribe(sub websocketSubscription) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.sub = sub
+}
+
+// deliver writes the broadcast to the session, as it's allowed to see it, if it's subscribed to any of it,
+// through the session's owner's view of views.
+// Broadcasts are stored raw, so replays go through the privacy zones as they are now.
+// The caller must hold the session lock.
+func (ls *liveSession) deliver(bc broadcats, views privacyViews) {
+	features := bc.Features
+	if ls.share != nil {
+		if ls.share.usable(time.Now()) != nil {
+			return
+		}
+		features = ls.share.features(features)
+	}
+	matched := ls.sub.filter(bc.Action, views.of(ls.owner).features(features))
+	if len(matched) == 0 {
+		return
+	}
+	// If it isn't sent, the next one's PrevSeq tells the client.
+	if ls.send(broadcats{Seq: bc.Seq, PrevSeq: ls.lastSeq, Action: bc.Action, Features: matched}) && bc.Seq > 0 {
+		ls.lastSeq = bc.Seq
+	}
+}
+
+// live delivers a live broadcast, or holds it while the session is catching up.
+func (ls *liveSession) live(bc broadcats, views privacyViews) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if ls.replaying {
+		// Past a replay's worth they'll be replayed anyway.
+		if len(ls.pending) < replayOptions.MaxReplay {
+			ls.pending = append(ls.pending, bc)
+		} else {
+			ls.overflow = true
+		}
+		return
+	}
+	ls.deliver(bc, views)
+}
+
+// resume replays the broadcasts after the sequence number since (or time sinceTime) to the session,
+// returning true if there are more than one replay's worth.
+// Then the session stays catching up, until resumed again.
+func (ls *liveSession) resume(since uint64, sinceTime time.Time) (bool, error) {
+	ls.mu.Lock()
+	ls.replaying = true
+	if since > ls.lastSeq {
+		ls.lastSeq = since
+	}
+	ls.mu.Unlock()
+
+	views := privacyViews{}
+	last, more, err := replayBroadcasts(since, sinceTime, replayOptions.MaxReplay, func(sb storedBroadcast) {
+		ls.mu.Lock()
+		ls.deliver(sb.broadcats, views)
+		ls.mu.Unlock()
+	})
+	if last == 0 {
+		last = since
+	}
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	more = more || ls.overflow
+	pending := ls.pending
+	ls.pending, ls.overflow = nil, false
+	if err == nil {
+		ls.send(websocketReply{Action: websocketActionReplayed, Seq: last, More: more})
+	}
+	if more && err == nil {
+		// Still catching up; the held broadcasts will be replayed on the next resume.
+		return true, nil
+	}
+	// Live again; the held broadcasts not already replayed come next.
+	ls.replaying = false
+	for _, bc := range pending {
+		if bc.Seq == 0 || bc.Seq > last {
+			ls.deliver(bc, views)
+		}
+	}
+	return false, err
+}
+
+// sendLastPushes writes the cached last pushes matching the session's subscription.
+func (ls *liveSession) sendLastPushes() {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	views := privacyViews{}
+	for _, v := range lastPushTTLCache.Items() {
+		ls.deliver(broadcats{Action: websocketActionPopulate, Features: v.Value()}, views)
+	}
+}
+
+// handleSubscribe subscribes the session, then resumes it or sends it the last pushes.
+// It returns true if the session is still catching up.
+func (ls *liveSession) handleSubscribe(in websocketMessage, reply bool) bool {
+	sub := in.websocketSubscription
+	sinceTime, err := parseTimeParam(in.SinceTime)
+	if err == nil {
+		err = sub.validate()
+	}
+	if err != nil {
+		ls.send(websocketReply{Action: websocketActionError, Error: err.Error()})
+		return false
+	}
+	ls.subscribe(sub)
+	if reply {
+		ls.send(websocketReply{Action: websocketActionSubscribed, Subscription: &sub})
+	}
+	if in.Since == 0 && sinceTime.IsZero() {
+		ls.sendLastPushes()
+		return false
+	}
+	more, err := ls.resume(in.Since, sinceTime)
+	if err != nil {
+		log.Println("[live] replay error", err)
+		ls.send(websocketReply{Action: websocketActionError, Error: "replay failed"})
+	}
+	return more
+}
+
+// fillMetrics adds the session's subscription and place in the sequence to its metrics.
+func (ls *liveSession) fillMetrics(mt *LiveSessionMetrics) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	mt.Subscription = ls.sub
+	mt.LastSeq = ls.lastSeq
+}
+
+// websocketSession is our side of a melody session.
+type websocketSession struct {
+	*liveSession
+	s     *melody.Session
+	queue *websocketQueue
+}
+
+// newWebsocketSession sets up the session, and starts its queue pumping messages to melody.
+func newWebsocketSession(s *melody.Session) *websocketSession {
+	ws := &websocketSession{s: s, queue: newWebsocketQueue(websocketOptions)}
+	ws.liveSession = &liveSession{send: ws.queue.push, owner: requestToken(s.Request)}
+	go ws.queue.pump(s.Write)
+	return ws
+}
+
+var websocketSessions = map[*melody.Session]*websocketSession{}
+var websocketSessionsLock sync.RWMutex
+
+func getWebsocketSession(s *melody.Session) *websocketSession {
+	websocketSessionsLock.RLock()
+	defer websocketSessionsLock.RUnlock()
+	return websocketSessions[s]
+}
+
+// messageFromQuery reads a subscribe message from the connecting request's query params.
+func messageFromQuery(r *http.Request) (websocketMessage, error) {
+	msg := websocketMessage{Action: websocketActionSubscribe}
+	q := r.URL.Query()
+	if v := q.Get("since"); v != "" {
+		since, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return msg, fmt.Errorf("invalid since: %v", err)
+		}
+		msg.Since = since
+	}
+	msg.SinceTime = q.Get("sinceTime")
+	sub := &msg.websocketSubscription
+	if v := q.Get("cats"); v != "" {
+		sub.Cats = strings.Split(v, ",")
+	}
+	if v := q.Get("events"); v != "" {
+		for _, e := range strings.Split(v, ",") {
+			sub.Events = append(sub.Events, websocketAction(e))
+		}
+	}
+	bound, err := parseBBoxParam(q.Get("bbox"))
+	if err != nil {
+		return msg, err
+	}
+	if bound != nil {
+		sub.BBox = []float64{bound.Min.Lon(), bound.Min.Lat(), bound.Max.Lon(), bound.Max.Lat()}
+	}
+	return msg, nil
+}
+
 var m *melody.Melody
 
 // InitMelody sets up the websocket handler.
 func InitMelody() *melody.Melody {
 	m = melody.New()
+	m.Upgrader.EnableCompression = websocketOptions.Compression
 
-	// Incoming message about updated query params.
 	m.HandleConnect(func(s *melody.Session) {
 		log.Println("[websocket] connected", s.Request.RemoteAddr)
-		for _, v := range lastPushTTLCache.Items() {
-			features := v.Value()
-			bc := broadcats{
-				Action:   websocketActionPopulate,
-				Features: features,
-			}
-			b, _ := json.Marshal(bc)
-			s.Write(b)
+		ws := newWebsocketSession(s)
+		websocketSessionsLock.Lock()
+		websocketSessions[s] = ws
+		websocketSessionsLock.Unlock()
+
+		msg, err := messageFromQuery(s.Request)
+		if err != nil {
+			ws.send(websocketReply{Action: websocketActionError, Error: err.Error()})
+			ws.sendLastPushes()
+			return
 		}
+		ws.handleSubscribe(msg, false)
 	})
 	m.HandleDisconnect(func(s *melody.Session) {
 		log.Println("[websocket] disconnected", s.Request.RemoteAddr)
+		websocketSessionsLock.Lock()
+		if ws, ok := websocketSessions[s]; ok {
+			ws.queue.close()
+		}
+		delete(websocketSessions, s)
+		websocketSessionsLock.Unlock()
+	})
+	m.HandleSentMessage(func(s *melody.Session, _ []byte) {
+		if ws := getWebsocketSession(s); ws != nil {
+			ws.queue.markSent()
+		}
 	})
 	m.HandleError(func(s *melody.Session, e error) {
 		log.Println("[websocket] error", e, s.Request.RemoteAddr)
@@ -46,16 +402,56 @@ func InitMelody() *melody.Melody {
 	return m
 }
 
+// broadcastLock keeps broadcasts going out in the order of their sequence numbers.
+var broadcastLock sync.Mutex
+
+// broadcastFeatures stores the features for replay, and sends them to the live clients,
+// websocket and server-sent events, subscribed to them.
+func broadcastFeatures(action websocketAction, features []*geojson.Feature) {
+	broadcastLock.Lock()
+	defer broadcastLock.Unlock()
+
+	bc := broadcats{Action: action, Features: features}
+	if err := storeBroadcast(&bc); err != nil {
+		log.Println("[websocket] store broadcast error", err)
+	}
+
+	// Each owner's view, the public's included, is made once for all their sessions.
+	views := privacyViews{}
+	websocketSessionsLock.RLock()
+	for _, ws := range websocketSessions {
+		ws.live(bc, views)
+	}
+	websocketSessionsLock.RUnlock()
+
+	sseSessionsLock.RLock()
+	for ss := range sseSessions {
+		ss.live(bc, views)
+	}
+	sseSessionsLock.RUnlock()
+}
+
 // GetMelody does stuff
 func GetMelody() *melody.Melody {
 	return m
 }
 
-// on request
+// messageHandler handles the subscribe protocol.
 func messageHandler(s *melody.Session, msg []byte) {
 	log.Println("[websocket] message", string(msg))
+	ws := getWebsocketSession(s)
+	if ws == nil {
+		return
+	}
+	in := websocketMessage{}
+	if err := json.Unmarshal(msg, &in); err != nil {
+		ws.send(websocketReply{Action: websocketActionError, Error: "invalid message: " + err.Error()})
+		return
+	}
+	switch in.Action {
+	case websocketActionSubscribe:
+		ws.handleSubscribe(in, true)
+	default:
+		ws.send(websocketReply{Action: websocketActionError, Error: fmt.Sprintf("unknown action %q", in.Action)})
+	}
 }
-
-// on message
-
-// on connect?
@@ -0,0 +1,66 @@
+package catTrackslib
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+)
+
+func TestWebsocketSubscriptionFilter(t *testing.T) {
+	cat := func(name, uuid string, pt orb.Point) *geojson.Feature {
+		f := geojson.NewFeature(pt)
+		f.Properties["Name"] = name
+		f.Properties["UUID"] = uuid
+		return f
+	}
+	minneapolis := cat("Rye13", "rye-uuid", orb.Point{-93.25, 44.98})
+	montana := cat("tonga-moto-63b2", "ia-uuid", orb.Point{-111.69, 45.57})
+	features := []*geojson.Feature{minneapolis, montana}
+
+	cases := []struct {
+		name   string
+		msg    string
+		action websocketAction
+		want   []*geojson.Feature
+	}{
+		{"everything", `{"action":"subscribe"}`, websocketActionPopulate, features},
+		{"by name", `{"action":"subscribe","cats":["Rye13"]}`, websocketActionPopulate, []*geojson.Feature{minneapolis}},
+		{"by uuid", `{"action":"subscribe","cats":["ia-uuid"]}`, websocketActionPopulate, []*geojson.Feature{montana}},
+		{"by bbox", `{"action":"subscribe","bbox":[-94,44,-93,45]}`, websocketActionPopulate, []*geojson.Feature{minneapolis}},
+		{"cat outside bbox", `{"action":"subscribe","cats":["ia-uuid"],"bbox":[-94,44,-93,45]}`, websocketActionPopulate, []*geojson.Feature{}},
+		{"event wanted", `{"action":"subscribe","events":["geofence"]}`, websocketActionGeofence, features},
+		{"event unwanted", `{"action":"subscribe","events":["geofence"]}`, websocketActionPopulate, nil},
+	}
+	for _, tc := range cases {
+		in := websocketMessage{}
+		if err := json.Unmarshal([]byte(tc.msg), &in); err != nil {
+			t.Fatal(err)
+		}
+		sub := in.websocketSubscription
+		if err := sub.validate(); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		got := sub.filter(tc.action, features)
+		if len(got) != len(tc.want) {
+			t.Errorf("%s: got %d features, want %d", tc.name, len(got), len(tc.want))
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("%s: got %v, want %v", tc.name, got[i].Properties["Name"], tc.want[i].Properties["Name"])
+			}
+		}
+	}
+
+	for _, msg := range []string{`{"bbox":[1,2,3]}`, `{"events":["nope"]}`} {
+		in := websocketMessage{}
+		if err := json.Unmarshal([]byte(msg), &in); err != nil {
+			t.Fatal(err)
+		}
+		if err := in.websocketSubscription.validate(); err == nil {
+			t.Errorf("%s: want error", msg)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package catTrackslib
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/paulmach/orb/geojson"
+)
+
+// Each websocket session has its own bounded queue in front of melody's buffer, which drops messages
+// (with only an error to show for it) when it's full. Only a few messages at a time are handed to melody;
+// the rest wait in the queue. When a slow client lets its queue fill up, the queued populates are coalesced
+// into one holding only the latest point of each cat (or, by the drop policy, new messages are dropped).
+// Either way the client can tell from the next message's PrevSeq if it missed any.
+
+type WebsocketSlowPolicy string
+
+const (
+	WebsocketSlowCoalesce WebsocketSlowPolicy = "coalesce"
+	WebsocketSlowDrop     WebsocketSlowPolicy = "drop"
+)
+
+type WebsocketOptions struct {
+	// QueueSize is the most messages queued for a session.
+	// Keep it above ReplayOptions.MaxReplay, so catching up isn't coalesced.
+	QueueSize int
+	// MaxInFlight is the most messages handed to melody, and not yet sent, for a session.
+	// Keep it below melody's MessageBufferSize.
+	MaxInFlight int
+	// SlowPolicy is what's done when a session's queue is full.
+	SlowPolicy WebsocketSlowPolicy
+	// Compression negotiates permessage-deflate with clients that offer it.
+	Compression bool
+}
+
+var DefaultWebsocketOptions = WebsocketOptions{
+	QueueSize:   256,
+	MaxInFlight: 16,
+	SlowPolicy:  WebsocketSlowCoalesce,
+	Compression: false,
+}
+
+// LiveSessionMetrics describes a live session, for keeping an eye on slow clients.
+type LiveSessionMetrics struct {
+	Transport     string                `json:"transport"`
+	RemoteAddr    string                `json:"remoteAddr"`
+	Connected     time.Time             `json:"connected"`
+	Subscription  websocketSubscription `json:"subscription"`
+	LastSeq       uint64                `json:"lastSeq"`
+	QueueDepth    int                   `json:"queueDepth"`
+	MaxQueueDepth int                   `json:"maxQueueDepth"`
+	InFlight      int                   `json:"inFlight"`
+	Sent          int                   `json:"sent"`
+	Dropped       int                   `json:"dropped"`
+	Coalesced     int                   `json:"coalesced"`
+}
+
+// websocketQueue holds the messages (broadcats or websocketReply) waiting to be written to a session.
+type websocketQueue struct {
+	opts WebsocketOptions
+
+	mu        sync.Mutex
+	items     []interface{}
+	inFlight  int
+	maxDepth  int
+	sent      int
+	dropped   int
+	coalesced int
+	closed    bool
+	wake      chan struct{}
+	connected time.Time
+}
+
+func newWebsocketQueue(opts WebsocketOptions) *websocketQueue {
+	return &websocketQueue{opts: opts, wake: make(chan struct{}, 1), connected: time.Now()}
+}
+
+// push queues the message, returning false if it was dropped.
+func (q *websocketQueue) push(v interface{}) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return false
+	}
+	if q.opts.QueueSize > 0 && len(q.items) >= q.opts.QueueSize {
+		if q.opts.SlowPolicy != WebsocketSlowCoalesce {
+			q.dropped++
+			return false
+		}
+		q.items = append(q.items, v)
+		q.coalesce()
+		for len(q.items) > q.opts.QueueSize {
+			q.items = q.items[1:]
+			q.dropped++
+		}
+	} else {
+		q.items = append(q.items, v)
+	}
+	if len(q.items) > q.maxDepth {
+		q.maxDepth = len(q.items)
+	}
+	q.signal()
+	return true
+}
+
+// coalesce merges the queued populates into one, holding the latest point of each cat,
+// where the last of them was. The caller must hold the lock.
+func (q *websocketQueue) coalesce() {
+	var merged *broadcats
+	latest := map[string]*geojson.Feature{}
+	order := []string{}
+	at, n := -1, 0
+	for i, v := range q.items {
+		bc, ok := v.(broadcats)
+		if !ok || bc.Action != websocketActionPopulate {
+			continue
+		}
+		if merged == nil {
+			merged = &broadcats{PrevSeq: bc.PrevSeq, Action: websocketActionPopulate}
+		}
+		if bc.Seq > 0 {
+			merged.Seq = bc.Seq
+		}
+		for _, f := range bc.Features {
+			name, _ := f.Properties["Name"].(string)
+			if _, ok := latest[name]; !ok {
+				order = append(order, name)
+			}
+			latest[name] = f
+		}
+		at = i
+		n++
+	}
+	if n < 2 {
+		return
+	}
+	for _, name := range order {
+		merged.Features = append(merged.Features, latest[name])
+	}
+	items := make([]interface{}, 0, len(q.items)-n+1)
+	for i, v := range q.items {
+		if bc, ok := v.(broadcats); ok && bc.Action == websocketActionPopulate {
+			if i == at {
+				items = append(items, *merged)
+			}
+			continue
+		}
+		items = append(items, v)
+	}
+	q.coalesced += n - 1
+	q.items = items
+}
+
+func (q *websocketQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// markSent is called when melody has written one of the session's messages.
+func (q *websocketQueue) markSent() {
+	q.mu.Lock()
+	if q.inFlight > 0 {
+		q.inFlight--
+	}
+	q.sent++
+	q.mu.Unlock()
+	q.signal()
+}
+
+func (q *websocketQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.items = nil
+	q.mu.Unlock()
+	q.signal()
+}
+
+// pump hands queued messages to write, no more than MaxInFlight at a time, until the queue is closed.
+func (q *websocketQueue) pump(write func(b []byte) error) {
+	for range q.wake {
+		for {
+			q.mu.Lock()
+			if q.closed {
+				q.mu.Unlock()
+				return
+			}
+			if len(q.items) == 0 || (q.opts.MaxInFlight > 0 && q.inFlight >= q.opts.MaxInFlight) {
+				q.mu.Unlock()
+				break
+			}
+			v := q.items[0]
+			q.items = q.items[1:]
+			q.inFlight++
+			q.mu.Unlock()
+
+			b, err := json.Marshal(v)
+			if err != nil {
+				log.Println("[websocket] marshal error", err)
+				q.markSent()
+				continue
+			}
+			if err := write(b); err != nil {
+				q.close()
+				return
+			}
+		}
+	}
+}
+
+func (q *websocketQueue) metrics() LiveSessionMetrics {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return LiveSessionMetrics{
+		Connected:     q.connected,
+		QueueDepth:    len(q.items),
+		MaxQueueDepth: q.maxDepth,
+		InFlight:      q.inFlight,
+		Sent:          q.sent,
+		Dropped:       q.dropped,
+		Coalesced:     q.coalesced,
+	}
+}
+
+// getLiveSessionMetrics returns metrics for each live session, websocket and server-sent events.
+func getLiveSessionMetrics() []LiveSessionMetrics {
+	out := []LiveSessionMetrics{}
+	websocketSessionsLock.RLock()
+	for _, ws := range websocketSessions {
+		mt := ws.queue.metrics()
+		mt.Transport = "websocket"
+		mt.RemoteAddr = ws.s.Request.RemoteAddr
+		ws.fillMetrics(&mt)
+		out = append(out, mt)
+	}
+	websocketSessionsLock.RUnlock()
+
+	sseSessionsLock.RLock()
+	for ss := range sseSessions {
+		mt := ss.metrics()
+		ss.fillMetrics(&mt)
+		out = append(out, mt)
+	}
+	sseSessionsLock.RUnlock()
+	return out
+}
@@ -0,0 +1,76 @@
+package catTrackslib
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+)
+
+func TestWebsocketQueueSlowConsumer(t *testing.T) {
+	point := func(name string, lng float64) *geojson.Feature {
+		f := geojson.NewFeature(orb.Point{lng, 0})
+		f.Properties["Name"] = name
+		return f
+	}
+	populate := func(seq uint64, features ...*geojson.Feature) broadcats {
+		return broadcats{Seq: seq, PrevSeq: seq - 1, Action: websocketActionPopulate, Features: features}
+	}
+
+	q := newWebsocketQueue(WebsocketOptions{QueueSize: 3, SlowPolicy: WebsocketSlowCoalesce})
+	q.push(populate(1, point("rye", 1)))
+	q.push(broadcats{Seq: 2, PrevSeq: 1, Action: websocketActionGeofence})
+	q.push(populate(3, point("ia", 1), point("rye", 2)))
+	q.push(populate(4, point("rye", 3)))
+
+	mt := q.metrics()
+	if mt.QueueDepth != 2 || mt.Coalesced != 2 || mt.Dropped != 0 {
+		t.Fatalf("got %+v, want 2 queued, 2 coalesced", mt)
+	}
+	if q.items[0].(broadcats).Action != websocketActionGeofence {
+		t.Errorf("want the geofence event kept in place, got %+v", q.items[0])
+	}
+	merged := q.items[1].(broadcats)
+	if merged.PrevSeq != 0 || merged.Seq != 4 || len(merged.Features) != 2 {
+		t.Fatalf("want populates 1-4 merged, got %+v", merged)
+	}
+	if lng := merged.Features[0].Geometry.(orb.Point).Lon(); merged.Features[0].Properties["Name"] != "rye" || lng != 3 {
+		t.Errorf("want rye's latest point, got %v at %v", merged.Features[0].Properties["Name"], lng)
+	}
+
+	q = newWebsocketQueue(WebsocketOptions{QueueSize: 1, SlowPolicy: WebsocketSlowDrop})
+	if !q.push(populate(1, point("rye", 1))) || q.push(populate(2, point("rye", 2))) {
+		t.Error("want the second push dropped")
+	}
+	if mt := q.metrics(); mt.Dropped != 1 || mt.QueueDepth != 1 {
+		t.Errorf("got %+v, want 1 dropped", mt)
+	}
+
+	// Only MaxInFlight are handed over until they're sent.
+	q = newWebsocketQueue(WebsocketOptions{QueueSize: 10, MaxInFlight: 2})
+	written := make(chan []byte, 10)
+	go q.pump(func(b []byte) error {
+		written <- b
+		return nil
+	})
+	defer q.close()
+	for i := uint64(1); i <= 5; i++ {
+		q.push(populate(i, point("rye", float64(i))))
+	}
+	time.Sleep(50 * time.Millisecond)
+	if len(written) != 2 {
+		t.Fatalf("got %d written, want 2 in flight", len(written))
+	}
+	q.markSent()
+	q.markSent()
+	time.Sleep(50 * time.Millisecond)
+	if len(written) != 4 {
+		t.Fatalf("got %d written, want 4", len(written))
+	}
+	bc := broadcats{}
+	if err := json.Unmarshal(<-written, &bc); err != nil || bc.Seq != 1 {
+		t.Errorf("want seq 1 first, got %+v (%v)", bc, err)
+	}
+}
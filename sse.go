@@ -0,0 +1,183 @@
+package catTrackslib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// GET /events is a server-sent events feed of the same broadcasts as the websocket, for clients
+// where a websocket is awkward. Each broadcast is an event named for its action, with its sequence number
+// as the event ID and the broadcats JSON as data.
+// The cats, bbox and events query params filter it as they do the websocket's, and it resumes
+// from the Last-Event-ID header (as EventSource sends on reconnecting), or the since or sinceTime query params.
+// If there's more to catch up on than one replay's worth, the stream ends after a "replayed" event,
+// and the client reconnects to get the rest.
+
+const sseKeepAlive = 30 * time.Second
+
+type sseSession struct {
+	*liveSession
+	events chan []byte
+
+	remoteAddr string
+	connected  time.Time
+	dropped    int64
+}
+
+func newSSESession() *sseSession {
+	ss := &sseSession{events: make(chan []byte, replayOptions.MaxReplay+64), connected: time.Now()}
+	ss.liveSession = &liveSession{send: ss.queue}
+	return ss
+}
+
+func (ss *sseSession) metrics() LiveSessionMetrics {
+	return LiveSessionMetrics{
+		Transport:  "sse",
+		RemoteAddr: ss.remoteAddr,
+		Connected:  ss.connected,
+		QueueDepth: len(ss.events),
+		Dropped:    int(atomic.LoadInt64(&ss.dropped)),
+	}
+}
+
+// queue formats the broadcats or websocketReply as an event and queues it to be written,
+// returning false if the client isn't keeping up.
+func (ss *sseSession) queue(v interface{}) bool {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Println("[sse] marshal error", err)
+		return false
+	}
+	buf := &bytes.Buffer{}
+	switch x := v.(type) {
+	case broadcats:
+		if x.Seq > 0 {
+			fmt.Fprintf(buf, "id: %d\n", x.Seq)
+		}
+		fmt.Fprintf(buf, "event: %s\n", x.Action)
+	case websocketReply:
+		if x.Action == websocketActionReplayed {
+			// Move the client's Last-Event-ID past what it's been replayed, sent or not.
+			fmt.Fprintf(buf, "id: %d\n", x.Seq)
+			if x.More {
+				fmt.Fprintf(buf, "retry: %d\n", 100)
+			}
+		}
+		fmt.Fprintf(buf, "event: %s\n", x.Action)
+	}
+	fmt.Fprintf(buf, "data: %s\n\n", data)
+
+	select {
+	case ss.events <- buf.Bytes():
+		return true
+	default:
+		atomic.AddInt64(&ss.dropped, 1)
+		return false
+	}
+}
+
+var sseSessions = map[*sseSession]struct{}{}
+var sseSessionsLock sync.RWMutex
+
+func handleGetEvents(w http.ResponseWriter, r *http.Request) {
+	streamEvents(w, r, nil)
+}
+
+// streamEvents streams the live feed to the client, limited to the share link's cat and points if there is one.
+func streamEvents(w http.ResponseWriter, r *http.Request, share *ShareLink) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	msg, err := messageFromQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		if msg.Since, err = strconv.ParseUint(id, 10, 64); err != nil {
+			http.Error(w, "invalid Last-Event-ID: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if share != nil {
+		// Shared, it's the cat's points, and nothing else.
+		msg.Cats = []string{share.Cat}
+		msg.Events = []websocketAction{websocketActionPopulate}
+	}
+	sub := msg.websocketSubscription
+	if err := sub.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := parseTimeParam(msg.SinceTime); err != nil {
+		http.Error(w, "invalid sinceTime: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ss := newSSESession()
+	ss.remoteAddr = r.RemoteAddr
+	if share == nil {
+		ss.owner = requestToken(r)
+	}
+	ss.share = share
+	sseSessionsLock.Lock()
+	sseSessions[ss] = struct{}{}
+	sseSessionsLock.Unlock()
+	defer func() {
+		sseSessionsLock.Lock()
+		delete(sseSessions, ss)
+		sseSessionsLock.Unlock()
+	}()
+	log.Println("[sse] connected", r.RemoteAddr)
+	defer log.Println("[sse] disconnected", r.RemoteAddr)
+
+	if more := ss.handleSubscribe(msg, false); more {
+		// Write what's been replayed, and let the client come back for the rest.
+		for len(ss.events) > 0 {
+			w.Write(<-ss.events)
+		}
+		flusher.Flush()
+		return
+	}
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-ss.events:
+			if _, err := w.Write(ev); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepAlive.C:
+			if share != nil {
+				// The stream ends with the link, if it's revoked or expires.
+				if s, err := GetShareLink(share.ID); err != nil || s.usable(time.Now()) != nil {
+					return
+				}
+			}
+			if _, err := w.Write([]byte(": keepalive\n\n")); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package catTrackslib
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSSESessionQueue(t *testing.T) {
+	ss := newSSESession()
+	ss.queue(broadcats{Seq: 7, PrevSeq: 5, Action: websocketActionPopulate})
+	ss.queue(websocketReply{Action: websocketActionReplayed, Seq: 9, More: true})
+
+	want := []string{
+		"id: 7\nevent: populate\ndata: {\"seq\":7,\"prevSeq\":5,\"action\":\"populate\",\"features\":null}\n\n",
+		"id: 9\nretry: 100\nevent: replayed\ndata: {\"action\":\"replayed\",\"seq\":9,\"more\":true}\n\n",
+	}
+	for _, w := range want {
+		if got := string(<-ss.events); got != w {
+			t.Errorf("got event %q, want %q", got, w)
+		}
+	}
+
+	// A client not keeping up doesn't block.
+	for i := 0; i < cap(ss.events); i++ {
+		ss.queue(broadcats{Action: websocketActionPopulate})
+	}
+	if ss.queue(broadcats{Action: websocketActionPopulate}) {
+		t.Error("want queue to a full session to fail")
+	}
+	if !strings.HasPrefix(string(<-ss.events), "event: populate\n") {
+		t.Error("want events without a seq to have no id")
+	}
+}
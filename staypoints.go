@@ -0,0 +1,233 @@
+package catTrackslib
+
+import (
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geo"
+	"github.com/paulmach/orb/geojson"
+)
+
+// StayPointOptions configures stay-point detection, which finds visits in raw tracks
+// for cats whose apps don't report iOS visits.
+type StayPointOptions struct {
+	// Radius is the distance in meters a cat may wander from the centroid of a stay.
+	Radius float64
+	// MinDuration is how long a cat must stay within Radius to count as a visit.
+	MinDuration time.Duration
+	// MaxAccuracy ignores points less accurate than this (meters).
+	MaxAccuracy float64
+	// MaxGap ends a stay when there are no points for this long.
+	MaxGap time.Duration
+}
+
+var DefaultStayPointOptions = StayPointOptions{
+	Radius:      100,
+	MinDuration: 5 * time.Minute,
+	MaxAccuracy: 200,
+	MaxGap:      45 * time.Minute,
+}
+
+type stayPoint struct {
+	pt   orb.Point
+	acc  float64
+	time time.Time
+}
+
+// stayPointDetector accumulates one cat's points into a candidate stay.
+// The centroid of the stay is weighted by inverse accuracy variance,
+// so a few rough fixes won't drag it away from the good ones.
+type stayPointDetector struct {
+	opts     StayPointOptions
+	name     string
+	uuid     string
+	pts      []stayPoint
+	sumW     float64
+	centroid orb.Point
+}
+
+func newStayPointDetector(opts StayPointOptions, name, uuid string) *stayPointDetector {
+	return &stayPointDetector{opts: opts, name: name, uuid: uuid}
+}
+
+func stayPointWeight(acc float64) float64 {
+	// Floor accuracy so that a (claimed) perfect fix doesn't take infinite weight.
+	acc = math.Max(acc, 5)
+	return 1 / (acc * acc)
+}
+
+func (d *stayPointDetector) reset(p stayPoint) {
+	d.pts = []stayPoint{p}
+	d.sumW = stayPointWeight(p.acc)
+	d.centroid = p.pt
+}
+
+func (d *stayPointDetector) add(p stayPoint) {
+	w := stayPointWeight(p.acc)
+	d.sumW += w
+	d.centroid[0] += (p.pt[0] - d.centroid[0]) * w / d.sumW
+	d.centroid[1] += (p.pt[1] - d.centroid[1]) * w / d.sumW
+	d.pts = append(d.pts, p)
+}
+
+// push adds a point to the detector, returning a visit if the point ended a stay.
+func (d *stayPointDetector) push(f *geojson.Feature) (NoteVisit, bool) {
+	acc, _ := f.Properties["Accuracy"].(float64)
+	if acc > d.opts.MaxAccuracy {
+		return NoteVisit{}, false
+	}
+	p := stayPoint{pt: f.Geometry.(orb.Point), acc: acc, time: mustGetTime(f)}
+
+	if len(d.pts) == 0 {
+		d.reset(p)
+		return NoteVisit{}, false
+	}
+	last := d.pts[len(d.pts)-1]
+	if !p.time.After(last.time) {
+		// Out of order or duplicate; the stream is assumed chronological.
+		return NoteVisit{}, false
+	}
+
+	// A point's own uncertainty earns it some (bounded) tolerance.
+	within := geo.Distance(d.centroid, p.pt) <= d.opts.Radius+math.Min(p.acc, d.opts.Radius)
+	if within && p.time.Sub(last.time) <= d.opts.MaxGap {
+		d.add(p)
+		return NoteVisit{}, false
+	}
+
+	nv, ok := d.visit(p.time)
+	d.reset(p)
+	return nv, ok
+}
+
+// visit returns the current stay as a visit, if it lasted long enough.
+func (d *stayPointDetector) visit(reported time.Time) (NoteVisit, bool) {
+	first, last := d.pts[0], d.pts[len(d.pts)-1]
+	if last.time.Sub(first.time) < d.opts.MinDuration {
+		return NoteVisit{}, false
+	}
+
+	var radius, sumAcc float64
+	for _, p := range d.pts {
+		radius = math.Max(radius, geo.Distance(d.centroid, p.pt))
+		sumAcc += p.acc
+	}
+
+	return NoteVisit{
+		Uuid:          d.uuid,
+		Name:          d.name,
+		ArrivalTime:   first.time,
+		DepartureTime: last.time,
+		PlaceParsed: Place{
+			Lat:    d.centroid.Lat(),
+			Lng:    d.centroid.Lon(),
+			Acc:    toFixed(sumAcc/float64(len(d.pts)), 2),
+			Radius: toFixed(radius, 2),
+		},
+		Valid:        true,
+		Source:       visitSourceStayPoint,
+		ReportedTime: reported,
+	}, true
+}
+
+// stayPointState is a detector's stay in progress, as it's kept across restarts.
+type stayPointState struct {
+	UUID     string           `json:"uuid"`
+	Points   []stayPointSaved `json:"points"`
+	SumW     float64          `json:"sumW"`
+	Centroid orb.Point        `json:"centroid"`
+}
+
+type stayPointSaved struct {
+	Pt   orb.Point `json:"pt"`
+	Acc  float64   `json:"acc"`
+	Time time.Time `json:"time"`
+}
+
+func (d *stayPointDetector) state() stayPointState {
+	st := stayPointState{UUID: d.uuid, SumW: d.sumW, Centroid: d.centroid, Points: make([]stayPointSaved, 0, len(d.pts))}
+	for _, p := range d.pts {
+		st.Points = append(st.Points, stayPointSaved{p.pt, p.acc, p.time})
+	}
+	return st
+}
+
+func (d *stayPointDetector) restore(st stayPointState) {
+	d.uuid, d.sumW, d.centroid = st.UUID, st.SumW, st.Centroid
+	d.pts = make([]stayPoint, 0, len(st.Points))
+	for _, p := range st.Points {
+		d.pts = append(d.pts, stayPoint{p.Pt, p.Acc, p.Time})
+	}
+}
+
+// stayPointDetectors holds the live detectors, by cat name, for points arriving through storePoints.
+var stayPointDetectors = map[string]*stayPointDetector{}
+var stayPointDetectorsLock sync.Mutex
+
+// detectStayPoints feeds stored features through their cats' detectors,
+// storing any visits they complete, then keeps their stays in progress.
+func detectStayPoints(features []*geojson.Feature) {
+	stayPointDetectorsLock.Lock()
+	defer stayPointDetectorsLock.Unlock()
+
+	pushed := map[string]*stayPointDetector{}
+	for _, f := range features {
+		name, _ := f.Properties["Name"].(string)
+		d, ok := stayPointDetectors[name]
+		if !ok {
+			uuid, _ := f.Properties["UUID"].(string)
+			d = newStayPointDetector(stayPointOptions, name, uuid)
+			st := stayPointState{}
+			if getLiveState(liveStateStayPoints, name, &st) {
+				d.restore(st)
+			}
+			stayPointDetectors[name] = d
+		}
+		if nv, ok := d.push(f); ok {
+			if _, err := storeVisit(nv); err != nil {
+				log.Println("store stay point visit error:", err)
+			}
+		}
+		pushed[name] = d
+	}
+	states := map[string]any{}
+	for name, d := range pushed {
+		states[name] = d.state()
+	}
+	if err := putLiveStates(liveStateStayPoints, states); err != nil {
+		log.Println("store stay point state error:", err)
+	}
+}
+
+// BackfillStayPoints runs stay-point detection over an archive of tracks
+// (eg. master.json.gz), storing the visits found. It returns the number of visits stored.
+func BackfillStayPoints(gzPath string) (int, error) {
+	detectors := map[string]*stayPointDetector{}
+	n := 0
+	err := readGZFeatures(gzPath, func(f *geojson.Feature) error {
+		if validatePoint(f) != nil {
+			return nil
+		}
+		name := f.Properties["Name"].(string)
+		d, ok := detectors[name]
+		if !ok {
+			d = newStayPointDetector(stayPointOptions, name, f.Properties["UUID"].(string))
+			detectors[name] = d
+		}
+		if nv, ok := d.push(f); ok {
+			stored, err := storeVisit(nv)
+			if err != nil {
+				return err
+			}
+			if stored {
+				n++
+			}
+		}
+		return nil
+	})
+	log.Println("Backfilled", n, "stay point visits from", gzPath)
+	return n, err
+}
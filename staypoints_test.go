@@ -0,0 +1,55 @@
+package catTrackslib
+
+import (
+	"testing"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+)
+
+func TestStayPointDetector(t *testing.T) {
+	t0 := time.Date(2024, 3, 2, 15, 0, 0, 0, time.UTC)
+	point := func(lng, lat, acc float64, minutes int) *geojson.Feature {
+		f := geojson.NewFeature(orb.Point{lng, lat})
+		f.Properties = map[string]interface{}{
+			"Name":     "rye",
+			"UUID":     "05C63745-BFA3-4DE3-AF2F-CDE2173C0E11",
+			"Time":     t0.Add(time.Duration(minutes) * time.Minute),
+			"Accuracy": acc,
+		}
+		return f
+	}
+
+	d := newStayPointDetector(DefaultStayPointOptions, "rye", "05C63745-BFA3-4DE3-AF2F-CDE2173C0E11")
+	visits := []NoteVisit{}
+	push := func(f *geojson.Feature) {
+		if nv, ok := d.push(f); ok {
+			visits = append(visits, nv)
+		}
+	}
+
+	// Ten minutes puttering around a house, with one wild fix that should be ignored.
+	for i := 0; i <= 10; i++ {
+		push(point(-93.2554+float64(i%3)*0.0001, 44.9893, 10, i))
+	}
+	push(point(-93.3, 44.9, 2000, 11))
+	// Then leave, briefly stopping at a light (too short to be a visit).
+	push(point(-93.24, 44.9893, 10, 12))
+	push(point(-93.24, 44.9893, 10, 13))
+	push(point(-93.20, 44.9893, 10, 14))
+
+	if len(visits) != 1 {
+		t.Fatalf("got %d visits, want 1", len(visits))
+	}
+	nv := visits[0]
+	if !nv.ArrivalTime.Equal(t0) || !nv.DepartureTime.Equal(t0.Add(10*time.Minute)) {
+		t.Errorf("got arrival=%v departure=%v", nv.ArrivalTime, nv.DepartureTime)
+	}
+	if nv.Source != visitSourceStayPoint {
+		t.Errorf("got source=%q", nv.Source)
+	}
+	if nv.PlaceParsed.Lat != 44.9893 || nv.PlaceParsed.Lng > -93.2553 || nv.PlaceParsed.Lng < -93.2554 {
+		t.Errorf("got place=%+v", nv.PlaceParsed)
+	}
+}
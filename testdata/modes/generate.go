@@ -0,0 +1,148 @@
+//go:build ignore
+
+// generate writes labeled.ndgeojson, a synthetic track of one cat getting around by each
+// transport mode in turn, for testing the mode classifier offline.
+// Each point carries its true mode in the Label property, and an Activity as a phone
+// might report it: often empty or Unknown, and Automotive on the train.
+//
+//	go run testdata/modes/generate.go > testdata/modes/labeled.ndgeojson
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geo"
+	"github.com/paulmach/orb/geojson"
+)
+
+var (
+	rng     = rand.New(rand.NewSource(42))
+	enc     = json.NewEncoder(os.Stdout)
+	t       = time.Date(2024, 3, 2, 8, 0, 0, 0, time.UTC)
+	pt      = orb.Point{-93.25544, 44.98931}
+	heading = 0.0
+	speed   = 0.0
+)
+
+type segment struct {
+	label    string
+	activity string
+	duration time.Duration
+	every    time.Duration
+	acc      float64
+	motion   float64 // mean user acceleration magnitude, g
+	rotation float64 // mean rotation rate magnitude, rad/s
+	// step updates speed and heading for the elapsed seconds in the segment.
+	step func(elapsed float64)
+}
+
+func noisy(mean, sd float64) float64 {
+	return math.Max(0, mean+rng.NormFloat64()*sd)
+}
+
+func main() {
+	segments := []segment{
+		{"Stationary", "Stationary", 5 * time.Minute, 10 * time.Second, 15, 0.01, 0.01, func(float64) {
+			speed = 0
+		}},
+		{"Walking", "", 8 * time.Minute, 5 * time.Second, 8, 0.25, 0.6, func(float64) {
+			speed = noisy(1.4, 0.2)
+			heading += rng.NormFloat64() * 15
+		}},
+		{"Running", "Unknown", 6 * time.Minute, 5 * time.Second, 8, 0.9, 1.5, func(float64) {
+			speed = noisy(3.2, 0.4)
+			heading += rng.NormFloat64() * 10
+		}},
+		{"Cycling", "", 8 * time.Minute, 5 * time.Second, 8, 0.15, 0.3, func(float64) {
+			speed = noisy(5.5, 1)
+			heading += rng.NormFloat64() * 8
+		}},
+		{"Automotive", "Automotive", 10 * time.Minute, 5 * time.Second, 10, 0.05, 0.1, func(elapsed float64) {
+			// City blocks: pull away, cruise, brake, wait at the light, turn.
+			c := math.Mod(elapsed, 75)
+			switch {
+			case c < 10:
+				speed = c * 1.3
+			case c < 40:
+				speed = noisy(13, 1)
+			case c < 50:
+				speed = (50 - c) * 1.3
+			default:
+				speed = 0
+			}
+			if c >= 70 && c < 75 {
+				heading += 90
+			}
+		}},
+		{"Automotive", "Automotive", 8 * time.Minute, 5 * time.Second, 10, 0.04, 0.1, func(elapsed float64) {
+			// Highway: keeping up with traffic, changing lanes, gentle curves.
+			speed = noisy(30+2*math.Sin(elapsed/20), 1)
+			heading += rng.NormFloat64() * 2
+		}},
+		{"Train", "Automotive", 15 * time.Minute, 5 * time.Second, 10, 0.02, 0.02, func(elapsed float64) {
+			// Between stations: a long smooth pull, cruise, and stop.
+			c := math.Mod(elapsed, 450)
+			switch {
+			case c < 90:
+				speed = c * 0.45
+			case c < 360:
+				speed = noisy(40, 0.3)
+			case c < 420:
+				speed = (420 - c) * 0.67
+			default:
+				speed = 0
+			}
+			heading += rng.NormFloat64() * 0.3
+		}},
+		{"Flying", "Unknown", 10 * time.Minute, 10 * time.Second, 10, 0.03, 0.02, func(float64) {
+			speed = noisy(230, 3)
+			heading += rng.NormFloat64() * 0.2
+		}},
+		{"Stationary", "", 5 * time.Minute, 10 * time.Second, 25, 0.01, 0.01, func(float64) {
+			speed = 0
+		}},
+	}
+
+	for _, seg := range segments {
+		for elapsed := time.Duration(0); elapsed < seg.duration; elapsed += seg.every {
+			seg.step(elapsed.Seconds())
+			t = t.Add(seg.every)
+			pt = geo.PointAtBearingAndDistance(pt, heading, speed*seg.every.Seconds())
+
+			// What the phone sees: fixes scattered around the truth, and some shaking.
+			fix := geo.PointAtBearingAndDistance(pt, rng.Float64()*360, math.Abs(rng.NormFloat64())*seg.acc/3)
+			motion := noisy(seg.motion, seg.motion/3)
+			rotation := noisy(seg.rotation, seg.rotation/3)
+			reportedSpeed := -1.0
+			if rng.Float64() < 0.7 {
+				reportedSpeed = math.Round(noisy(speed, 0.3)*100) / 100
+			}
+
+			f := geojson.NewFeature(orb.Point{math.Round(fix[0]*1e7) / 1e7, math.Round(fix[1]*1e7) / 1e7})
+			f.Properties = map[string]interface{}{
+				"Name":               "rye",
+				"UUID":               "05C63745-BFA3-4DE3-AF2F-CDE2173C0E11",
+				"Time":               t.Format(time.RFC3339),
+				"Accuracy":           seg.acc,
+				"Speed":              reportedSpeed,
+				"Heading":            -1,
+				"Activity":           seg.activity,
+				"UserAccelerometerX": math.Round(motion*0.6*1e4) / 1e4,
+				"UserAccelerometerY": math.Round(motion*0.8*1e4) / 1e4,
+				"UserAccelerometerZ": 0,
+				"GyroscopeX":         math.Round(rotation*1e4) / 1e4,
+				"GyroscopeY":         0,
+				"GyroscopeZ":         0,
+				"Label":              seg.label,
+			}
+			if err := enc.Encode(f); err != nil {
+				panic(err)
+			}
+		}
+	}
+}
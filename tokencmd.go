@@ -0,0 +1,111 @@
+package catTrackslib
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// RunTokenCommand runs a token subcommand, for wiring into a binary as, say, `cattracks token ...`:
+//
+//	create -label <label> [-cat <name>] [-uuid <uuid>] -scopes populate,read,admin [-expires 720h]
+//	list
+//	rotate <id>
+//	revoke <id>
+//	expire <id> [<when>]   (a duration from now, a time, or never; now if it's left out)
+//
+// The master database must be open.
+func RunTokenCommand(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("want a token command: create, list, rotate, revoke or expire")
+	}
+	cmd, args := args[0], args[1:]
+	switch cmd {
+	case "create":
+		fs := flag.NewFlagSet("token create", flag.ContinueOnError)
+		fs.SetOutput(out)
+		label := fs.String("label", "", "what, or who, the token is for")
+		cat := fs.String("cat", "", "the cat the token can populate as, by name or alias")
+		uuid := fs.String("uuid", "", "the device UUID the token can populate as")
+		scopes := fs.String("scopes", ScopePopulate, "comma-separated scopes: populate, read, admin")
+		expires := fs.String("expires", "", "when the token expires: a duration from now, like 720h, or a time")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		at, err := parseTokenExpiry(*expires, time.Now())
+		if err != nil {
+			return fmt.Errorf("invalid expires: %w", err)
+		}
+		token, t, err := CreateAPIToken(*label, *cat, *uuid, strings.Split(*scopes, ","), at)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Created token %s for %q. It won't be shown again:\n%s\n", t.ID, t.Label, token)
+		return nil
+
+	case "list":
+		tokens, err := ListAPITokens()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tLABEL\tCAT\tSCOPES\tCREATED\tEXPIRES\tLAST USED\tSTATUS")
+		for _, t := range tokens {
+			status := "ok"
+			if err := t.usable(time.Now()); err != nil {
+				status = err.Error()
+			}
+			lastUsed := "never"
+			if t.LastUsed != nil {
+				lastUsed = t.LastUsed.Format(time.RFC3339) + " from " + t.LastUsedIP
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", t.ID, t.Label, t.Cat, strings.Join(t.Scopes, ","),
+				t.Created.Format(time.RFC3339), formatTokenTime(t.Expires), lastUsed, status)
+		}
+		return tw.Flush()
+
+	case "rotate", "revoke", "expire":
+		if len(args) == 0 {
+			return fmt.Errorf("want: token %s <id>", cmd)
+		}
+		id := args[0]
+		switch cmd {
+		case "rotate":
+			token, _, err := RotateAPIToken(id)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "Rotated token %s. The old one no longer works; the new one won't be shown again:\n%s\n", id, token)
+		case "revoke":
+			if err := RevokeAPIToken(id); err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "Revoked token %s\n", id)
+		case "expire":
+			at := time.Now()
+			if len(args) > 1 {
+				var err error
+				if at, err = parseTokenExpiry(args[1], at); err != nil {
+					return fmt.Errorf("invalid expiry: %w", err)
+				}
+			}
+			if err := ExpireAPIToken(id, at); err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "Token %s expires %s\n", id, formatTokenTime(&at))
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown token command %q", cmd)
+}
+
+func formatTokenTime(t *time.Time) string {
+	if t == nil || t.IsZero() {
+		return "never"
+	}
+	return t.Format(time.RFC3339)
+}
@@ -0,0 +1,366 @@
+package catTrackslib
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/paulmach/orb/geojson"
+	catnames "github.com/rotblauer/cattracks-names"
+	bolt "go.etcd.io/bbolt"
+)
+
+// API tokens are given to cats' devices, and to people, each with scopes for what it can do:
+// populate, to push points (as its cat, if it has one), read, for the authenticated GETs, and admin, for everything.
+// Tokens look like ct_<id>_<secret>. Only a hash of the token is kept, in the API tokens bucket keyed by its ID.
+// COTOKEN, if set, is a legacy token with every scope.
+
+const (
+	ScopePopulate = "populate"
+	ScopeRead     = "read"
+	ScopeAdmin    = "admin"
+
+	apiTokenPrefix = "ct_"
+)
+
+var (
+	ErrInvalidToken  = errors.New("invalid token")
+	ErrTokenNotFound = errors.New("token not found")
+	ErrInvalidScope  = errors.New("invalid scope")
+	ErrTokenRevoked  = errors.New("token revoked")
+	ErrTokenExpired  = errors.New("token expired")
+	errTokenWrongCat = errors.New("token can't populate as this cat")
+)
+
+// APIToken is a token as it's kept, without its secret.
+type APIToken struct {
+	ID    string `json:"id"`
+	Label string `json:"label"` // what, or who, it's for, like a phone
+	// Cat and UUID limit populating to the cat's points, by name or alias, and to the device's, if they're set.
+	Cat     string    `json:"cat,omitempty"`
+	UUID    string    `json:"uuid,omitempty"`
+	Scopes  []string  `json:"scopes"`
+	Hash    string    `json:"-"`
+	Created time.Time `json:"created"`
+
+	Rotated    *time.Time `json:"rotated,omitempty"`
+	Expires    *time.Time `json:"expires,omitempty"`
+	Revoked    *time.Time `json:"revoked,omitempty"`
+	LastUsed   *time.Time `json:"lastUsed,omitempty"`
+	LastUsedIP string     `json:"lastUsedIP,omitempty"`
+}
+
+// apiTokenRecord is the APIToken as it's stored, with its hash.
+type apiTokenRecord struct {
+	APIToken
+	Hash string `json:"hash"`
+}
+
+// HasScope reports whether the token has the scope. Admin tokens have them all.
+func (t *APIToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// usable returns why the token can't be used now, if it can't.
+func (t *APIToken) usable(now time.Time) error {
+	if t.Revoked != nil {
+		return ErrTokenRevoked
+	}
+	if t.Expires != nil && !now.Before(*t.Expires) {
+		return ErrTokenExpired
+	}
+	return nil
+}
+
+// canPopulate checks the features all belong to the token's cat and device, if it has them.
+func (t *APIToken) canPopulate(features []*geojson.Feature) error {
+	if !t.HasScope(ScopePopulate) {
+		return fmt.Errorf("%w: want scope %s", ErrInvalidScope, ScopePopulate)
+	}
+	for _, f := range features {
+		name, _ := f.Properties["Name"].(string)
+		uuid, _ := f.Properties["UUID"].(string)
+		if t.Cat != "" && name != t.Cat && catnames.AliasOrSanitizedName(name) != t.Cat {
+			return fmt.Errorf("%w: got Name %q", errTokenWrongCat, name)
+		}
+		if t.UUID != "" && uuid != t.UUID {
+			return fmt.Errorf("%w: got UUID %q", errTokenWrongCat, uuid)
+		}
+	}
+	return nil
+}
+
+func validScope(scope string) bool {
+	return scope == ScopePopulate || scope == ScopeRead || scope == ScopeAdmin
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseToken returns the ID from a token of the ct_<id>_<secret> form.
+func parseToken(token string) (id string, ok bool) {
+	rest, ok := strings.CutPrefix(token, apiTokenPrefix)
+	if !ok {
+		return "", false
+	}
+	id, secret, ok := strings.Cut(rest, "_")
+	return id, ok && id != "" && secret != ""
+}
+
+func newToken(id string) string {
+	return apiTokenPrefix + id + "_" + randomHex(24)
+}
+
+func putAPIToken(tx *bolt.Tx, t *APIToken) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(apiTokensKey))
+	if err != nil {
+		return err
+	}
+	v, err := json.Marshal(apiTokenRecord{APIToken: *t, Hash: t.Hash})
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(t.ID), v)
+}
+
+func getAPIToken(tx *bolt.Tx, id string) (*APIToken, error) {
+	b := tx.Bucket([]byte(apiTokensKey))
+	if b == nil {
+		return nil, ErrTokenNotFound
+	}
+	v := b.Get([]byte(id))
+	if v == nil {
+		return nil, ErrTokenNotFound
+	}
+	rec := apiTokenRecord{}
+	if err := json.Unmarshal(v, &rec); err != nil {
+		return nil, err
+	}
+	rec.APIToken.Hash = rec.Hash
+	return &rec.APIToken, nil
+}
+
+// CreateAPIToken makes a new token with the scopes, limited to populating as the cat and device if they're given,
+// and working until it expires. The zero time means never.
+// It returns the token, which is all there is of its secret, so it has to be handed over now.
+func CreateAPIToken(label, cat, uuid string, scopes []string, expires time.Time) (string, *APIToken, error) {
+	if len(scopes) == 0 {
+		return "", nil, fmt.Errorf("%w: want at least one", ErrInvalidScope)
+	}
+	for _, s := range scopes {
+		if !validScope(s) {
+			return "", nil, fmt.Errorf("%w: %q", ErrInvalidScope, s)
+		}
+	}
+	t := &APIToken{ID: randomHex(8), Label: label, Cat: cat, UUID: uuid, Scopes: scopes, Created: time.Now()}
+	if !expires.IsZero() {
+		t.Expires = &expires
+	}
+	token := newToken(t.ID)
+	t.Hash = hashToken(token)
+	err := GetDB("master").Update(func(tx *bolt.Tx) error {
+		return putAPIToken(tx, t)
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return token, t, nil
+}
+
+// haveAPITokens reports whether any tokens have been made.
+func haveAPITokens() bool {
+	have := false
+	GetDB("master").View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(apiTokensKey)); b != nil {
+			k, _ := b.Cursor().First()
+			have = k != nil
+		}
+		return nil
+	})
+	return have
+}
+
+// legacyToken is COTOKEN's token.
+var legacyToken = &APIToken{ID: "COTOKEN", Label: "COTOKEN", Scopes: []string{ScopeAdmin}}
+
+// authenticateToken returns the token's APIToken, or ErrInvalidToken.
+func authenticateToken(token string) (*APIToken, error) {
+	if token == "" {
+		return nil, ErrInvalidToken
+	}
+	if legacy := os.Getenv("COTOKEN"); legacy != "" && subtle.ConstantTimeCompare([]byte(token), []byte(legacy)) == 1 {
+		return legacyToken, nil
+	}
+	id, ok := parseToken(token)
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	var t *APIToken
+	err := GetDB("master").View(func(tx *bolt.Tx) error {
+		var err error
+		t, err = getAPIToken(tx, id)
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, ErrTokenNotFound) {
+			return nil, ErrInvalidToken
+		}
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(t.Hash)) != 1 {
+		return nil, ErrInvalidToken
+	}
+	if err := t.usable(time.Now()); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+	return t, nil
+}
+
+// apiTokenTouchEvery is how often a token's last use is written, unless it's used from somewhere new.
+const apiTokenTouchEvery = time.Minute
+
+// touchAPIToken records the token's use, from the IP.
+func touchAPIToken(t *APIToken, ip string, now time.Time) {
+	if t == legacyToken || (t.LastUsed != nil && now.Sub(*t.LastUsed) < apiTokenTouchEvery && t.LastUsedIP == ip) {
+		return
+	}
+	err := updateAPIToken(t.ID, func(t *APIToken) error {
+		t.LastUsed, t.LastUsedIP = &now, ip
+		return nil
+	})
+	if err != nil {
+		log.Println("error recording token use:", err)
+	}
+}
+
+// updateAPIToken changes the stored token.
+func updateAPIToken(id string, fn func(t *APIToken) error) error {
+	return GetDB("master").Update(func(tx *bolt.Tx) error {
+		t, err := getAPIToken(tx, id)
+		if err != nil {
+			return err
+		}
+		if err := fn(t); err != nil {
+			return err
+		}
+		return putAPIToken(tx, t)
+	})
+}
+
+// GetAPIToken returns the token with the ID.
+func GetAPIToken(id string) (*APIToken, error) {
+	var t *APIToken
+	err := GetDB("master").View(func(tx *bolt.Tx) error {
+		var err error
+		t, err = getAPIToken(tx, id)
+		return err
+	})
+	return t, err
+}
+
+// ListAPITokens returns all the tokens, revoked and expired too, oldest first.
+func ListAPITokens() ([]*APIToken, error) {
+	tokens := []*APIToken{}
+	err := GetDB("master").View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(apiTokensKey))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			t, err := getAPIToken(tx, string(k))
+			if err != nil {
+				log.Println("error reading token:", err)
+				return nil
+			}
+			tokens = append(tokens, t)
+			return nil
+		})
+	})
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].Created.Before(tokens[j].Created)
+	})
+	return tokens, err
+}
+
+// RotateAPIToken gives the token a new secret, keeping everything else, and returns the new token.
+// The old one stops working straight away.
+func RotateAPIToken(id string) (string, *APIToken, error) {
+	token := newToken(id)
+	var rotated *APIToken
+	err := updateAPIToken(id, func(t *APIToken) error {
+		if t.Revoked != nil {
+			return ErrTokenRevoked
+		}
+		now := time.Now()
+		t.Hash, t.Rotated = hashToken(token), &now
+		rotated = t
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return token, rotated, nil
+}
+
+// RevokeAPIToken stops the token working for good. It's kept, to be listed.
+func RevokeAPIToken(id string) error {
+	return updateAPIToken(id, func(t *APIToken) error {
+		if t.Revoked == nil {
+			now := time.Now()
+			t.Revoked = &now
+		}
+		return nil
+	})
+}
+
+// ExpireAPIToken sets when the token stops working. The zero time means never.
+func ExpireAPIToken(id string, at time.Time) error {
+	return updateAPIToken(id, func(t *APIToken) error {
+		if at.IsZero() {
+			t.Expires = nil
+		} else {
+			t.Expires = &at
+		}
+		return nil
+	})
+}
+
+// parseTokenExpiry parses when a token expires: a duration from now, like 720h, a time as parseTimeParam takes,
+// or never.
+func parseTokenExpiry(raw string, now time.Time) (time.Time, error) {
+	if raw == "" || raw == "never" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(raw); err == nil {
+		return now.Add(d), nil
+	}
+	return parseTimeParam(raw)
+}
+
+type apiTokenContextKey struct{}
+
+func withAPIToken(ctx context.Context, t *APIToken) context.Context {
+	return context.WithValue(ctx, apiTokenContextKey{}, t)
+}
+
+// apiTokenFromContext returns the request's token, or nil if it wasn't authenticated.
+func apiTokenFromContext(ctx context.Context) *APIToken {
+	t, _ := ctx.Value(apiTokenContextKey{}).(*APIToken)
+	return t
+}
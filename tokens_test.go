@@ -0,0 +1,196 @@
+package catTrackslib
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPITokens(t *testing.T) {
+	SetDBPath("master", filepath.Join(t.TempDir(), "m.db"))
+	if err := InitBoltDB(); err != nil {
+		t.Fatal(err)
+	}
+	defer GetDB("master").Close()
+	t.Setenv("COTOKEN", "legacy-secret")
+	// Populating keeps the last pushes beside the tracks, which without them is the working directory.
+	wd, _ := os.Getwd()
+	os.Chdir(t.TempDir())
+	defer os.Chdir(wd)
+
+	if _, _, err := CreateAPIToken("phone", "", "", []string{"everything"}, time.Time{}); !errors.Is(err, ErrInvalidScope) {
+		t.Errorf("got %v, want invalid scope", err)
+	}
+	ryeToken, rye, err := CreateAPIToken("rye's phone", "rye", "", []string{ScopePopulate}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readToken, _, _ := CreateAPIToken("dashboard", "", "", []string{ScopeRead}, time.Time{})
+
+	if got, err := authenticateToken(ryeToken); err != nil || got.ID != rye.ID || got.Cat != "rye" {
+		t.Errorf("got %+v, %v", got, err)
+	}
+	id, _ := parseToken(ryeToken)
+	for _, bad := range []string{"", "nope", apiTokenPrefix + id + "_wrong", apiTokenPrefix + "missing_secret"} {
+		if _, err := authenticateToken(bad); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%q: got %v, want invalid", bad, err)
+		}
+	}
+	if got, err := authenticateToken("legacy-secret"); err != nil || !got.HasScope(ScopePopulate) || !got.HasScope(ScopeAdmin) {
+		t.Errorf("want COTOKEN a superuser, got %+v, %v", got, err)
+	}
+
+	srv := httptest.NewServer(NewRouter(&RouterOpts{DisableWebsocket: true}))
+	defer srv.Close()
+	do := func(method, path, token, body string) int {
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		req.Header.Set("AuthorizationOfCats", token)
+		res, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	point := func(name string) string {
+		return `[{"type":"Feature","geometry":{"type":"Point","coordinates":[-93.25,44.98]},"properties":{"Name":"` + name +
+			`","UUID":"rye-uuid","Time":"` + now.Format(time.RFC3339) + `","Accuracy":5}}]`
+	}
+	lastKnown := func(name string) bool {
+		b, _ := getLastKnownData()
+		lk := LastKnownGeoJSON{}
+		json.Unmarshal(b, &lk)
+		f, ok := lk[name]
+		return ok && mustGetTime(f).Equal(now)
+	}
+	stored := map[string]bool{}
+	for _, c := range []struct {
+		method, path, token, body string
+		want                      int
+		stores                    string // the cat whose point is stored, if it is
+	}{
+		{"GET", "/geofences", "", "", http.StatusForbidden, ""},
+		{"GET", "/geofences", readToken, "", http.StatusOK, ""},
+		{"DELETE", "/geofences/nope", readToken, "", http.StatusForbidden, ""},
+		{"GET", "/geofences", ryeToken, "", http.StatusForbidden, ""},
+		{"POST", "/populate", readToken, point("rye"), http.StatusForbidden, ""},
+		{"POST", "/populate", ryeToken, point("ia"), http.StatusForbidden, ""},
+		{"POST", "/populate", ryeToken, point("rye"), http.StatusOK, "rye"},
+		{"POST", "/populate", "legacy-secret", point("ia"), http.StatusOK, "ia"},
+	} {
+		if got := do(c.method, c.path, c.token, c.body); got != c.want {
+			t.Errorf("%s %s with %.12q: got %d, want %d", c.method, c.path, c.token, got, c.want)
+		}
+		stored[c.stores] = true
+		for _, name := range []string{"rye", "ia"} {
+			if got := lastKnown(name); got != stored[name] {
+				t.Errorf("%s %s with %.12q: got %s's point stored %v, want %v", c.method, c.path, c.token, name, got, stored[name])
+			}
+		}
+	}
+}
+
+func TestAPITokenAdmin(t *testing.T) {
+	SetDBPath("master", filepath.Join(t.TempDir(), "m.db"))
+	if err := InitBoltDB(); err != nil {
+		t.Fatal(err)
+	}
+	defer GetDB("master").Close()
+
+	out := &bytes.Buffer{}
+	if err := RunTokenCommand([]string{"create", "-label", "rye's phone", "-cat", "rye", "-scopes", "populate,read"}, out); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	token := lines[len(lines)-1]
+	rye, err := authenticateToken(token)
+	if err != nil || rye.Label != "rye's phone" || !rye.HasScope(ScopeRead) {
+		t.Fatalf("got %+v, %v", rye, err)
+	}
+
+	rotated, _, err := RotateAPIToken(rye.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authenticateToken(token); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("want the old token gone, got %v", err)
+	}
+	if _, err := authenticateToken(rotated); err != nil {
+		t.Errorf("want the rotated token working, got %v", err)
+	}
+
+	if err := ExpireAPIToken(rye.ID, time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authenticateToken(rotated); !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("got %v, want expired", err)
+	}
+	ExpireAPIToken(rye.ID, time.Time{})
+	if expired, _, err := CreateAPIToken("old phone", "rye", "", []string{ScopePopulate}, time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	} else if _, err := authenticateToken(expired); !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("got %v, want created expired", err)
+	}
+	if err := RevokeAPIToken(rye.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authenticateToken(rotated); !errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("got %v, want revoked", err)
+	}
+	if _, _, err := RotateAPIToken(rye.ID); !errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("got %v, want revoked tokens not rotated", err)
+	}
+	if err := RevokeAPIToken("nope"); !errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("got %v, want not found", err)
+	}
+
+	// Over HTTP, with an admin token, which records where it was used.
+	admin, _, _ := CreateAPIToken("me", "", "", []string{ScopeAdmin}, time.Time{})
+	srv := httptest.NewServer(NewRouter(&RouterOpts{DisableWebsocket: true}))
+	defer srv.Close()
+	do := func(method, path, token, body string) (int, []byte) {
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		req.Header.Set("AuthorizationOfCats", token)
+		req.Header.Set("X-Forwarded-For", "203.0.113.7, 10.0.0.1")
+		res, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := io.ReadAll(res.Body)
+		return res.StatusCode, b
+	}
+	code, b := do("POST", "/tokens", admin, `{"label":"dashboard","scopes":["read"],"expires":"720h"}`)
+	created := createdToken{}
+	if err := json.Unmarshal(b, &created); code != http.StatusCreated || err != nil || created.Info.Expires == nil {
+		t.Fatalf("got %d %s", code, b)
+	}
+	if code, _ := do("GET", "/tokens", created.Token, ""); code != http.StatusForbidden {
+		t.Errorf("got %d, want tokens admin only", code)
+	}
+	if code, _ := do("POST", "/tokens/"+created.Info.ID+"/expire", admin, ""); code != http.StatusOK {
+		t.Errorf("got %d expiring", code)
+	}
+	if code, _ := do("GET", "/geofences", created.Token, ""); code != http.StatusForbidden {
+		t.Errorf("got %d, want the expired token refused", code)
+	}
+	if code, _ := do("DELETE", "/tokens/nope", admin, ""); code != http.StatusNotFound {
+		t.Errorf("got %d revoking nothing", code)
+	}
+	if code, b := do("GET", "/tokens", admin, ""); code != http.StatusOK || strings.Contains(string(b), `"hash"`) {
+		t.Errorf("got %d %s, want the tokens without their hashes", code, b)
+	}
+	me, _ := authenticateToken(admin)
+	if me.LastUsed == nil || me.LastUsedIP != "203.0.113.7" {
+		t.Errorf("got last used %v from %q", me.LastUsed, me.LastUsedIP)
+	}
+}
@@ -0,0 +1,458 @@
+package catTrackslib
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geo"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/simplify"
+	catnames "github.com/rotblauer/cattracks-names"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Trips are stretches of a cat's track between stops.
+// They are stored in the trips bucket keyed by cat name and start time.
+
+const tripModeUnknown = "Unknown"
+
+// TripOptions configures how a cat's point stream is cut into trips.
+type TripOptions struct {
+	// MaxGap ends a trip when there are no points for this long.
+	MaxGap time.Duration
+	// DwellRadius and DwellDuration end a trip when the cat stays within
+	// DwellRadius meters for DwellDuration.
+	DwellRadius   float64
+	DwellDuration time.Duration
+	// ModeChangeDuration ends a trip when a new Activity persists for this long.
+	ModeChangeDuration time.Duration
+	// MaxAccuracy ignores points less accurate than this (meters).
+	MaxAccuracy float64
+	// MinDistance drops trips shorter than this (meters).
+	MinDistance float64
+	// SimplifyTolerance is the Douglas-Peucker threshold (meters) for stored geometries.
+	SimplifyTolerance float64
+}
+
+var DefaultTripOptions = TripOptions{
+	MaxGap:             15 * time.Minute,
+	DwellRadius:        75,
+	DwellDuration:      5 * time.Minute,
+	ModeChangeDuration: 2 * time.Minute,
+	MaxAccuracy:        100,
+	MinDistance:        250,
+	SimplifyTolerance:  10,
+}
+
+type Trip struct {
+	Name       string         `json:"name"`
+	UUID       string         `json:"uuid"`
+	Start      time.Time      `json:"start"`
+	End        time.Time      `json:"end"`
+	Distance   float64        `json:"distance"` // meters
+	Duration   time.Duration  `json:"duration"`
+	Mode       string         `json:"mode"` // dominant reported Activity
+	BBox       orb.Bound      `json:"bbox"`
+	Geometry   orb.LineString `json:"geometry"`
+	PointCount int            `json:"pointCount"`
+
+	// InferredMode is the mode voted for by the points' inferred modes.
+	InferredMode           string  `json:"inferredMode,omitempty"`
+	InferredModeConfidence float64 `json:"inferredModeConfidence,omitempty"`
+	// SmoothedGeometry is the simplified track of the points' smoothed coordinates.
+	SmoothedGeometry orb.LineString `json:"smoothedGeometry,omitempty"`
+}
+
+type tripsQuery struct {
+	Cat      string
+	Start    time.Time
+	End      time.Time
+	Smoothed bool
+}
+
+type tripPoint struct {
+	pt       orb.Point
+	smoothed orb.Point
+	time     time.Time
+	activity string // the reported Activity, or the inferred mode if that's not helpful
+
+	inferred     string
+	inferredConf float64
+}
+
+// isMovingActivity reports whether the Activity label names a way of getting around.
+func isMovingActivity(activity string) bool {
+	return activity != "" && activity != "Stationary" && activity != tripModeUnknown
+}
+
+// tripSegmenter accumulates one cat's points into the trip in progress.
+type tripSegmenter struct {
+	opts TripOptions
+	name string
+	uuid string
+	pts  []tripPoint
+
+	// anchor is the index of the first point of the current (possible) dwell:
+	// the cat hasn't left DwellRadius around it since.
+	anchor int
+	// dwelling is set once a dwell has ended a trip, until the cat leaves dwellAt.
+	dwelling bool
+	dwellAt  orb.Point
+
+	// mode is the Activity of the trip so far, and pending a different one
+	// seen since index pendingFrom.
+	mode        string
+	pending     string
+	pendingFrom int
+}
+
+func newTripSegmenter(opts TripOptions, name, uuid string) *tripSegmenter {
+	return &tripSegmenter{opts: opts, name: name, uuid: uuid}
+}
+
+// push adds a point to the segmenter, returning any trips the point completed.
+func (s *tripSegmenter) push(f *geojson.Feature) []Trip {
+	acc, _ := f.Properties["Accuracy"].(float64)
+	if acc > s.opts.MaxAccuracy {
+		return nil
+	}
+	activity, _ := f.Properties["Activity"].(string)
+	p := tripPoint{pt: f.Geometry.(orb.Point), time: mustGetTime(f), activity: activity}
+	p.smoothed = p.pt
+	if lng, ok := f.Properties["SmoothedLng"].(float64); ok {
+		p.smoothed[0] = lng
+	}
+	if lat, ok := f.Properties["SmoothedLat"].(float64); ok {
+		p.smoothed[1] = lat
+	}
+	p.inferred, _ = f.Properties["InferredMode"].(string)
+	p.inferredConf, _ = f.Properties["InferredModeConfidence"].(float64)
+
+	if len(s.pts) == 0 {
+		s.reset([]tripPoint{p})
+		return nil
+	}
+	last := s.pts[len(s.pts)-1]
+	if !p.time.After(last.time) {
+		// Out of order or duplicate; the stream is assumed chronological.
+		return nil
+	}
+
+	trips := []Trip{}
+	if p.time.Sub(last.time) > s.opts.MaxGap {
+		trips = s.cut(len(s.pts), trips)
+		s.reset([]tripPoint{p})
+		return trips
+	}
+
+	// Is the cat still stopped? The next trip leaves from the last point here.
+	if s.dwelling {
+		if geo.Distance(s.dwellAt, p.pt) <= s.opts.DwellRadius {
+			s.reset([]tripPoint{p})
+			s.dwelling = true
+			return trips
+		}
+		s.dwelling = false
+	}
+
+	s.pts = append(s.pts, p)
+
+	// Has the cat stopped?
+	if geo.Distance(s.pts[s.anchor].pt, p.pt) > s.opts.DwellRadius {
+		s.anchor = len(s.pts) - 1
+	} else if p.time.Sub(s.pts[s.anchor].time) >= s.opts.DwellDuration {
+		// The trip ended when the dwell began.
+		trips = s.cut(s.anchor+1, trips)
+		s.dwellAt = s.pts[s.anchor].pt
+		s.reset([]tripPoint{p})
+		s.dwelling = true
+		return trips
+	}
+
+	// Has the cat changed the way it's getting around?
+	mode := p.mode()
+	if !isMovingActivity(mode) {
+		return trips
+	}
+	switch {
+	case s.mode == "" || mode == s.mode:
+		s.mode = mode
+		s.pending = ""
+	case mode != s.pending:
+		s.pending = mode
+		s.pendingFrom = len(s.pts) - 1
+	case p.time.Sub(s.pts[s.pendingFrom].time) >= s.opts.ModeChangeDuration:
+		// Split where the new mode started, sharing the point so the trips connect.
+		i := s.pendingFrom
+		trips = s.cut(i+1, trips)
+		s.reset(s.pts[i:])
+		s.mode = mode
+	}
+	return trips
+}
+
+// mode is the point's reported Activity, falling back to its inferred mode when the Activity isn't telling.
+func (p tripPoint) mode() string {
+	if isMovingActivity(p.activity) || p.activity == modeStationary {
+		return p.activity
+	}
+	return p.inferred
+}
+
+// reset starts a new trip in progress with the given points.
+func (s *tripSegmenter) reset(pts []tripPoint) {
+	s.pts = append([]tripPoint{}, pts...)
+	s.anchor = 0
+	s.dwelling = false
+	s.mode, s.pending, s.pendingFrom = "", "", 0
+	for _, p := range s.pts {
+		if isMovingActivity(p.mode()) {
+			s.mode = p.mode()
+		}
+	}
+}
+
+// cut appends the trip made of the first n points in progress to trips, if it's long enough to count.
+func (s *tripSegmenter) cut(n int, trips []Trip) []Trip {
+	if trip, ok := s.trip(s.pts[:n]); ok {
+		trips = append(trips, trip)
+	}
+	return trips
+}
+
+// trip builds a trip from the points.
+func (s *tripSegmenter) trip(pts []tripPoint) (Trip, bool) {
+	if len(pts) < 2 {
+		return Trip{}, false
+	}
+
+	trip := Trip{
+		Name:       s.name,
+		UUID:       s.uuid,
+		Start:      pts[0].time,
+		End:        pts[len(pts)-1].time,
+		PointCount: len(pts),
+	}
+	trip.Duration = trip.End.Sub(trip.Start)
+
+	ls := make(orb.LineString, 0, len(pts))
+	sls := make(orb.LineString, 0, len(pts))
+	modes := map[string]time.Duration{}
+	inferred := make([]string, 0, len(pts))
+	inferredConfs := make([]float64, 0, len(pts))
+	times := make([]time.Time, 0, len(pts))
+	for i, p := range pts {
+		ls = append(ls, p.pt)
+		sls = append(sls, p.smoothed)
+		inferred = append(inferred, p.inferred)
+		inferredConfs = append(inferredConfs, p.inferredConf)
+		times = append(times, p.time)
+		if i > 0 {
+			trip.Distance += geo.Distance(pts[i-1].pt, p.pt)
+			if isMovingActivity(p.activity) {
+				modes[p.activity] += p.time.Sub(pts[i-1].time)
+			}
+		}
+	}
+	if trip.Distance < s.opts.MinDistance {
+		return Trip{}, false
+	}
+	trip.Distance = toFixed(trip.Distance, 2)
+
+	trip.Mode = tripModeUnknown
+	var most time.Duration
+	for mode, d := range modes {
+		if d > most || (d == most && d > 0 && mode < trip.Mode) {
+			trip.Mode, most = mode, d
+		}
+	}
+
+	if mode, conf := segmentMode(inferred, inferredConfs, times); conf > 0 {
+		trip.InferredMode, trip.InferredModeConfidence = mode, conf
+	}
+
+	trip.BBox = ls.Bound()
+	// The threshold is in degrees; a degree of latitude is about 111km.
+	simplifier := simplify.DouglasPeucker(s.opts.SimplifyTolerance / 111320)
+	trip.Geometry = simplifier.Simplify(ls.Clone()).(orb.LineString)
+	if !sls.Equal(ls) {
+		trip.SmoothedGeometry = simplifier.Simplify(sls).(orb.LineString)
+	}
+	return trip, true
+}
+
+func buildTripKey(name string, start time.Time) []byte {
+	return []byte(fmt.Sprintf("%s+%d", name, start.Unix()))
+}
+
+func storeTrip(trip Trip) error {
+	v, err := json.Marshal(trip)
+	if err != nil {
+		return err
+	}
+	err = GetDB("master").Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(tripsKey)).Put(buildTripKey(trip.Name, trip.Start), v)
+	})
+	if err == nil {
+		log.Println("Stored trip", trip.Name, trip.Start, trip.Mode, math.Round(trip.Distance), "m")
+	}
+	return err
+}
+
+// tripState is a segmenter's trip in progress, as it's kept across restarts.
+type tripState struct {
+	UUID        string           `json:"uuid"`
+	Points      []tripPointSaved `json:"points"`
+	Anchor      int              `json:"anchor"`
+	Dwelling    bool             `json:"dwelling"`
+	DwellAt     orb.Point        `json:"dwellAt"`
+	Mode        string           `json:"mode"`
+	Pending     string           `json:"pending"`
+	PendingFrom int              `json:"pendingFrom"`
+}
+
+type tripPointSaved struct {
+	Pt           orb.Point `json:"pt"`
+	Smoothed     orb.Point `json:"smoothed"`
+	Time         time.Time `json:"time"`
+	Activity     string    `json:"activity,omitempty"`
+	Inferred     string    `json:"inferred,omitempty"`
+	InferredConf float64   `json:"inferredConf,omitempty"`
+}
+
+func (s *tripSegmenter) state() tripState {
+	st := tripState{UUID: s.uuid, Anchor: s.anchor, Dwelling: s.dwelling, DwellAt: s.dwellAt,
+		Mode: s.mode, Pending: s.pending, PendingFrom: s.pendingFrom, Points: make([]tripPointSaved, 0, len(s.pts))}
+	for _, p := range s.pts {
+		st.Points = append(st.Points, tripPointSaved{p.pt, p.smoothed, p.time, p.activity, p.inferred, p.inferredConf})
+	}
+	return st
+}
+
+func (s *tripSegmenter) restore(st tripState) {
+	s.uuid, s.anchor, s.dwelling, s.dwellAt = st.UUID, st.Anchor, st.Dwelling, st.DwellAt
+	s.mode, s.pending, s.pendingFrom = st.Mode, st.Pending, st.PendingFrom
+	s.pts = make([]tripPoint, 0, len(st.Points))
+	for _, p := range st.Points {
+		s.pts = append(s.pts, tripPoint{p.Pt, p.Smoothed, p.Time, p.Activity, p.Inferred, p.InferredConf})
+	}
+}
+
+// tripSegmenters holds the live segmenters, by cat name, for points arriving through storePoints.
+var tripSegmenters = map[string]*tripSegmenter{}
+var tripSegmentersLock sync.Mutex
+
+// segmentTrips feeds stored features through their cats' segmenters,
+// storing any trips they complete, then keeps their trips in progress.
+func segmentTrips(features []*geojson.Feature) {
+	tripSegmentersLock.Lock()
+	defer tripSegmentersLock.Unlock()
+
+	pushed := map[string]*tripSegmenter{}
+	for _, f := range features {
+		name, _ := f.Properties["Name"].(string)
+		s, ok := tripSegmenters[name]
+		if !ok {
+			uuid, _ := f.Properties["UUID"].(string)
+			s = newTripSegmenter(tripOptions, name, uuid)
+			st := tripState{}
+			if getLiveState(liveStateTrips, name, &st) {
+				s.restore(st)
+			}
+			tripSegmenters[name] = s
+		}
+		for _, trip := range s.push(f) {
+			if err := storeTrip(trip); err != nil {
+				log.Println("store trip error:", err)
+			}
+		}
+		pushed[name] = s
+	}
+	states := map[string]any{}
+	for name, s := range pushed {
+		states[name] = s.state()
+	}
+	if err := putLiveStates(liveStateTrips, states); err != nil {
+		log.Println("store trip state error:", err)
+	}
+}
+
+// TripToFeature converts a trip to a GeoJSON LineString feature of its simplified geometry.
+func TripToFeature(trip Trip) *geojson.Feature {
+	p := geojson.NewFeature(trip.Geometry)
+	p.BBox = geojson.NewBBox(trip.BBox)
+
+	props := make(map[string]interface{})
+	if alias := catnames.AliasOrName(trip.Name); alias != trip.Name {
+		props["Alias"] = alias
+	}
+	props["Name"] = trip.Name
+	props["UUID"] = trip.UUID
+	props["StartTime"] = trip.Start
+	props["EndTime"] = trip.End
+	props["Distance"] = trip.Distance
+	props["Duration"] = toFixed(trip.Duration.Seconds(), 0)
+	props["Mode"] = trip.Mode
+	if trip.InferredMode != "" {
+		props["InferredMode"] = trip.InferredMode
+		props["InferredModeConfidence"] = trip.InferredModeConfidence
+	}
+	props["PointCount"] = trip.PointCount
+
+	p.Properties = props
+	return p
+}
+
+func (q tripsQuery) match(trip Trip) bool {
+	if q.Cat != "" && q.Cat != trip.Name && q.Cat != catnames.AliasOrSanitizedName(trip.Name) {
+		return false
+	}
+	// Match any trip overlapping the queried time range.
+	if !q.End.IsZero() && trip.Start.After(q.End) {
+		return false
+	}
+	if !q.Start.IsZero() && trip.End.Before(q.Start) {
+		return false
+	}
+	return true
+}
+
+// getTrips returns the stored trips matching the query, newest first.
+func getTrips(q tripsQuery) ([]*geojson.Feature, error) {
+	trips := []Trip{}
+	err := GetDB("master").View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(tripsKey)).ForEach(func(k, v []byte) error {
+			trip := Trip{}
+			if err := json.Unmarshal(v, &trip); err != nil {
+				log.Println("error unmarshalling trip:", err)
+				return nil
+			}
+			if q.match(trip) {
+				trips = append(trips, trip)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(trips, func(i, j int) bool {
+		return trips[i].Start.After(trips[j].Start)
+	})
+
+	features := make([]*geojson.Feature, 0, len(trips))
+	for _, trip := range trips {
+		if q.Smoothed && len(trip.SmoothedGeometry) > 1 {
+			trip.Geometry = trip.SmoothedGeometry
+		}
+		features = append(features, TripToFeature(trip))
+	}
+	return features, nil
+}
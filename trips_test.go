@@ -0,0 +1,81 @@
+package catTrackslib
+
+import (
+	"testing"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+)
+
+func TestTripSegmenter(t *testing.T) {
+	t0 := time.Date(2024, 3, 2, 15, 0, 0, 0, time.UTC)
+	lat, lng := 44.98931, -93.25544
+	seconds := 0
+	point := func(activity string) *geojson.Feature {
+		f := geojson.NewFeature(orb.Point{lng, lat})
+		f.Properties = map[string]interface{}{
+			"Name":     "rye",
+			"UUID":     "05C63745-BFA3-4DE3-AF2F-CDE2173C0E11",
+			"Time":     t0.Add(time.Duration(seconds) * time.Second),
+			"Accuracy": 5.0,
+			"Activity": activity,
+		}
+		return f
+	}
+
+	s := newTripSegmenter(DefaultTripOptions, "rye", "05C63745-BFA3-4DE3-AF2F-CDE2173C0E11")
+	trips := []Trip{}
+	// move goes north for n points, meters and seconds per point at a time.
+	move := func(activity string, n int, meters float64, every int) {
+		for i := 0; i < n; i++ {
+			seconds += every
+			lat += meters / 110540
+			trips = append(trips, s.push(point(activity))...)
+		}
+	}
+
+	move("Stationary", 20, 0, 30)   // 10 minutes at home
+	move("Automotive", 36, 100, 10) // 3.6km in 6 minutes
+	move("Walking", 60, 8, 6)       // 480m in 6 minutes
+	move("Stationary", 20, 0, 30)   // 10 minutes at the park
+	move("Walking", 10, 50, 30)     // a stroll, recorded...
+	seconds += 3600                 // ...until the phone dies
+	move("Walking", 20, 0, 30)
+
+	if len(trips) != 3 {
+		for _, trip := range trips {
+			t.Log(trip.Start, trip.End, trip.Mode, trip.Distance)
+		}
+		t.Fatalf("got %d trips, want 3", len(trips))
+	}
+
+	want := []struct {
+		mode     string
+		distance float64
+		duration time.Duration
+	}{
+		{"Automotive", 3600, 6 * time.Minute},
+		{"Walking", 480, 6 * time.Minute},
+		{"Walking", 500, 5 * time.Minute},
+	}
+	for i, w := range want {
+		trip := trips[i]
+		if trip.Mode != w.mode {
+			t.Errorf("trip %d: got mode %s, want %s", i, trip.Mode, w.mode)
+		}
+		// Trips end where the cat came within DwellRadius of where it stopped.
+		if d := trip.Distance - w.distance; d < -w.distance/10-DefaultTripOptions.DwellRadius || d > w.distance/10 {
+			t.Errorf("trip %d: got distance %v, want about %v", i, trip.Distance, w.distance)
+		}
+		if d := trip.Duration - w.duration; d < -time.Minute || d > time.Minute {
+			t.Errorf("trip %d: got duration %v, want about %v", i, trip.Duration, w.duration)
+		}
+		if len(trip.Geometry) >= trip.PointCount {
+			t.Errorf("trip %d: geometry of %d points wasn't simplified from %d", i, len(trip.Geometry), trip.PointCount)
+		}
+	}
+	if !trips[0].End.Equal(trips[1].Start) {
+		t.Errorf("mode change split should share a point, got %v and %v", trips[0].End, trips[1].Start)
+	}
+}
@@ -1,6 +1,10 @@
 package catTrackslib
 
-import "encoding/binary"
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+)
 
 // i64tob returns an 8-byte big endian representation of v.
 func i64tob(v int64) []byte {
@@ -12,3 +16,12 @@ func i64tob(v int64) []byte {
 func i64fromb(b []byte) int64 {
 	return int64(binary.BigEndian.Uint64(b))
 }
+
+// randomHex returns n random bytes, hex encoded.
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
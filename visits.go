@@ -0,0 +1,255 @@
+package catTrackslib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	catnames "github.com/rotblauer/cattracks-names"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// visitSourceIOS marks visits reported by the iOS CLVisit API.
+	visitSourceIOS = "ios"
+	// visitSourceStayPoint marks visits detected from the track stream by the server.
+	visitSourceStayPoint = "staypoint"
+)
+
+// btw places are actually visits.
+// Visits are stored in the places bucket keyed by cat name and arrival time,
+// so that iOS re-reporting the same visit (eg. once on arrival, and again on departure)
+// collapses into one record.
+// The placesByCoord bucket indexes the same visits by lat+lng for bounding box queries.
+
+type visitsQuery struct {
+	Cat   string
+	Start time.Time
+	End   time.Time
+	BBox  *orb.Bound
+}
+
+func buildVisitKey(name string, arrival time.Time) []byte {
+	return []byte(fmt.Sprintf("%s+%d", name, arrival.Unix()))
+}
+
+func buildVisitCoordKey(nv NoteVisit, visitKey []byte) []byte {
+	k := Float64bytesBig(nv.PlaceParsed.Lat + 90)
+	k = append(k, Float64bytesBig(nv.PlaceParsed.Lng+180)...)
+	return append(k, visitKey...)
+}
+
+// featureVisit returns the valid visit carried by a feature, if any.
+// The Visit property is a VisitString when the feature was converted from a TrackPoint,
+// and a plain string when the feature was decoded from GeoJSON.
+func featureVisit(f *geojson.Feature) (nv NoteVisit, ok bool) {
+	var vs VisitString
+	switch v := f.Properties["Visit"].(type) {
+	case VisitString:
+		vs = v
+	case string:
+		vs = VisitString(v)
+	default:
+		return nv, false
+	}
+	if !(NoteStructured{Visit: vs}).HasValidVisit() {
+		return nv, false
+	}
+	nv, err := vs.AsVisit()
+	if err != nil {
+		return nv, false
+	}
+	return nv, true
+}
+
+// storeVisitFromFeature stores the visit carried by the feature, if any.
+// It returns true if the visit was new or updated.
+func storeVisitFromFeature(f *geojson.Feature) (bool, error) {
+	nv, ok := featureVisit(f)
+	if !ok {
+		return false, nil
+	}
+
+	nv.Source = visitSourceIOS
+	nv.Name, _ = f.Properties["Name"].(string)
+	nv.Uuid, _ = f.Properties["UUID"].(string)
+	nv.ReportedTime = mustGetTime(f)
+
+	place, err := nv.Place.AsPlace()
+	if err != nil {
+		// Fall back to the location of the point reporting the visit.
+		log.Println("visit place parse error:", err, "place:", nv.Place)
+		pt := f.Geometry.(orb.Point)
+		place.Lat, place.Lng = pt.Lat(), pt.Lon()
+		place.Acc, _ = f.Properties["Accuracy"].(float64)
+	}
+	nv.PlaceParsed = place
+
+	return storeVisit(nv)
+}
+
+// storeVisit writes the visit to the places bucket, deduplicating on cat and arrival time.
+// A visit with a known departure is never overwritten by one without.
+func storeVisit(nv NoteVisit) (stored bool, err error) {
+	if nv.HasDeparture() {
+		nv.Duration = nv.GetDuration()
+	}
+	k := buildVisitKey(nv.Name, nv.ArrivalTime)
+
+	err = GetDB("master").Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(placesKey))
+		bc := tx.Bucket([]byte(placesByCoord))
+
+		if existing := b.Get(k); existing != nil {
+			old := NoteVisit{}
+			if err := json.Unmarshal(existing, &old); err == nil {
+				if old.HasDeparture() && !nv.HasDeparture() {
+					return nil
+				}
+				if old.HasDeparture() == nv.HasDeparture() && old.DepartureTime.Equal(nv.DepartureTime) {
+					return nil
+				}
+				if err := bc.Delete(buildVisitCoordKey(old, k)); err != nil {
+					return err
+				}
+			}
+		}
+
+		v, err := json.Marshal(nv)
+		if err != nil {
+			return err
+		}
+		if err := b.Put(k, v); err != nil {
+			return err
+		}
+		if err := bc.Put(buildVisitCoordKey(nv, k), k); err != nil {
+			return err
+		}
+		stored = true
+		return nil
+	})
+	if err != nil || !stored {
+		return
+	}
+
+	log.Println("Stored visit", nv.Name, nv.ArrivalTime, nv.PlaceParsed.Identity)
+	markSignificantPlacesStale(nv.Name)
+
+	select {
+	case NotifyNewPlace <- true:
+	default:
+	}
+	select {
+	case FeaturePlaceChan <- VisitToFeature(nv):
+	default:
+	}
+	return
+}
+
+// VisitToFeature converts a visit to a GeoJSON point feature located at the visited place.
+func VisitToFeature(nv NoteVisit) *geojson.Feature {
+	p := geojson.NewFeature(orb.Point{nv.PlaceParsed.Lng, nv.PlaceParsed.Lat})
+
+	props := make(map[string]interface{})
+	if alias := catnames.AliasOrName(nv.Name); alias != nv.Name {
+		props["Alias"] = alias
+	}
+	props["Name"] = nv.Name
+	props["UUID"] = nv.Uuid
+	props["ReportedTime"] = nv.ReportedTime
+	props["ArrivalTime"] = nv.ArrivalTime
+	if nv.HasDeparture() {
+		props["DepartureTime"] = nv.DepartureTime
+	} else {
+		props["DepartureTime"] = nil
+	}
+	props["Duration"] = toFixed(nv.GetDuration().Seconds(), 0)
+	props["PlaceIdentity"] = nv.PlaceParsed.Identity
+	props["PlaceAddress"] = nv.PlaceParsed.Address
+	props["Accuracy"] = nv.PlaceParsed.Acc
+	props["Radius"] = nv.PlaceParsed.Radius
+	if nv.Source != "" {
+		props["Source"] = nv.Source
+	} else {
+		// Visits stored before sources were recorded all came from iOS.
+		props["Source"] = visitSourceIOS
+	}
+
+	p.Properties = props
+	return p
+}
+
+func (q visitsQuery) match(nv NoteVisit) bool {
+	if q.Cat != "" && q.Cat != nv.Name && q.Cat != catnames.AliasOrSanitizedName(nv.Name) {
+		return false
+	}
+	// Match any visit overlapping the queried time range.
+	if !q.End.IsZero() && nv.ArrivalTime.After(q.End) {
+		return false
+	}
+	if !q.Start.IsZero() && nv.HasDeparture() && nv.DepartureTime.Before(q.Start) {
+		return false
+	}
+	if q.BBox != nil && !q.BBox.Contains(orb.Point{nv.PlaceParsed.Lng, nv.PlaceParsed.Lat}) {
+		return false
+	}
+	return true
+}
+
+// getVisits returns the stored visits matching the query, newest arrivals first.
+func getVisits(q visitsQuery) ([]*geojson.Feature, error) {
+	visits := []NoteVisit{}
+
+	err := GetDB("master").View(func(tx *bolt.Tx) error {
+		collect := func(v []byte) {
+			nv := NoteVisit{}
+			if err := json.Unmarshal(v, &nv); err != nil {
+				log.Println("error unmarshalling visit for query:", err)
+				return
+			}
+			if q.match(nv) {
+				visits = append(visits, nv)
+			}
+		}
+
+		if q.BBox == nil {
+			return tx.Bucket([]byte(placesKey)).ForEach(func(k, v []byte) error {
+				if v != nil {
+					collect(v)
+				}
+				return nil
+			})
+		}
+
+		// Keys in placesByCoord are ordered by latitude first,
+		// so seek to the southern edge and stop at the northern one.
+		b := tx.Bucket([]byte(placesKey))
+		c := tx.Bucket([]byte(placesByCoord)).Cursor()
+		min := Float64bytesBig(q.BBox.Min.Lat() + 90)
+		max := Float64bytesBig(q.BBox.Max.Lat() + 90)
+		for k, vk := c.Seek(min); k != nil && bytes.Compare(k[:8], max) <= 0; k, vk = c.Next() {
+			if v := b.Get(vk); v != nil {
+				collect(v)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(visits, func(i, j int) bool {
+		return visits[i].ArrivalTime.After(visits[j].ArrivalTime)
+	})
+
+	features := make([]*geojson.Feature, 0, len(visits))
+	for _, nv := range visits {
+		features = append(features, VisitToFeature(nv))
+	}
+	return features, nil
+}
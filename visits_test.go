@@ -0,0 +1,108 @@
+package catTrackslib
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+)
+
+func TestVisits(t *testing.T) {
+	SetDBPath("master", filepath.Join(t.TempDir(), "m.db"))
+	if err := InitBoltDB(); err != nil {
+		t.Fatal(err)
+	}
+	defer GetDB("master").Close()
+
+	day := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	visit := func(name string, arrival time.Time, stay time.Duration, lng, lat float64) NoteVisit {
+		nv := NoteVisit{Name: name, Uuid: name + "-uuid", ArrivalTime: arrival, ReportedTime: arrival, Source: visitSourceIOS,
+			PlaceParsed: Place{Identity: name + "'s place", Lat: lat, Lng: lng}}
+		if stay > 0 {
+			nv.DepartureTime = arrival.Add(stay)
+		} else {
+			nv.DepartureTime = time.Date(4001, 1, 1, 0, 0, 0, 0, time.UTC) // still there, as iOS reports it
+		}
+		return nv
+	}
+
+	// iOS reports a visit on arrival, then again on departure, and sometimes repeats itself.
+	arrived := visit("rye", day.Add(9*time.Hour), 0, -93.25, 44.98)
+	left := visit("rye", day.Add(9*time.Hour), 2*time.Hour, -93.25, 44.98)
+	for _, c := range []struct {
+		name string
+		nv   NoteVisit
+		want bool
+	}{
+		{"arrival", arrived, true},
+		{"arrival again", arrived, false},
+		{"departure", left, true},
+		{"departure again", left, false},
+		{"arrival after departure", arrived, false},
+	} {
+		if stored, err := storeVisit(c.nv); err != nil || stored != c.want {
+			t.Errorf("%s: got stored %v (%v), want %v", c.name, stored, err, c.want)
+		}
+	}
+	storeVisit(visit("rye", day.Add(14*time.Hour), time.Hour, -93.1, 44.9))
+	storeVisit(visit("ia", day.Add(10*time.Hour), 3*time.Hour, 10, 50))
+
+	names := func(fs []*geojson.Feature) []string {
+		out := []string{}
+		for _, f := range fs {
+			out = append(out, f.Properties["Name"].(string)+"@"+f.Properties["ArrivalTime"].(time.Time).Format("15"))
+		}
+		return out
+	}
+	for _, c := range []struct {
+		name string
+		q    visitsQuery
+		want []string
+	}{
+		{"all, newest first", visitsQuery{}, []string{"rye@14", "ia@10", "rye@09"}},
+		{"a cat's", visitsQuery{Cat: "rye"}, []string{"rye@14", "rye@09"}},
+		{"overlapping the start", visitsQuery{Start: day.Add(10 * time.Hour)}, []string{"rye@14", "ia@10", "rye@09"}},
+		{"after they left", visitsQuery{Start: day.Add(11*time.Hour + time.Minute)}, []string{"rye@14", "ia@10"}},
+		{"before they arrived", visitsQuery{End: day.Add(12 * time.Hour)}, []string{"ia@10", "rye@09"}},
+		{"in the box", visitsQuery{BBox: &orb.Bound{Min: orb.Point{-94, 44.95}, Max: orb.Point{-93, 45}}}, []string{"rye@09"}},
+		{"a cat's in the box", visitsQuery{Cat: "ia", BBox: &orb.Bound{Min: orb.Point{-94, 44}, Max: orb.Point{-93, 45}}}, []string{}},
+	} {
+		got, err := getVisits(c.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if g := strings.Join(names(got), ","); g != strings.Join(c.want, ",") {
+			t.Errorf("%s: got %v, want %v", c.name, g, c.want)
+		}
+	}
+
+	srv := httptest.NewServer(NewRouter(&RouterOpts{DisableWebsocket: true}))
+	defer srv.Close()
+	res, err := srv.Client().Get(srv.URL + "/visits?cat=rye&start=" + day.Format(time.RFC3339) + "&end=" + day.Add(12*time.Hour).Format(time.RFC3339))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, _ := io.ReadAll(res.Body)
+	fc, err := geojson.UnmarshalFeatureCollection(b)
+	if res.StatusCode != http.StatusOK || err != nil || len(fc.Features) != 1 {
+		t.Fatalf("got %d %s", res.StatusCode, b)
+	}
+	props := fc.Features[0].Properties
+	if props["DepartureTime"] != left.DepartureTime.Format(time.RFC3339) || props["Duration"] != float64(2*60*60) {
+		t.Errorf("got departure %v and duration %v, want the departure and 2h", props["DepartureTime"], props["Duration"])
+	}
+	if fc.Features[0].Point() != (orb.Point{-93.25, 44.98}) || props["PlaceIdentity"] != "rye's place" || props["Source"] != visitSourceIOS {
+		t.Errorf("got %v %v", fc.Features[0].Geometry, props)
+	}
+
+	if res, _ := srv.Client().Get(srv.URL + "/visits?bbox=1,2,3"); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("got %d, want a bad bbox refused", res.StatusCode)
+	}
+}